@@ -22,12 +22,17 @@ export CGO_ENABLED=0
 
 # Get the list of lambda directories
 LAMBDA_DIRS=(
+  "authorizer"
   "customer"
   "lead"
+  "notify"
   "ops"
   "partner"
   "profile"
+  "purge"
+  "stream"
   "user"
+  "webhook"
 )
 
 # Track build status
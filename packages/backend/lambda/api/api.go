@@ -0,0 +1,51 @@
+// Package api holds the request plumbing the REST Lambdas share: the JSON
+// error envelope, request logging, the rbac policy check, ETag versioning,
+// JSON Merge Patch, soft delete, body validation and idempotency keys, plus
+// the audit log and outbox writes, which the AppSync resolvers use too.
+//
+// Each function calls Use from its init with its DynamoDB client and the
+// shared tables it writes to.
+package api
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDB is the part of *dynamodb.Client the helpers call.
+type DynamoDB interface {
+	GetItem(ctx context.Context, in *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, in *dynamodb.PutItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, in *dynamodb.DeleteItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	TransactWriteItems(ctx context.Context, in *dynamodb.TransactWriteItemsInput, opts ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// Tables names the shared tables. A function leaves out the ones it does
+// not write to.
+type Tables struct {
+	Audit       string
+	Idempotency string
+	Outbox      string
+}
+
+var (
+	db     DynamoDB
+	tables Tables
+)
+
+// Use sets the client and tables the helpers work with.
+func Use(client DynamoDB, t Tables) {
+	db, tables = client, t
+}
+
+// MarshalItem encodes v using its json field names so stored attributes
+// match the camelCase names in app_design/dynamodb.
+func MarshalItem(v interface{}) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMapWithOptions(v, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
+}
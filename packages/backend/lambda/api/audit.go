@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Writes to referrals, payments, bonus pools, partner compensation and
+// status, and customer merges append an event to the audit table in the
+// same transaction as the write, so no change is stored without its
+// history. Events are only ever put, never updated or deleted: PK
+// AUDIT#<entityType>#<entityId>, SK <at>#<id>, with the ActorIndex GSI on
+// actor and at.
+
+// Audited entity types.
+const (
+	AuditReferral            = "referral"
+	AuditPayment             = "payment"
+	AuditBonusPool           = "bonusPool"
+	AuditPartnerCompensation = "partnerCompensation"
+	AuditPartnerStatus       = "partnerStatus"
+	AuditCustomer            = "customer"
+)
+
+// AuditEntityTypes are the entity types events are recorded for.
+var AuditEntityTypes = []string{AuditReferral, AuditPayment, AuditBonusPool, AuditPartnerCompensation, AuditPartnerStatus, AuditCustomer}
+
+// FieldChange is one top-level field that differs between the before and
+// after states. A missing Before means the field was added, a missing After
+// that it was removed.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// AuditEvent is one immutable entry in the audit log.
+type AuditEvent struct {
+	ID         string        `json:"id"`
+	EntityType string        `json:"entityType"`
+	EntityID   string        `json:"entityId"`
+	Action     string        `json:"action"`
+	Actor      string        `json:"actor"`
+	At         string        `json:"at"`
+	Changes    []FieldChange `json:"changes"`
+}
+
+// auditIgnoredFields change on every write and would only add noise.
+var auditIgnoredFields = map[string]bool{"updatedAt": true, "version": true}
+
+// NewAuditEvent describes the change from before to after. A nil before is a
+// CREATE and a nil after a DELETE. It returns nil when no audited field
+// changed.
+func NewAuditEvent(entityType, entityID, actor string, before, after interface{}) (*AuditEvent, error) {
+	old, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for name := range old {
+		names[name] = true
+	}
+	for name := range updated {
+		names[name] = true
+	}
+	var changes []FieldChange
+	for name := range names {
+		if !auditIgnoredFields[name] && !reflect.DeepEqual(old[name], updated[name]) {
+			changes = append(changes, FieldChange{Field: name, Before: old[name], After: updated[name]})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	action := "UPDATE"
+	switch {
+	case old == nil:
+		action = "CREATE"
+	case updated == nil:
+		action = "DELETE"
+	}
+	return &AuditEvent{
+		ID:         uuid.NewString(),
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Actor:      actor,
+		At:         time.Now().UTC().Format(time.RFC3339Nano),
+		Changes:    changes,
+	}, nil
+}
+
+// auditFields returns the JSON fields of v, or nil if v is nil.
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	if rv := reflect.ValueOf(v); !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// AuditWrite is the transaction item that appends e. The condition makes an
+// event impossible to overwrite.
+func AuditWrite(e AuditEvent) (types.TransactWriteItem, error) {
+	item, err := MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		AuditEvent
+	}{
+		PK:         fmt.Sprintf("AUDIT#%s#%s", e.EntityType, e.EntityID),
+		SK:         fmt.Sprintf("%s#%s", e.At, e.ID),
+		AuditEvent: e,
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(tables.Audit),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}}, nil
+}
+
+// WriteAudited performs write in one transaction with the audit events,
+// skipping nil ones. A failed condition on write is returned as a
+// *types.ConditionalCheckFailedException, as a single-item write would.
+func WriteAudited(ctx context.Context, write types.TransactWriteItem, events ...*AuditEvent) error {
+	return WriteWithOutbox(ctx, []types.TransactWriteItem{write}, nil, events...)
+}
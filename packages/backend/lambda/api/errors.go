@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Error is the body of every non-2xx REST response:
+// {"error":{"code","message","details","requestId"}}.
+type Error struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	// ExistingID names the record a duplicate create collided with.
+	ExistingID string `json:"existingId,omitempty"`
+}
+
+// FieldError describes a single invalid field in a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "BAD_REQUEST",
+	http.StatusUnauthorized:        "UNAUTHORIZED",
+	http.StatusForbidden:           "FORBIDDEN",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusConflict:            "CONFLICT",
+	http.StatusPreconditionFailed:  "PRECONDITION_FAILED",
+	http.StatusInternalServerError: "INTERNAL_ERROR",
+}
+
+func ErrorResponse(ctx context.Context, status int, code, msg string, details []FieldError) (events.APIGatewayProxyResponse, error) {
+	return WriteError(ctx, status, Error{Code: code, Message: msg, Details: details})
+}
+
+// WriteError returns e as the error envelope, stamped with the request ID.
+func WriteError(ctx context.Context, status int, e Error) (events.APIGatewayProxyResponse, error) {
+	e.RequestID = RequestID(ctx)
+	body, _ := json.Marshal(struct {
+		Error Error `json:"error"`
+	}{e})
+	return events.APIGatewayProxyResponse{StatusCode: status, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+func ClientError(ctx context.Context, status int, msg string) (events.APIGatewayProxyResponse, error) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "ERROR"
+	}
+	return ErrorResponse(ctx, status, code, msg, nil)
+}
+
+func NotFound(ctx context.Context, msg string) (events.APIGatewayProxyResponse, error) {
+	return ClientError(ctx, http.StatusNotFound, msg)
+}
+
+// ValidationError reports one entry per invalid field.
+func ValidationError(ctx context.Context, details []FieldError) (events.APIGatewayProxyResponse, error) {
+	return ErrorResponse(ctx, http.StatusBadRequest, "VALIDATION_FAILED", "request failed validation", details)
+}
+
+// BodyError turns a JSON decoding error into a 400, naming the offending field
+// when the decoder knows it.
+func BodyError(ctx context.Context, err error) (events.APIGatewayProxyResponse, error) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return ValidationError(ctx, []FieldError{{Field: typeErr.Field, Message: "must be " + jsonTypeName(typeErr.Type)}})
+	}
+	return ClientError(ctx, http.StatusBadRequest, "invalid body")
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// ServerError logs err in full and returns a generic 500 that only exposes the
+// correlation ID to the client.
+func ServerError(ctx context.Context, err error) (events.APIGatewayProxyResponse, error) {
+	LoggerFrom(ctx).ErrorContext(ctx, "internal error", slog.String("error", err.Error()))
+	return ErrorResponse(ctx, http.StatusInternalServerError, errorCodes[http.StatusInternalServerError], "internal server error", nil)
+}
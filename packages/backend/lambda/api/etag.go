@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Stored records carry a version attribute that starts at 1 and is
+// incremented on every write. It is returned as a strong ETag, and writes are
+// conditioned on the version the caller last saw: the one named by If-Match,
+// or, without that header, the one the handler just read.
+
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// Header returns the named request header, matched case-insensitively.
+func Header(req events.APIGatewayProxyRequest, name string) string {
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// IfMatch reports whether the If-Match header of req admits the stored
+// record at version. A missing header admits anything; a present one never
+// matches a record that does not exist.
+func IfMatch(req events.APIGatewayProxyRequest, version int, exists bool) bool {
+	h := Header(req, "If-Match")
+	if h == "" {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	for _, tag := range strings.Split(h, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionCondition returns a condition that holds only while the stored
+// record is still at version. Version 0 stands for a record written before
+// versioning, which has no version attribute.
+func VersionCondition(version int) (string, map[string]string, map[string]types.AttributeValue) {
+	names := map[string]string{"#version": "version"}
+	values := map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+	}
+	if version == 0 {
+		return "attribute_exists(PK) AND (attribute_not_exists(#version) OR #version = :version)", names, values
+	}
+	return "#version = :version", names, values
+}
+
+func PreconditionFailed(ctx context.Context) (events.APIGatewayProxyResponse, error) {
+	return ClientError(ctx, http.StatusPreconditionFailed, "resource was modified by another request; fetch it again and retry")
+}
+
+// WithETag sets the ETag header for a record at version.
+func WithETag(resp events.APIGatewayProxyResponse, version int) events.APIGatewayProxyResponse {
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["ETag"] = etag(version)
+	return resp
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A create request may carry an Idempotency-Key header. The first request
+// with a key claims it in the idempotency table and, once it succeeds,
+// stores its response there; a retry with the same key and body gets that
+// response back instead of creating another record. Keys are scoped to the
+// operation and the caller, and expire after idempotencyTTL. PK
+// IDEMPOTENCY#<operation>#<actor>#<key>, SK RESPONSE.
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader marks a response that was stored, not produced anew.
+	replayedHeader          = "Idempotent-Replayed"
+	idempotencyTTL          = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+
+	idempotencyInProgress = "IN_PROGRESS"
+	idempotencyCompleted  = "COMPLETED"
+)
+
+// idempotencyRecord is the claim on a key and, once completed, the response
+// to replay.
+type idempotencyRecord struct {
+	PK          string            `dynamodbav:"PK"`
+	SK          string            `dynamodbav:"SK"`
+	RequestHash string            `dynamodbav:"requestHash"`
+	Status      string            `dynamodbav:"status"`
+	StatusCode  int               `dynamodbav:"statusCode,omitempty"`
+	Body        string            `dynamodbav:"body,omitempty"`
+	Headers     map[string]string `dynamodbav:"headers,omitempty"`
+	CreatedAt   string            `dynamodbav:"createdAt"`
+	ExpiresAt   int64             `dynamodbav:"expiresAt"`
+}
+
+func (r idempotencyRecord) key() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: r.PK},
+		"SK": &types.AttributeValueMemberS{Value: r.SK},
+	}
+}
+
+// WithIdempotency runs create unless req repeats an earlier request with the
+// same Idempotency-Key. A repeat with the same body gets the stored
+// response; one with a different body is rejected with 422, and one that
+// arrives while the first is still running with 409. Only 2xx responses are
+// stored: after a failure the claim is released so the client can retry
+// with the same key.
+func WithIdempotency(ctx context.Context, req events.APIGatewayProxyRequest, operation string, create func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	key := Header(req, idempotencyHeader)
+	if key == "" {
+		return create(ctx, req)
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return ValidationError(ctx, []FieldError{{Field: idempotencyHeader, Message: fmt.Sprintf("must be at most %d characters", maxIdempotencyKeyLength)}})
+	}
+	sum := sha256.Sum256([]byte(req.Body))
+	now := time.Now().UTC()
+	claim := idempotencyRecord{
+		PK:          fmt.Sprintf("IDEMPOTENCY#%s#%s#%s", operation, Actor(req), key),
+		SK:          "RESPONSE",
+		RequestHash: hex.EncodeToString(sum[:]),
+		Status:      idempotencyInProgress,
+		CreatedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(idempotencyTTL).Unix(),
+	}
+	item, err := attributevalue.MarshalMap(claim)
+	if err != nil {
+		return ServerError(ctx, err)
+	}
+	// TTL deletion lags, so an expired record counts as absent.
+	_, err = db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tables.Idempotency),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) OR expiresAt < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return replayIdempotent(ctx, claim)
+	}
+	if err != nil {
+		return ServerError(ctx, err)
+	}
+
+	resp, err := create(ctx, req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		releaseIdempotencyKey(ctx, claim)
+		return resp, err
+	}
+	completeIdempotencyKey(ctx, claim, resp)
+	return resp, nil
+}
+
+// replayIdempotent answers a request whose key is already claimed.
+func replayIdempotent(ctx context.Context, claim idempotencyRecord) (events.APIGatewayProxyResponse, error) {
+	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tables.Idempotency),
+		Key:            claim.key(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return ServerError(ctx, err)
+	}
+	if out.Item == nil {
+		// Released between our put and this read.
+		return ClientError(ctx, http.StatusConflict, "a request with this Idempotency-Key just failed; retry it")
+	}
+	var stored idempotencyRecord
+	if err := attributevalue.UnmarshalMap(out.Item, &stored); err != nil {
+		return ServerError(ctx, err)
+	}
+	switch {
+	case stored.RequestHash != claim.RequestHash:
+		return ErrorResponse(ctx, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", "Idempotency-Key was already used with a different request body", nil)
+	case stored.Status != idempotencyCompleted:
+		return ClientError(ctx, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+	}
+	headers := map[string]string{}
+	for k, v := range stored.Headers {
+		headers[k] = v
+	}
+	headers[replayedHeader] = "true"
+	return events.APIGatewayProxyResponse{StatusCode: stored.StatusCode, Body: stored.Body, Headers: headers}, nil
+}
+
+// completeIdempotencyKey stores resp as the response to replay. A failure
+// is only logged: the record was created, and retries see 409 until the
+// claim expires.
+func completeIdempotencyKey(ctx context.Context, claim idempotencyRecord, resp events.APIGatewayProxyResponse) {
+	headers, err := attributevalue.Marshal(resp.Headers)
+	if err != nil {
+		headers = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}}
+	}
+	_, err = db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(tables.Idempotency),
+		Key:                      claim.key(),
+		UpdateExpression:         aws.String("SET #status = :done, statusCode = :code, #body = :body, #headers = :headers"),
+		ExpressionAttributeNames: map[string]string{"#status": "status", "#body": "body", "#headers": "headers"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":done":    &types.AttributeValueMemberS{Value: idempotencyCompleted},
+			":code":    &types.AttributeValueMemberN{Value: strconv.Itoa(resp.StatusCode)},
+			":body":    &types.AttributeValueMemberS{Value: resp.Body},
+			":headers": headers,
+		},
+	})
+	if err != nil {
+		Logger.ErrorContext(ctx, "storing idempotent response failed", slog.String("key", claim.PK), slog.String("error", err.Error()))
+	}
+}
+
+// releaseIdempotencyKey deletes a claim whose request failed.
+func releaseIdempotencyKey(ctx context.Context, claim idempotencyRecord) {
+	_, err := db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(tables.Idempotency),
+		Key:                      claim.key(),
+		ConditionExpression:      aws.String("#status = :inProgress"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress": &types.AttributeValueMemberS{Value: idempotencyInProgress},
+		},
+	})
+	if err != nil {
+		Logger.ErrorContext(ctx, "releasing idempotency key failed", slog.String("key", claim.PK), slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Handler is an API Gateway proxy handler.
+type Handler func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+type requestLogKey struct{}
+
+// requestLog carries the request-scoped logger and correlation ID.
+type requestLog struct {
+	logger    *slog.Logger
+	requestID string
+}
+
+// WithLogging logs every invocation with the API Gateway request ID, the
+// caller's sub, the route and the latency, and stores a request-scoped logger
+// on the context.
+func WithLogging(next Handler) Handler {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		requestID := req.RequestContext.RequestID
+		l := Logger.With(
+			slog.String("requestId", requestID),
+			slog.String("route", req.HTTPMethod+" "+req.Resource),
+			slog.String("sub", CallerSub(req)),
+		)
+		if lc, ok := lambdacontext.FromContext(ctx); ok {
+			l = l.With(slog.String("awsRequestId", lc.AwsRequestID))
+		}
+		ctx = context.WithValue(ctx, requestLogKey{}, requestLog{logger: l, requestID: requestID})
+
+		resp, err := next(ctx, req)
+
+		if resp.Headers == nil {
+			resp.Headers = map[string]string{}
+		}
+		resp.Headers["X-Request-Id"] = requestID
+		level := slog.LevelInfo
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		l.Log(ctx, level, "request completed",
+			slog.Int("status", resp.StatusCode),
+			slog.Int64("latencyMs", time.Since(start).Milliseconds()),
+		)
+		return resp, err
+	}
+}
+
+func requestLogFrom(ctx context.Context) requestLog {
+	if rl, ok := ctx.Value(requestLogKey{}).(requestLog); ok {
+		return rl
+	}
+	return requestLog{logger: Logger}
+}
+
+// LoggerFrom returns the request-scoped logger WithLogging stored on ctx, or
+// Logger outside a request.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	return requestLogFrom(ctx).logger
+}
+
+// RequestID returns the API Gateway request ID of the request on ctx.
+func RequestID(ctx context.Context) string {
+	return requestLogFrom(ctx).requestID
+}
+
+// CallerSub returns the Cognito sub of the caller when the request passed
+// through an authorizer, or an empty string otherwise.
+func CallerSub(req events.APIGatewayProxyRequest) string {
+	if claims, ok := req.RequestContext.Authorizer["claims"].(map[string]interface{}); ok {
+		if sub, ok := claims["sub"].(string); ok {
+			return sub
+		}
+	}
+	if sub, ok := req.RequestContext.Authorizer["sub"].(string); ok {
+		return sub
+	}
+	return ""
+}
+
+// AuthorizedPartner returns the partner the partner authorizer resolved the
+// caller's credential to, or an empty string for other callers.
+func AuthorizedPartner(req events.APIGatewayProxyRequest) string {
+	id, _ := req.RequestContext.Authorizer["partnerId"].(string)
+	return id
+}
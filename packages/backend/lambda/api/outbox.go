@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Side effects of a write, such as notifying someone, posting to the ledger
+// or replaying a webhook delivery, are not performed here. They are recorded
+// as outbox messages in the same transaction as the write, and the relay
+// (the stream function, reading the outbox table's stream) delivers them
+// afterwards, at least once. PK OUTBOX#<dedupKey>, SK MESSAGE; messages
+// expire through the expiresAt TTL.
+
+// Outbox topics, delivered as the EventBridge detail-type.
+const (
+	TopicReferralSubmitted      = "notification.referralSubmitted"
+	TopicPaymentPosted          = "ledger.paymentPosted"
+	TopicWebhookReplayRequested = "webhook.replayRequested"
+)
+
+// outboxRetention is how long a message stays in the outbox after it is
+// written. The relay sees it within seconds; the rest is for inspection.
+const outboxRetention = 7 * 24 * time.Hour
+
+// OutboxMessage is one side effect to deliver. ID is the deduplication key:
+// it is derived from the write, so the same logical write always yields the
+// same ID and consumers drop repeats by it.
+type OutboxMessage struct {
+	ID        string      `json:"id"`
+	Topic     string      `json:"topic"`
+	Payload   interface{} `json:"payload"`
+	CreatedAt string      `json:"createdAt"`
+	ExpiresAt int64       `json:"expiresAt"`
+}
+
+// NewOutboxMessage returns a message for topic. The key parts are joined
+// into the deduplication key.
+func NewOutboxMessage(topic string, payload interface{}, key ...string) OutboxMessage {
+	id := topic
+	for _, k := range key {
+		id += "#" + k
+	}
+	now := time.Now().UTC()
+	return OutboxMessage{
+		ID:        id,
+		Topic:     topic,
+		Payload:   payload,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(outboxRetention).Unix(),
+	}
+}
+
+// OutboxWrite is the transaction item that records m. A message with the
+// same key cannot be recorded twice.
+func OutboxWrite(m OutboxMessage) (types.TransactWriteItem, error) {
+	item, err := MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		OutboxMessage
+	}{
+		PK:            "OUTBOX#" + m.ID,
+		SK:            "MESSAGE",
+		OutboxMessage: m,
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(tables.Outbox),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}}, nil
+}
+
+// WriteWithOutbox performs writes in one transaction with the outbox
+// messages and the audit events, skipping nil events. A failed condition on
+// the first of writes is returned as a *types.ConditionalCheckFailedException,
+// as a single-item write would.
+func WriteWithOutbox(ctx context.Context, writes []types.TransactWriteItem, messages []OutboxMessage, events ...*AuditEvent) error {
+	items := append([]types.TransactWriteItem{}, writes...)
+	for _, m := range messages {
+		w, err := OutboxWrite(m)
+		if err != nil {
+			return err
+		}
+		items = append(items, w)
+	}
+	for _, e := range events {
+		if e == nil {
+			continue
+		}
+		w, err := AuditWrite(*e)
+		if err != nil {
+			return err
+		}
+		items = append(items, w)
+	}
+	_, err := db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 && aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return &types.ConditionalCheckFailedException{Message: canceled.Message}
+	}
+	return err
+}
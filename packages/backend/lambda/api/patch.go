@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PATCH bodies are JSON Merge Patches (RFC 7396): members set a value, null
+// removes it and nested objects merge. The patch is applied to the stored
+// record so the result can be validated as a whole, and only the top-level
+// attributes it names are written back through an UpdateExpression.
+
+// ReadOnlyFields are managed by the server on every record.
+var ReadOnlyFields = []string{"id", "createdAt", "updatedAt", "version", "deletedAt", "deletedBy"}
+
+var errPatchNotObject = errors.New("merge patch must be a JSON object")
+
+func ParsePatch(body string) (map[string]json.RawMessage, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &patch); err != nil || patch == nil {
+		return nil, errPatchNotObject
+	}
+	return patch, nil
+}
+
+// CheckPatchFields rejects patch members that are not JSON fields of v, or
+// that are read-only: the common server-managed fields plus readOnly.
+func CheckPatchFields(patch map[string]json.RawMessage, v interface{}, readOnly ...string) []FieldError {
+	known := map[string]bool{}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	locked := map[string]bool{}
+	for _, name := range append(ReadOnlyFields, readOnly...) {
+		locked[name] = true
+	}
+	var errs []FieldError
+	for _, name := range SortedKeys(patch) {
+		switch {
+		case !known[name]:
+			errs = append(errs, FieldError{Field: name, Message: "is not a known field"})
+		case locked[name]:
+			errs = append(errs, FieldError{Field: name, Message: "is read-only"})
+		}
+	}
+	return errs
+}
+
+// ApplyPatch merges patch into the JSON form of current and decodes the
+// result into dst.
+func ApplyPatch(current interface{}, patch map[string]json.RawMessage, dst interface{}) error {
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	for name, value := range patch {
+		var v interface{}
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+		if v == nil {
+			delete(doc, name)
+		} else {
+			doc[name] = mergeValue(doc[name], v)
+		}
+	}
+	merged, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(merged, dst)
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergeValue(t[k], v)
+		}
+	}
+	return t
+}
+
+// PatchUpdate builds an UpdateExpression that copies fields from item, the
+// marshalled result of the patch, removes the fields item no longer has,
+// stamps updatedAt and bumps the version. cond is the version condition for
+// the stored record; names and values serve both expressions.
+func PatchUpdate(fields []string, item map[string]types.AttributeValue, updatedAt string, version int) (update string, cond string, names map[string]string, values map[string]types.AttributeValue) {
+	cond, names, values = VersionCondition(version)
+	set := []string{"#updatedAt = :updatedAt", "#version = :nextVersion"}
+	names["#updatedAt"] = "updatedAt"
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: updatedAt}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)}
+	var remove []string
+	for i, name := range fields {
+		ref := fmt.Sprintf("#p%d", i)
+		names[ref] = name
+		if v, ok := item[name]; ok {
+			values[fmt.Sprintf(":p%d", i)] = v
+			set = append(set, fmt.Sprintf("%s = :p%d", ref, i))
+		} else {
+			remove = append(remove, ref)
+		}
+	}
+	update = "SET " + strings.Join(set, ", ")
+	if len(remove) > 0 {
+		update += " REMOVE " + strings.Join(remove, ", ")
+	}
+	return update, cond, names, values
+}
+
+func SortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,29 @@
+package api
+
+// Payment amounts are stored in whole USD cents and a payment that went out
+// has the status PROCESSED. Older clients wrote "Paid" for the same thing,
+// so both count as earnings. Dashboards report earnings in dollars.
+
+// PaymentStatusProcessed is the status of a payment that has been sent.
+const PaymentStatusProcessed = "PROCESSED"
+
+// legacyPaymentStatusPaid is what older clients wrote for PROCESSED.
+const legacyPaymentStatusPaid = "Paid"
+
+// EarnedPaymentStatuses are the payment statuses counted as earnings.
+var EarnedPaymentStatuses = []string{PaymentStatusProcessed, legacyPaymentStatusPaid}
+
+// PaymentEarned reports whether a payment in status counts as earnings.
+func PaymentEarned(status string) bool {
+	for _, s := range EarnedPaymentStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CentsToDollars converts a stored amount to the dollars the dashboards show.
+func CentsToDollars(cents int64) float64 {
+	return float64(cents) / 100
+}
@@ -0,0 +1,17 @@
+package api
+
+import "testing"
+
+func TestPaymentEarned(t *testing.T) {
+	for status, want := range map[string]bool{"PROCESSED": true, "Paid": true, "PENDING": false, "FAILED": false, "": false} {
+		if got := PaymentEarned(status); got != want {
+			t.Errorf("PaymentEarned(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestCentsToDollars(t *testing.T) {
+	if got := CentsToDollars(150050); got != 1500.50 {
+		t.Errorf("CentsToDollars(150050) = %v", got)
+	}
+}
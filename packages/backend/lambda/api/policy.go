@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"rbac"
+)
+
+// WithPolicy checks every request against the shared rbac policy before it
+// reaches its handler. Only requests the policy allows get through: a route
+// it does not know is a 404, so a route added without a policy entry is
+// never served unchecked.
+func WithPolicy(next Handler) Handler {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		action, err := rbac.Check(Identity(req), req.HTTPMethod+" "+req.Resource, req.PathParameters)
+		switch {
+		case err == nil:
+			return next(ctx, req)
+		case errors.Is(err, rbac.ErrUnauthenticated):
+			return ClientError(ctx, http.StatusUnauthorized, "sign-in required")
+		case errors.Is(err, rbac.ErrForbidden):
+			return ClientError(ctx, http.StatusForbidden, "not allowed to "+string(action))
+		case errors.Is(err, rbac.ErrNoRoute):
+			return NotFound(ctx, "route not found")
+		}
+		return ServerError(ctx, err)
+	}
+}
+
+// Identity is the caller as the Cognito or partner authorizer described it.
+// REST authorizers flatten cognito:groups into a string such as
+// "admins,team_lead" or "[admins team_lead]".
+func Identity(req events.APIGatewayProxyRequest) rbac.Identity {
+	claims, _ := req.RequestContext.Authorizer["claims"].(map[string]interface{})
+	groups, _ := claims["cognito:groups"].(string)
+	return rbac.Identity{
+		Sub: CallerSub(req),
+		Groups: strings.FieldsFunc(strings.Trim(groups, "[]"), func(r rune) bool {
+			return r == ',' || r == ' '
+		}),
+		PartnerID: AuthorizedPartner(req),
+	}
+}
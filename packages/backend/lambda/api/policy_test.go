@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestWithPolicy(t *testing.T) {
+	called := false
+	h := WithPolicy(func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		called = true
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	request := func(method, resource, sub string, params map[string]string) events.APIGatewayProxyRequest {
+		req := events.APIGatewayProxyRequest{HTTPMethod: method, Resource: resource, PathParameters: params}
+		if sub != "" {
+			req.RequestContext.Authorizer = map[string]interface{}{"claims": map[string]interface{}{"sub": sub}}
+		}
+		return req
+	}
+	cases := []struct {
+		name string
+		req  events.APIGatewayProxyRequest
+		want int
+	}{
+		{"allowed", request(http.MethodGet, "/users/{userId}", "u1", map[string]string{"userId": "u1"}), http.StatusOK},
+		{"signed out", request(http.MethodGet, "/users/{userId}", "", map[string]string{"userId": "u1"}), http.StatusUnauthorized},
+		{"forbidden", request(http.MethodGet, "/users/{userId}", "u2", map[string]string{"userId": "u1"}), http.StatusForbidden},
+		{"route without a policy", request(http.MethodGet, "/nowhere", "u1", nil), http.StatusNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			called = false
+			resp, err := h(context.Background(), c.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != c.want || called != (c.want == http.StatusOK) {
+				t.Errorf("status %d, handler called %v; want %d", resp.StatusCode, called, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DELETE only marks a record with deletedAt and deletedBy. Deleted records
+// are hidden from reads and lists unless ?includeDeleted=true is given, an
+// admin can restore them, and the purge job removes them for good once they
+// are past its retention period.
+
+func IncludeDeleted(req events.APIGatewayProxyRequest) bool {
+	return req.QueryStringParameters["includeDeleted"] == "true"
+}
+
+// Actor names who made the request: the caller's Cognito sub, the partner
+// on partner API routes, or the API key for key-only routes.
+func Actor(req events.APIGatewayProxyRequest) string {
+	if sub := CallerSub(req); sub != "" {
+		return sub
+	}
+	if id := AuthorizedPartner(req); id != "" {
+		return "partner:" + id
+	}
+	if id := req.RequestContext.Identity.APIKeyID; id != "" {
+		return "apikey:" + id
+	}
+	return "unknown"
+}
+
+// MarkDeleted soft-deletes the record at key if it is still at version and
+// not already deleted.
+func MarkDeleted(ctx context.Context, table string, key map[string]types.AttributeValue, version int, by string) error {
+	cond, names, values := VersionCondition(version)
+	names["#deletedAt"] = "deletedAt"
+	names["#deletedBy"] = "deletedBy"
+	values[":deletedAt"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	values[":deletedBy"] = &types.AttributeValueMemberS{Value: by}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)}
+	_, err := db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #deletedAt = :deletedAt, #deletedBy = :deletedBy, #version = :nextVersion"),
+		ConditionExpression:       aws.String("(" + cond + ") AND attribute_not_exists(#deletedAt)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// RestoreDeleted clears the deletion mark on the record at key if it is
+// still at version.
+func RestoreDeleted(ctx context.Context, table string, key map[string]types.AttributeValue, version int) error {
+	cond, names, values := VersionCondition(version)
+	names["#deletedAt"] = "deletedAt"
+	names["#deletedBy"] = "deletedBy"
+	names["#updatedAt"] = "updatedAt"
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)}
+	_, err := db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #updatedAt = :updatedAt, #version = :nextVersion REMOVE #deletedAt, #deletedBy"),
+		ConditionExpression:       aws.String("(" + cond + ") AND attribute_exists(#deletedAt)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ValidateStruct checks v against its `validate` struct tags and returns one
+// FieldError per invalid field, named by its JSON path. Supported rules are
+// required, email, url, https, oneof=A B, min=N and max=N. Rules other than
+// required apply to each element of a slice, and nested structs are checked
+// recursively. Empty optional values are not checked. The tags of v's type
+// should have passed CheckTags.
+func ValidateStruct(v interface{}) []FieldError {
+	var errs []FieldError
+	validateFields(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+func validateFields(v reflect.Value, prefix string, errs *[]FieldError) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous {
+			validateFields(fv, prefix, errs)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		path := prefix + name
+		if tag := f.Tag.Get("validate"); tag != "" {
+			validateField(fv, path, strings.Split(tag, ","), errs)
+		}
+		validateFields(fv, path+".", errs)
+	}
+}
+
+func validateField(v reflect.Value, path string, rules []string, errs *[]FieldError) {
+	for _, rule := range rules {
+		if rule == "required" {
+			if v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+				*errs = append(*errs, FieldError{Field: path, Message: "is required"})
+				return
+			}
+			continue
+		}
+		if v.Kind() == reflect.Slice {
+			for i := 0; i < v.Len(); i++ {
+				if msg := checkRule(v.Index(i), rule); msg != "" {
+					*errs = append(*errs, FieldError{Field: fmt.Sprintf("%s[%d]", path, i), Message: msg})
+				}
+			}
+			continue
+		}
+		if msg := checkRule(v, rule); msg != "" {
+			*errs = append(*errs, FieldError{Field: path, Message: msg})
+			return
+		}
+	}
+}
+
+// checkRule returns a message describing why v breaks rule, or "" if it
+// satisfies it.
+func checkRule(v reflect.Value, rule string) string {
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.IsZero() {
+		return ""
+	}
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "email":
+		addr, err := mail.ParseAddress(v.String())
+		if err != nil || addr.Address != v.String() {
+			return "must be a valid email address"
+		}
+	case "url":
+		u, err := url.Parse(v.String())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "must be a valid http or https URL"
+		}
+	case "https":
+		u, err := url.Parse(v.String())
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return "must be a valid https URL"
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		for _, o := range options {
+			if v.String() == o {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	case "min", "max":
+		if checkRuleTag(v.Type(), rule) != nil {
+			return "cannot be checked"
+		}
+		limit, _ := strconv.ParseFloat(arg, 64)
+		var n float64
+		if isInt(v.Kind()) {
+			n = float64(v.Int())
+		} else {
+			n = v.Float()
+		}
+		if name == "min" && n < limit {
+			return "must be at least " + arg
+		}
+		if name == "max" && n > limit {
+			return "must be at most " + arg
+		}
+	default:
+		return "cannot be checked"
+	}
+	return ""
+}
+
+// CheckTags reports the first `validate` tag in the types of vs that
+// ValidateStruct cannot apply: an unknown rule, a min or max without a number
+// or on a non-numeric field, or a string rule on a non-string field. Lambdas
+// call it at init for every type they validate, so a bad tag fails the cold
+// start rather than a request.
+func CheckTags(vs ...interface{}) error {
+	for _, v := range vs {
+		if err := checkTypeTags(reflect.TypeOf(v), map[reflect.Type]bool{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTypeTags(t reflect.Type, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if tag := f.Tag.Get("validate"); tag != "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			for _, rule := range strings.Split(tag, ",") {
+				if rule == "required" {
+					continue
+				}
+				et := ft
+				if et.Kind() == reflect.Slice {
+					et = et.Elem()
+				}
+				if err := checkRuleTag(et, rule); err != nil {
+					return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+				}
+			}
+		}
+		if err := checkTypeTags(f.Type, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRuleTag reports why rule cannot be applied to a value of type t.
+func checkRuleTag(t reflect.Type, rule string) error {
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "email", "url", "https", "oneof":
+		if t.Kind() != reflect.String {
+			return fmt.Errorf("%s rule on non-string %s", name, t.Kind())
+		}
+		if name == "oneof" && len(strings.Fields(arg)) == 0 {
+			return fmt.Errorf("oneof rule %q lists no options", rule)
+		}
+	case "min", "max":
+		if _, err := strconv.ParseFloat(arg, 64); err != nil {
+			return fmt.Errorf("invalid %s rule %q", name, rule)
+		}
+		if !isInt(t.Kind()) && t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+			return fmt.Errorf("%s rule on non-numeric %s", name, t.Kind())
+		}
+	default:
+		return fmt.Errorf("unknown validation rule %q", rule)
+	}
+	return nil
+}
+
+func isInt(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	Zip string `json:"zip" validate:"required"`
+}
+
+type sample struct {
+	Name     string   `json:"name" validate:"required"`
+	Email    string   `json:"email" validate:"email"`
+	Site     string   `json:"site" validate:"url"`
+	Hook     string   `json:"hook" validate:"https"`
+	Status   string   `json:"status" validate:"oneof=OPEN CLOSED"`
+	Count    int      `json:"count" validate:"min=1,max=10"`
+	Share    *float64 `json:"share" validate:"max=1"`
+	Tags     []string `json:"tags" validate:"oneof=a b"`
+	Address  *address `json:"address"`
+	internal string   `validate:"bogus"`
+}
+
+func TestValidateStruct(t *testing.T) {
+	half, two := 0.5, 2.0
+	valid := sample{Name: "n", Email: "a@b.co", Site: "http://x.io", Hook: "https://x.io", Status: "OPEN", Count: 5, Share: &half, Tags: []string{"a"}, Address: &address{Zip: "1"}}
+	cases := []struct {
+		name   string
+		change func(*sample)
+		want   []FieldError
+	}{
+		{"valid", func(*sample) {}, nil},
+		{"empty optional values", func(s *sample) { *s = sample{Name: "n"} }, nil},
+		{"missing required", func(s *sample) { s.Name = "" }, []FieldError{{"name", "is required"}}},
+		{"bad email", func(s *sample) { s.Email = "Bob <a@b.co>" }, []FieldError{{"email", "must be a valid email address"}}},
+		{"bad url", func(s *sample) { s.Site = "ftp://x.io" }, []FieldError{{"site", "must be a valid http or https URL"}}},
+		{"http hook", func(s *sample) { s.Hook = "http://x.io" }, []FieldError{{"hook", "must be a valid https URL"}}},
+		{"unknown option", func(s *sample) { s.Status = "DONE" }, []FieldError{{"status", "must be one of OPEN, CLOSED"}}},
+		{"below min", func(s *sample) { s.Count = -1 }, []FieldError{{"count", "must be at least 1"}}},
+		{"above max", func(s *sample) { s.Count = 11 }, []FieldError{{"count", "must be at most 10"}}},
+		{"pointer above max", func(s *sample) { s.Share = &two }, []FieldError{{"share", "must be at most 1"}}},
+		{"slice element", func(s *sample) { s.Tags = []string{"a", "c"} }, []FieldError{{"tags[1]", "must be one of a, b"}}},
+		{"nested struct", func(s *sample) { s.Address = &address{} }, []FieldError{{"address.zip", "is required"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := valid
+			c.change(&s)
+			if got := ValidateStruct(s); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("ValidateStruct() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	cases := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"supported rules", sample{}, ""},
+		{"pointer to struct", &sample{}, ""},
+		{"unknown rule", struct {
+			A string `validate:"required,uuid"`
+		}{}, `unknown validation rule "uuid"`},
+		{"min without a number", struct {
+			A int `validate:"min=one"`
+		}{}, `invalid min rule "min=one"`},
+		{"max on a string", struct {
+			A string `validate:"max=3"`
+		}{}, "max rule on non-numeric string"},
+		{"email on a number", struct {
+			A int `validate:"email"`
+		}{}, "email rule on non-string int"},
+		{"empty oneof", struct {
+			A string `validate:"oneof="`
+		}{}, "lists no options"},
+		{"nested struct", struct {
+			B []struct {
+				A float64 `validate:"min=x"`
+			}
+		}{}, `invalid min rule "min=x"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckTags(c.v)
+			if c.want == "" {
+				if err != nil {
+					t.Fatalf("CheckTags() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("CheckTags() = %v, want an error containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+// A tag CheckTags would reject fails the field instead of panicking.
+func TestValidateStructBadTagDoesNotPanic(t *testing.T) {
+	v := struct {
+		A string `json:"a" validate:"max=3"`
+	}{A: "long"}
+	want := []FieldError{{"a", "cannot be checked"}}
+	if got := ValidateStruct(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateStruct() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Partner credentials look like mlp_<keyId>_<secret>, where keyId is 16 hex
+// characters. They are stored in the partners table under PK
+// PARTNER#<partnerId>, SK CREDENTIAL#<keyId>, holding only the SHA-256 of the
+// whole key, and found through the CredentialIndex GSI on keyId.
+const (
+	keyPrefix   = "mlp_"
+	keyIDLength = 16
+)
+
+// Credential statuses. A rotated credential keeps working until its
+// expiresAt, so the partner can switch to the new one.
+const (
+	statusActive  = "ACTIVE"
+	statusRotated = "ROTATED"
+)
+
+// partnerActive is the partner status that may call the partner API; the
+// partner function owns the lifecycle. Drafts, partners awaiting approval
+// and deactivated partners are refused, as they are for new referrals.
+const partnerActive = "ACTIVE"
+
+type credential struct {
+	ID        string `json:"id"`
+	PartnerID string `json:"partnerId"`
+	KeyHash   string `json:"keyHash"`
+	Status    string `json:"status"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// parseKeyID returns the key ID of a well-formed key, or "".
+func parseKeyID(key string) string {
+	rest, ok := strings.CutPrefix(key, keyPrefix)
+	if !ok || len(rest) < keyIDLength+2 || rest[keyIDLength] != '_' {
+		return ""
+	}
+	id := rest[:keyIDLength]
+	if _, err := hex.DecodeString(id); err != nil {
+		return ""
+	}
+	return id
+}
+
+// authenticate returns the credential key identifies, or nil and the reason
+// it is not accepted.
+func authenticate(ctx context.Context, key string) (*credential, string, error) {
+	keyID := parseKeyID(key)
+	if keyID == "" {
+		return nil, "malformed key", nil
+	}
+	out, err := ddb.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(partnersTable),
+		IndexName:              aws.String("CredentialIndex"),
+		KeyConditionExpression: aws.String("keyId = :keyId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":keyId": &types.AttributeValueMemberS{Value: keyID},
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(out.Items) != 1 {
+		return nil, "unknown key", nil
+	}
+	var c credential
+	if err := unmarshalItem(out.Items[0], &c); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(c.KeyHash)) != 1 {
+		return nil, "wrong secret", nil
+	}
+	switch c.Status {
+	case statusActive:
+	case statusRotated:
+		if exp, err := time.Parse(time.RFC3339, c.ExpiresAt); err != nil || !time.Now().Before(exp) {
+			return nil, "rotated key expired", nil
+		}
+	default:
+		return nil, "key " + strings.ToLower(c.Status), nil
+	}
+	reason, err := partnerRefused(ctx, c.PartnerID)
+	if err != nil || reason != "" {
+		return nil, reason, err
+	}
+	return &c, "", nil
+}
+
+// partnerRefused returns why the partner may not call the API, or "" when it
+// is stored, ACTIVE and not deleted.
+func partnerRefused(ctx context.Context, id string) (string, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(partnersTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
+		},
+		ProjectionExpression:     aws.String("#status, deletedAt"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.Item == nil {
+		return "partner not found", nil
+	}
+	var p struct {
+		Status    string `json:"status"`
+		DeletedAt string `json:"deletedAt"`
+	}
+	if err := unmarshalItem(out.Item, &p); err != nil {
+		return "", err
+	}
+	switch {
+	case p.DeletedAt != "":
+		return "partner deleted", nil
+	case p.Status != partnerActive:
+		return "partner not active", nil
+	}
+	return "", nil
+}
+
+func unmarshalItem(item map[string]types.AttributeValue, v interface{}) error {
+	return attributevalue.UnmarshalMapWithOptions(item, v, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	})
+}
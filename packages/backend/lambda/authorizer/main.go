@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var (
+	ddb           *dynamodb.Client
+	partnersTable string
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	partnersTable = getenv("PARTNERS_TABLE")
+}
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
+}
+
+// errUnauthorized is the error API Gateway turns into a 401.
+var errUnauthorized = errors.New("Unauthorized")
+
+// handler resolves the partner credential in the Authorization header to a
+// partner and allows the call, passing partnerId and credentialId to the
+// backend in the authorizer context. Any problem with the credential is a
+// 401; the reason is only logged.
+func handler(ctx context.Context, req events.APIGatewayCustomAuthorizerRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	cred, reason, err := authenticate(ctx, strings.TrimSpace(strings.TrimPrefix(req.AuthorizationToken, "Bearer ")))
+	if err != nil {
+		logger.ErrorContext(ctx, "credential lookup failed", slog.String("error", err.Error()))
+		return events.APIGatewayCustomAuthorizerResponse{}, err
+	}
+	if cred == nil {
+		logger.WarnContext(ctx, "credential rejected", slog.String("reason", reason))
+		return events.APIGatewayCustomAuthorizerResponse{}, errUnauthorized
+	}
+	return events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: "partner:" + cred.PartnerID,
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{{
+				Action:   []string{"execute-api:Invoke"},
+				Effect:   "Allow",
+				Resource: []string{partnerAPIResource(req.MethodArn)},
+			}},
+		},
+		Context: map[string]interface{}{
+			"partnerId":    cred.PartnerID,
+			"credentialId": cred.ID,
+		},
+	}, nil
+}
+
+// partnerAPIResource widens the ARN of the method being called to every
+// partner API method in the same stage, so a cached decision holds for all
+// of them: arn:...:<apiId>/<stage>/<verb>/<path> becomes
+// arn:...:<apiId>/<stage>/*/partner-api/*.
+func partnerAPIResource(methodArn string) string {
+	parts := strings.SplitN(methodArn, "/", 3)
+	if len(parts) < 2 {
+		return methodArn
+	}
+	return parts[0] + "/" + parts[1] + "/*/partner-api/*"
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// maxTransactItems is DynamoDB's limit on writes in one transaction.
+const maxTransactItems = 100
+
+// Each normalized email and phone number is claimed by a uniqueness item
+// (PK CUSTOMER_<KIND>#<value>, SK UNIQUE) that names the customer owning it.
+// Claims are written in the same transaction as the customer, so two
+// concurrent creates cannot both succeed.
+const (
+	uniqueEmail = "EMAIL"
+	uniquePhone = "PHONE"
+)
+
+type uniqueClaim struct {
+	PK         string `dynamodbav:"PK"`
+	SK         string `dynamodbav:"SK"`
+	CustomerID string `dynamodbav:"customerId"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizePhone keeps only the digits of phone and drops a leading US
+// country code. It returns "" if the result is not 7 to 15 digits long.
+func normalizePhone(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, phone)
+	if len(digits) == 11 && digits[0] == '1' {
+		digits = digits[1:]
+	}
+	if len(digits) < 7 || len(digits) > 15 {
+		return ""
+	}
+	return digits
+}
+
+// uniqueValues returns the normalized email and phone of c keyed by kind.
+func uniqueValues(c *Customer) map[string]string {
+	v := map[string]string{}
+	if c == nil {
+		return v
+	}
+	if e := normalizeEmail(c.Email); e != "" {
+		v[uniqueEmail] = e
+	}
+	if p := normalizePhone(c.Phone); p != "" {
+		v[uniquePhone] = p
+	}
+	return v
+}
+
+func uniqueKey(kind, value string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("CUSTOMER_%s#%s", kind, value)},
+		"SK": &types.AttributeValueMemberS{Value: "UNIQUE"},
+	}
+}
+
+// claimWrite assigns the claim on kind/value to customerID. The claim may be
+// unclaimed or already held by one of owners; any other holder fails the
+// condition.
+func claimWrite(kind, value, customerID string, owners ...string) (types.TransactWriteItem, error) {
+	item, err := attributevalue.MarshalMap(uniqueClaim{
+		PK:         fmt.Sprintf("CUSTOMER_%s#%s", kind, value),
+		SK:         "UNIQUE",
+		CustomerID: customerID,
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	names := make([]string, len(owners))
+	values := map[string]types.AttributeValue{}
+	for i, o := range owners {
+		names[i] = fmt.Sprintf(":owner%d", i)
+		values[names[i]] = &types.AttributeValueMemberS{Value: o}
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:                 aws.String(customersTable),
+		Item:                      item,
+		ConditionExpression:       aws.String(fmt.Sprintf("attribute_not_exists(PK) OR customerId IN (%s)", strings.Join(names, ", "))),
+		ExpressionAttributeValues: values,
+	}}, nil
+}
+
+func releaseWrite(kind, value, customerID string) types.TransactWriteItem {
+	return types.TransactWriteItem{Delete: &types.Delete{
+		TableName:           aws.String(customersTable),
+		Key:                 uniqueKey(kind, value),
+		ConditionExpression: aws.String("attribute_not_exists(PK) OR customerId = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: customerID},
+		},
+	}}
+}
+
+// claimOwner returns the ID of the customer holding the claim on kind/value,
+// or "" if it is unclaimed.
+func claimOwner(ctx context.Context, kind, value string) (string, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(customersTable),
+		Key:            uniqueKey(kind, value),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return "", err
+	}
+	var claim uniqueClaim
+	if err := attributevalue.UnmarshalMap(out.Item, &claim); err != nil {
+		return "", err
+	}
+	return claim.CustomerID, nil
+}
+
+// customerWrite is one item of a customer transaction. field names the
+// request field whose conflict a failed condition on it reports.
+type customerWrite struct {
+	item  types.TransactWriteItem
+	field string
+}
+
+// customerWrites builds the transaction that stores c: the profile itself,
+// claims on its email and phone, releases of the claims existing held on
+// values c no longer has, and the back-link on a newly set referral with its
+// audit event, recorded as made by by. On create (existing == nil) the
+// profile must not exist yet; on update it must still be at existing's
+// version. A non-nil fields limits an update to those attributes, written
+// through an UpdateExpression instead of a full put.
+func customerWrites(c Customer, existing *Customer, fields []string, by string) ([]customerWrite, error) {
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		Customer
+	}{
+		PK:       fmt.Sprintf("CUSTOMER#%s", c.ID),
+		SK:       fmt.Sprintf("PROFILE#%s", c.ID),
+		Customer: c,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var profile types.TransactWriteItem
+	switch {
+	case existing == nil:
+		profile.Put = &types.Put{TableName: aws.String(customersTable), Item: item, ConditionExpression: aws.String("attribute_not_exists(PK)")}
+	case fields != nil:
+		update, cond, names, values := api.PatchUpdate(fields, item, c.UpdatedAt, existing.Version)
+		profile.Update = &types.Update{
+			TableName:                 aws.String(customersTable),
+			Key:                       map[string]types.AttributeValue{"PK": item["PK"], "SK": item["SK"]},
+			UpdateExpression:          aws.String(update),
+			ConditionExpression:       aws.String(cond),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		}
+	default:
+		cond, names, values := api.VersionCondition(existing.Version)
+		profile.Put = &types.Put{
+			TableName:                 aws.String(customersTable),
+			Item:                      item,
+			ConditionExpression:       aws.String(cond),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		}
+	}
+	writes := []customerWrite{{item: profile, field: "id"}}
+
+	values, old := uniqueValues(&c), uniqueValues(existing)
+	for _, kind := range []string{uniqueEmail, uniquePhone} {
+		if v := values[kind]; v != "" {
+			w, err := claimWrite(kind, v, c.ID, c.ID)
+			if err != nil {
+				return nil, err
+			}
+			writes = append(writes, customerWrite{item: w, field: strings.ToLower(kind)})
+		}
+		if v := old[kind]; v != "" && v != values[kind] {
+			writes = append(writes, customerWrite{item: releaseWrite(kind, v, c.ID)})
+		}
+	}
+	if c.ReferralID != "" && (existing == nil || existing.ReferralID == "") {
+		writes = append(writes, customerWrite{item: referralLinkWrite(c), field: "referralId"})
+		event, err := referralLinkEvent(c.ReferralID, "", c.ID, by)
+		if err != nil {
+			return nil, err
+		}
+		w, err := api.AuditWrite(*event)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, customerWrite{item: w})
+	}
+	return writes, nil
+}
+
+// writeConflict reports the write of a customer transaction whose condition
+// failed.
+type writeConflict struct {
+	field string
+}
+
+func (e *writeConflict) Error() string {
+	return fmt.Sprintf("customer write conflict on %s", e.field)
+}
+
+// saveCustomer stores c in one transaction on behalf of by, limited to fields
+// when they are given. A failed condition is returned as a *writeConflict naming the field
+// it concerns.
+func saveCustomer(ctx context.Context, c Customer, existing *Customer, fields []string, by string) error {
+	writes, err := customerWrites(c, existing, fields, by)
+	if err != nil {
+		return err
+	}
+	items := make([]types.TransactWriteItem, len(writes))
+	for i, w := range writes {
+		items[i] = w.item
+	}
+	_, err = ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return err
+	}
+	for i, reason := range canceled.CancellationReasons {
+		if i < len(writes) && aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return &writeConflict{field: writes[i].field}
+		}
+	}
+	return &writeConflict{}
+}
+
+// saveError maps an error from saveCustomer to a response: a taken email or
+// phone is a 409 naming the customer that holds it.
+func saveError(ctx context.Context, c Customer, existing *Customer, err error) (events.APIGatewayProxyResponse, error) {
+	var conflict *writeConflict
+	if !errors.As(err, &conflict) {
+		return api.ServerError(ctx, err)
+	}
+	switch conflict.field {
+	case "id":
+		if existing != nil {
+			return api.PreconditionFailed(ctx)
+		}
+		return duplicateError(ctx, c.ID, api.FieldError{Field: "id", Message: "is already used by another customer"})
+	case "email", "phone":
+		kind := strings.ToUpper(conflict.field)
+		owner, err := claimOwner(ctx, kind, uniqueValues(&c)[kind])
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		return duplicateError(ctx, owner, api.FieldError{Field: conflict.field, Message: "matches an existing customer"})
+	case "referralId":
+		return api.ClientError(ctx, http.StatusConflict, "referral is already linked to another customer")
+	default:
+		return api.ClientError(ctx, http.StatusConflict, "customer was changed by another request")
+	}
+}
+
+type mergeCustomersInput struct {
+	SourceID string `json:"sourceId"`
+}
+
+// handleMergeCustomers folds the customer named by sourceId into {customerId}.
+// The target keeps its own values and takes the source's phone and referral
+// links where it has none; the source's referrals and email/phone claims move
+// to the target, and the source is soft-deleted with mergedInto naming the
+// target, all in one transaction. Both customers and each moved referral are
+// audited.
+func handleMergeCustomers(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var in mergeCustomersInput
+	if err := json.Unmarshal([]byte(req.Body), &in); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	targetID := req.PathParameters["customerId"]
+	if in.SourceID == "" {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "sourceId", Message: "is required"}})
+	}
+	if in.SourceID == targetID {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "sourceId", Message: "must differ from the target customer"}})
+	}
+	target, err := getCustomer(ctx, targetID)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if target == nil || target.DeletedAt != "" {
+		return api.NotFound(ctx, "customer not found")
+	}
+	if !api.IfMatch(req, target.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	source, err := getCustomer(ctx, in.SourceID)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if source == nil || source.DeletedAt != "" {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "sourceId", Message: "must be an existing customer"}})
+	}
+	referrals, err := customerReferrals(ctx, source.ID)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+
+	merged := *target
+	if merged.Phone == "" {
+		merged.Phone = source.Phone
+	}
+	if merged.ReferralID == "" {
+		merged.ReferralID, merged.PartnerID, merged.AgentID = source.ReferralID, source.PartnerID, source.AgentID
+	}
+	merged.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	merged.Version = target.Version + 1
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		Customer
+	}{
+		PK:       fmt.Sprintf("CUSTOMER#%s", merged.ID),
+		SK:       fmt.Sprintf("PROFILE#%s", merged.ID),
+		Customer: merged,
+	})
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	// The source is soft-deleted rather than removed, so it keeps pointing at
+	// the customer it was merged into until the purge job removes it.
+	mergedSource := *source
+	mergedSource.DeletedAt, mergedSource.DeletedBy = merged.UpdatedAt, api.Actor(req)
+	mergedSource.MergedInto = merged.ID
+	mergedSource.Version = source.Version + 1
+	targetEvent, err := api.NewAuditEvent(api.AuditCustomer, merged.ID, api.Actor(req), target, merged)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	sourceEvent, err := api.NewAuditEvent(api.AuditCustomer, source.ID, api.Actor(req), source, mergedSource)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	targetCond, targetNames, targetValues := api.VersionCondition(target.Version)
+	sourceCond, sourceNames, sourceValues := api.VersionCondition(source.Version)
+	sourceNames["#deletedAt"] = "deletedAt"
+	sourceNames["#deletedBy"] = "deletedBy"
+	sourceNames["#mergedInto"] = "mergedInto"
+	sourceNames["#updatedAt"] = "updatedAt"
+	sourceValues[":deletedAt"] = &types.AttributeValueMemberS{Value: mergedSource.DeletedAt}
+	sourceValues[":deletedBy"] = &types.AttributeValueMemberS{Value: mergedSource.DeletedBy}
+	sourceValues[":mergedInto"] = &types.AttributeValueMemberS{Value: merged.ID}
+	sourceValues[":updatedAt"] = &types.AttributeValueMemberS{Value: merged.UpdatedAt}
+	sourceValues[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(mergedSource.Version)}
+	items := []types.TransactWriteItem{
+		{Put: &types.Put{
+			TableName:                 aws.String(customersTable),
+			Item:                      item,
+			ConditionExpression:       aws.String(targetCond),
+			ExpressionAttributeNames:  targetNames,
+			ExpressionAttributeValues: targetValues,
+		}},
+		{Update: &types.Update{
+			TableName:                 aws.String(customersTable),
+			Key:                       customerKey(source.ID),
+			UpdateExpression:          aws.String("SET #deletedAt = :deletedAt, #deletedBy = :deletedBy, #mergedInto = :mergedInto, #updatedAt = :updatedAt, #version = :nextVersion"),
+			ConditionExpression:       aws.String("(" + sourceCond + ") AND attribute_not_exists(#deletedAt)"),
+			ExpressionAttributeNames:  sourceNames,
+			ExpressionAttributeValues: sourceValues,
+		}},
+	}
+	for _, e := range []*api.AuditEvent{targetEvent, sourceEvent} {
+		if e == nil {
+			continue
+		}
+		w, err := api.AuditWrite(*e)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		items = append(items, w)
+	}
+	// The source's email and phone stay claimed, now by the target, so a
+	// later create with either still finds the merged customer.
+	type claim struct{ kind, value string }
+	claims := map[claim]bool{}
+	for _, c := range []*Customer{&merged, source} {
+		for kind, v := range uniqueValues(c) {
+			claims[claim{kind, v}] = true
+		}
+	}
+	for cl := range claims {
+		w, err := claimWrite(cl.kind, cl.value, merged.ID, merged.ID, source.ID)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		items = append(items, w)
+	}
+	for _, r := range referrals {
+		items = append(items, types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(referralsTable),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFERRAL#%s", r.ID)},
+				"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", r.ID)},
+			},
+			UpdateExpression:    aws.String("SET customerId = :target"),
+			ConditionExpression: aws.String("customerId = :source"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":target": &types.AttributeValueMemberS{Value: merged.ID},
+				":source": &types.AttributeValueMemberS{Value: source.ID},
+			},
+		}})
+		event, err := referralLinkEvent(r.ID, source.ID, merged.ID, api.Actor(req))
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		w, err := api.AuditWrite(*event)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		items = append(items, w)
+	}
+	if len(items) > maxTransactItems {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("source customer has too many referrals to merge (%d)", len(referrals)))
+	}
+
+	_, err = ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		if len(canceled.CancellationReasons) > 0 && aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return api.PreconditionFailed(ctx)
+		}
+		return api.ClientError(ctx, http.StatusConflict, "customers were changed by another request")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(merged)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, merged.Version), nil
+}
+
+// duplicateError is the 409 for a customer that already exists as existingID.
+func duplicateError(ctx context.Context, existingID string, detail api.FieldError) (events.APIGatewayProxyResponse, error) {
+	return api.WriteError(ctx, http.StatusConflict, api.Error{
+		Code:       "DUPLICATE_CUSTOMER",
+		Message:    "customer already exists",
+		Details:    []api.FieldError{detail},
+		ExistingID: existingID,
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"(555) 123-4567", "5551234567"},
+		{"555.123.4567", "5551234567"},
+		{"+1 555 123 4567", "5551234567"},
+		{"1-555-123-4567", "5551234567"},
+		{"5551234567", "5551234567"},
+		{"123-4567", "1234567"},
+		{"+44 20 7946 0958", "442079460958"},
+		{"+1 (555) 123-45678", "155512345678"},
+		{"123456", ""},
+		{"1234567890123456", ""},
+		{"call me", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := normalizePhone(c.in); got != c.want {
+			t.Errorf("normalizePhone(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
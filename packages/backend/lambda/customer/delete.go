@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"rbac"
+)
+
+// handleDeleteCustomer soft-deletes a customer. The email and phone claims
+// are kept until the purge job removes the customer, so a deleted customer
+// can still be restored and is still reported as the existing duplicate.
+func handleDeleteCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	existing, err := getCustomer(ctx, req.PathParameters["customerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" || !rbac.Allowed(api.Identity(req), "customers:delete", existing.AgentID) {
+		return api.NotFound(ctx, "customer not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.MarkDeleted(ctx, customersTable, customerKey(existing.ID), existing.Version, api.Actor(req))
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// handleRestoreCustomer clears a customer's deletion mark. Admins only.
+func handleRestoreCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	c, err := getCustomer(ctx, req.PathParameters["customerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if c == nil {
+		return api.NotFound(ctx, "customer not found")
+	}
+	if c.DeletedAt == "" {
+		return api.ClientError(ctx, http.StatusConflict, "customer is not deleted")
+	}
+	if c.MergedInto != "" {
+		// Its referrals and claims now belong to the merged customer.
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("customer was merged into %s", c.MergedInto))
+	}
+	if !api.IfMatch(req, c.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.RestoreDeleted(ctx, customersTable, customerKey(c.ID), c.Version)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	c.DeletedAt, c.DeletedBy = "", ""
+	c.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	c.Version++
+	body, _ := json.Marshal(c)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, c.Version), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"rbac"
+)
+
+const (
+	// customerIndex is the GSI on customerId in the referrals table.
+	customerIndex = "CustomerIndex"
+	// partnerIndex is the GSI on partnerId in the customers table.
+	partnerIndex = "PartnerIndex"
+)
+
+// Referral is the subset of a referral record the customer function reads.
+type Referral struct {
+	ID         string  `json:"id"`
+	UserID     string  `json:"userId"`
+	CompanyID  string  `json:"companyId"`
+	CustomerID string  `json:"customerId,omitempty"`
+	LeadID     string  `json:"leadId,omitempty"`
+	ClientName string  `json:"clientName"`
+	Status     string  `json:"status"`
+	Amount     float64 `json:"amount,omitempty"`
+	CreatedAt  string  `json:"createdAt"`
+	UpdatedAt  string  `json:"updatedAt"`
+}
+
+func getReferral(ctx context.Context, id string) (*Referral, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(referralsTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFERRAL#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", id)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	var r Referral
+	if err := attributevalue.UnmarshalMap(out.Item, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// resolveLinks fills in the partner and referring agent from c's originating
+// referral. A referral can only be set once and can only belong to one
+// customer; partnerId and agentId must agree with it when given.
+func resolveLinks(ctx context.Context, c *Customer, existing *Customer) ([]api.FieldError, error) {
+	if existing != nil && existing.ReferralID != "" {
+		if c.ReferralID != "" && c.ReferralID != existing.ReferralID {
+			return []api.FieldError{{Field: "referralId", Message: "cannot be changed once set"}}, nil
+		}
+		c.ReferralID = existing.ReferralID
+	}
+	if c.ReferralID == "" {
+		return nil, nil
+	}
+	r, err := getReferral(ctx, c.ReferralID)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return []api.FieldError{{Field: "referralId", Message: "must be an existing referral"}}, nil
+	}
+	if r.CustomerID != "" && r.CustomerID != c.ID {
+		return []api.FieldError{{Field: "referralId", Message: "is already linked to another customer"}}, nil
+	}
+	var errs []api.FieldError
+	if c.PartnerID != "" && c.PartnerID != r.CompanyID {
+		errs = append(errs, api.FieldError{Field: "partnerId", Message: "must match the referral's partner"})
+	}
+	if c.AgentID != "" && c.AgentID != r.UserID {
+		errs = append(errs, api.FieldError{Field: "agentId", Message: "must match the referral's agent"})
+	}
+	c.PartnerID, c.AgentID = r.CompanyID, r.UserID
+	return errs, nil
+}
+
+// referralLinkWrite points the customer's originating referral back at the
+// customer. The condition keeps a referral from being claimed by two
+// customers at once.
+func referralLinkWrite(c Customer) types.TransactWriteItem {
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName: aws.String(referralsTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFERRAL#%s", c.ReferralID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", c.ReferralID)},
+		},
+		UpdateExpression:    aws.String("SET customerId = :cid"),
+		ConditionExpression: aws.String("attribute_exists(PK) AND (attribute_not_exists(customerId) OR customerId = :cid)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":cid": &types.AttributeValueMemberS{Value: c.ID},
+		},
+	}}
+}
+
+// referralLinkEvent audits moving referral referralID from customer from,
+// empty if it was unlinked, to customer to.
+func referralLinkEvent(referralID, from, to, by string) (*api.AuditEvent, error) {
+	before := map[string]string{}
+	if from != "" {
+		before["customerId"] = from
+	}
+	return api.NewAuditEvent(api.AuditReferral, referralID, by, before, map[string]string{"customerId": to})
+}
+
+// handleListCustomerReferrals returns the referral history of a customer.
+func handleListCustomerReferrals(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	id := req.PathParameters["customerId"]
+	c, err := getCustomer(ctx, id)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if c == nil || (c.DeletedAt != "" && !api.IncludeDeleted(req)) || !rbac.Allowed(api.Identity(req), "customers:read", c.AgentID) {
+		return api.NotFound(ctx, "customer not found")
+	}
+	referrals, err := customerReferrals(ctx, id)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(referrals)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// customerReferrals returns the referrals linked to customerID.
+func customerReferrals(ctx context.Context, customerID string) ([]Referral, error) {
+	referrals := []Referral{}
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(referralsTable),
+		IndexName:              aws.String(customerIndex),
+		KeyConditionExpression: aws.String("customerId = :cid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":cid": &types.AttributeValueMemberS{Value: customerID},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []Referral
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		referrals = append(referrals, page...)
+	}
+	return referrals, nil
+}
+
+// handleListPartnerCustomers returns the customers served by a partner.
+func handleListPartnerCustomers(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	customers := []Customer{}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(customersTable),
+		IndexName:              aws.String(partnerIndex),
+		KeyConditionExpression: aws.String("partnerId = :pid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pid": &types.AttributeValueMemberS{Value: req.PathParameters["partnerId"]},
+		},
+	}
+	if !api.IncludeDeleted(req) {
+		input.FilterExpression = aws.String("attribute_not_exists(deletedAt)")
+	}
+	p := dynamodb.NewQueryPaginator(ddb, input)
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		var page []Customer
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return api.ServerError(ctx, err)
+		}
+		customers = append(customers, page...)
+	}
+	body, _ := json.Marshal(customers)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// handlePartnerAPICustomers lists the customer book of the partner whose
+// credential made the call. Deleted customers are never included.
+func handlePartnerAPICustomers(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	partnerID := api.AuthorizedPartner(req)
+	if partnerID == "" {
+		return api.ClientError(ctx, http.StatusUnauthorized, "partner credential required")
+	}
+	req.PathParameters = map[string]string{"partnerId": partnerID}
+	req.QueryStringParameters = nil
+	return handleListPartnerCustomers(ctx, req)
+}
@@ -16,28 +16,34 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+
+	"api"
+	"rbac"
 )
 
 var (
 	ddb            *dynamodb.Client
 	customersTable string
+	referralsTable string
 )
 
+// Customer is a client served by a partner. ReferralID is the referral the
+// customer came from; PartnerID and AgentID are copied from it.
 type Customer struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
-	CreatedAt string `json:"createdAt,omitempty"`
-	UpdatedAt string `json:"updatedAt,omitempty"`
-}
-
-func init() {
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	ddb = dynamodb.NewFromConfig(cfg)
-	customersTable = getenv("CUSTOMERS_TABLE")
+	ID         string `json:"id"`
+	Name       string `json:"name" validate:"required"`
+	Email      string `json:"email" validate:"required,email"`
+	Phone      string `json:"phone,omitempty"`
+	ReferralID string `json:"referralId,omitempty"`
+	PartnerID  string `json:"partnerId,omitempty"`
+	AgentID    string `json:"agentId,omitempty"`
+	Version    int    `json:"version"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+	UpdatedAt  string `json:"updatedAt,omitempty"`
+	DeletedAt  string `json:"deletedAt,omitempty"`
+	DeletedBy  string `json:"deletedBy,omitempty"`
+	// MergedInto names the customer a deleted customer was merged into.
+	MergedInto string `json:"mergedInto,omitempty"`
 }
 
 func getenv(key string) string {
@@ -51,122 +57,236 @@ func getenv(key string) string {
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	switch {
 	case req.Resource == "/customers" && req.HTTPMethod == http.MethodGet:
-		return handleListCustomers(ctx)
+		return handleListCustomers(ctx, req)
 	case req.Resource == "/customers" && req.HTTPMethod == http.MethodPost:
-		return handleCreateCustomer(ctx, req)
+		return api.WithIdempotency(ctx, req, "createCustomer", handleCreateCustomer)
 	case req.Resource == "/customers/{customerId}" && req.HTTPMethod == http.MethodGet:
 		return handleGetCustomer(ctx, req)
 	case req.Resource == "/customers/{customerId}" && req.HTTPMethod == http.MethodPut:
 		return handlePutCustomer(ctx, req)
+	case req.Resource == "/customers/{customerId}" && req.HTTPMethod == http.MethodPatch:
+		return handlePatchCustomer(ctx, req)
+	case req.Resource == "/customers/{customerId}" && req.HTTPMethod == http.MethodDelete:
+		return handleDeleteCustomer(ctx, req)
+	case req.Resource == "/customers/{customerId}/restore" && req.HTTPMethod == http.MethodPost:
+		return handleRestoreCustomer(ctx, req)
+	case req.Resource == "/customers/{customerId}/referrals" && req.HTTPMethod == http.MethodGet:
+		return handleListCustomerReferrals(ctx, req)
+	case req.Resource == "/customers/{customerId}/merge" && req.HTTPMethod == http.MethodPost:
+		return handleMergeCustomers(ctx, req)
+	case req.Resource == "/partners/{partnerId}/customers" && req.HTTPMethod == http.MethodGet:
+		return handleListPartnerCustomers(ctx, req)
+	case req.Resource == "/partner-api/customers" && req.HTTPMethod == http.MethodGet:
+		return handlePartnerAPICustomers(ctx, req)
 	default:
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return api.NotFound(ctx, "route not found")
 	}
 }
 
-func handleListCustomers(ctx context.Context) (events.APIGatewayProxyResponse, error) {
-	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(customersTable)})
-	if err != nil {
-		return serverError(err)
+// handleListCustomers lists the customers the caller referred, or every
+// customer for admins.
+func handleListCustomers(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	customers := []Customer{}
+	// The table also holds the email/phone uniqueness claims.
+	filter := "begins_with(SK, :profile)"
+	values := map[string]types.AttributeValue{
+		":profile": &types.AttributeValueMemberS{Value: "PROFILE#"},
 	}
-	var customers []Customer
-	if err := attributevalue.UnmarshalListOfMaps(out.Items, &customers); err != nil {
-		return serverError(err)
+	if !api.IncludeDeleted(req) {
+		filter += " AND attribute_not_exists(deletedAt)"
+	}
+	if id := api.Identity(req); !rbac.Allowed(id, "customers:read", "") {
+		filter += " AND agentId = :agent"
+		values[":agent"] = &types.AttributeValueMemberS{Value: id.Sub}
+	}
+	p := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{
+		TableName:                 aws.String(customersTable),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		var page []Customer
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return api.ServerError(ctx, err)
+		}
+		customers = append(customers, page...)
 	}
 	body, _ := json.Marshal(customers)
 	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
 }
 
+// validateCustomer checks c's struct tags and its phone number.
+func validateCustomer(c Customer) []api.FieldError {
+	errs := api.ValidateStruct(c)
+	if c.Phone != "" && normalizePhone(c.Phone) == "" {
+		errs = append(errs, api.FieldError{Field: "phone", Message: "must be a phone number of 7 to 15 digits"})
+	}
+	return errs
+}
+
 func handleCreateCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var c Customer
 	if err := json.Unmarshal([]byte(req.Body), &c); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	if errs := validateCustomer(c); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 	if c.ID == "" {
 		c.ID = uuid.NewString()
 	}
+	errs, err := resolveLinks(ctx, &c, nil)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
 	now := time.Now().UTC().Format(time.RFC3339)
 	c.CreatedAt = now
 	c.UpdatedAt = now
-	item, err := attributevalue.MarshalMap(struct {
-		PK string `dynamodbav:"PK"`
-		SK string `dynamodbav:"SK"`
-		Customer
-	}{
-		PK:       fmt.Sprintf("CUSTOMER#%s", c.ID),
-		SK:       fmt.Sprintf("PROFILE#%s", c.ID),
-		Customer: c,
-	})
-	if err != nil {
-		return serverError(err)
-	}
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(customersTable), Item: item}); err != nil {
-		return serverError(err)
+	c.Version = 1
+	if err := saveCustomer(ctx, c, nil, nil, api.Actor(req)); err != nil {
+		return saveError(ctx, c, nil, err)
 	}
 	body, _ := json.Marshal(c)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, c.Version), nil
 }
 
-func handleGetCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	id := req.PathParameters["customerId"]
-	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(customersTable),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("CUSTOMER#%s", id)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
-		},
-	})
+func customerKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("CUSTOMER#%s", id)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
+	}
+}
+
+func getCustomer(ctx context.Context, id string) (*Customer, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(customersTable), Key: customerKey(id)})
 	if err != nil {
-		return serverError(err)
+		return nil, err
 	}
 	if out.Item == nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return nil, nil
 	}
 	var c Customer
 	if err := attributevalue.UnmarshalMap(out.Item, &c); err != nil {
-		return serverError(err)
+		return nil, err
+	}
+	return &c, nil
+}
+
+func handleGetCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	c, err := getCustomer(ctx, req.PathParameters["customerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if c == nil || (c.DeletedAt != "" && !api.IncludeDeleted(req)) || !rbac.Allowed(api.Identity(req), "customers:read", c.AgentID) {
+		return api.NotFound(ctx, "customer not found")
 	}
 	body, _ := json.Marshal(c)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, c.Version), nil
 }
 
 func handlePutCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	id := req.PathParameters["customerId"]
 	var c Customer
 	if err := json.Unmarshal([]byte(req.Body), &c); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	if errs := validateCustomer(c); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 	c.ID = id
-	c.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	if c.CreatedAt == "" {
-		c.CreatedAt = c.UpdatedAt
-	}
-	item, err := attributevalue.MarshalMap(struct {
-		PK string `dynamodbav:"PK"`
-		SK string `dynamodbav:"SK"`
-		Customer
-	}{
-		PK:       fmt.Sprintf("CUSTOMER#%s", id),
-		SK:       fmt.Sprintf("PROFILE#%s", id),
-		Customer: c,
-	})
+	existing, err := getCustomer(ctx, id)
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" || !rbac.Allowed(api.Identity(req), "customers:update", existing.AgentID) {
+		return api.NotFound(ctx, "customer not found")
 	}
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(customersTable), Item: item}); err != nil {
-		return serverError(err)
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	errs, err := resolveLinks(ctx, &c, existing)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	c.CreatedAt = existing.CreatedAt
+	c.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	c.Version = existing.Version + 1
+	if err := saveCustomer(ctx, c, existing, nil, api.Actor(req)); err != nil {
+		return saveError(ctx, c, existing, err)
 	}
 	body, _ := json.Marshal(c)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, c.Version), nil
 }
 
-func serverError(err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
-}
-
-func clientError(code int, msg string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: code, Body: msg}, nil
+// handlePatchCustomer applies a JSON Merge Patch to a customer, writing only
+// the attributes the patch names. Setting referralId also rewrites partnerId
+// and agentId, which are taken from the referral.
+func handlePatchCustomer(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	patch, err := api.ParsePatch(req.Body)
+	if err != nil {
+		return api.ClientError(ctx, http.StatusBadRequest, err.Error())
+	}
+	if errs := api.CheckPatchFields(patch, Customer{}, "mergedInto"); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	existing, err := getCustomer(ctx, req.PathParameters["customerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" || !rbac.Allowed(api.Identity(req), "customers:update", existing.AgentID) {
+		return api.NotFound(ctx, "customer not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	var c Customer
+	if err := api.ApplyPatch(existing, patch, &c); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if errs := validateCustomer(c); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	errs, err := resolveLinks(ctx, &c, existing)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	if _, ok := patch["referralId"]; ok {
+		// Only the field names matter from here on.
+		patch["partnerId"], patch["agentId"] = nil, nil
+	}
+	c.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	c.Version = existing.Version + 1
+	if err := saveCustomer(ctx, c, existing, api.SortedKeys(patch), api.Actor(req)); err != nil {
+		return saveError(ctx, c, existing, err)
+	}
+	body, _ := json.Marshal(c)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, c.Version), nil
 }
 
 func main() {
-	lambda.Start(handler)
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: getenv("AUDIT_TABLE"), Idempotency: getenv("IDEMPOTENCY_TABLE")})
+	if err := api.CheckTags(Customer{}); err != nil {
+		panic(err)
+	}
+	customersTable = getenv("CUSTOMERS_TABLE")
+	referralsTable = getenv("REFERRALS_TABLE")
+	lambda.Start(api.WithLogging(api.WithPolicy(handler)))
 }
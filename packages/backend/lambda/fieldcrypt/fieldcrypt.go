@@ -0,0 +1,275 @@
+// Package fieldcrypt encrypts individual record attributes with envelope
+// encryption: each value is sealed with AES-256-GCM under a data key, and the
+// data key is stored next to it wrapped by a KeyProvider (KMS in the deployed
+// stack, a local AES key in tests and sam local).
+//
+// Fields opt in by having the type Secret. Handlers hold plaintext: Sealed
+// encrypts a record's Secrets before it is marshalled, Open decrypts them
+// after it is unmarshalled, and a Secret that was not sealed refuses to be
+// marshalled, so only ciphertext reaches the table. Each value is bound to
+// the table, item key and attribute it is stored under.
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix marks an encrypted attribute value. Values without it were stored
+// before the field was encrypted and are read as plaintext. legacyPrefix
+// marks values encrypted before they were bound to where they are stored;
+// they are still read, and are rewritten bound the next time they are saved.
+const (
+	prefix       = "enc:v2:"
+	legacyPrefix = "enc:v1:"
+)
+
+// A data key encrypts values for at most dataKeyLifetime or dataKeyUses
+// values, whichever comes first, so a busy Lambda does not call KMS on every
+// write. Up to maxCachedKeys keys are kept for encryption and as many
+// unwrapped keys for decryption.
+const (
+	dataKeyLifetime = 5 * time.Minute
+	dataKeyUses     = 1000
+	maxCachedKeys   = 100
+)
+
+var (
+	// ErrNoProvider means Use was never called.
+	ErrNoProvider = errors.New("fieldcrypt: no key provider")
+	// ErrMalformed means an attribute carries the encrypted prefix but not a
+	// value this package wrote.
+	ErrMalformed = errors.New("fieldcrypt: malformed ciphertext")
+)
+
+// Binding is where a value is stored: the table, the item's primary key and
+// the attribute's path within the item. The whole binding is authenticated
+// with the value, as GCM additional data, so a value copied to another item
+// or attribute does not decrypt. Data keys are bound to the table and
+// attribute only, as their KMS encryption context, so one key serves every
+// item and the cache below keeps KMS off most reads and writes.
+type Binding struct {
+	Table, Key, Attribute string
+}
+
+// encryptionContext is the binding as authenticated with the value.
+func (b Binding) encryptionContext() map[string]string {
+	return map[string]string{"table": b.Table, "key": b.Key, "attribute": b.Attribute}
+}
+
+// keyScope is the part of a binding a data key is issued for.
+type keyScope struct {
+	table, attribute string
+}
+
+func (b Binding) keyScope() keyScope {
+	return keyScope{table: b.Table, attribute: b.Attribute}
+}
+
+// encryptionContext is the scope as a KMS encryption context.
+func (s keyScope) encryptionContext() map[string]string {
+	return map[string]string{"table": s.table, "attribute": s.attribute}
+}
+
+// additionalData is the encryption context as authenticated data: JSON with
+// sorted keys, or nil for no context.
+func additionalData(encryptionContext map[string]string) []byte {
+	if len(encryptionContext) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(encryptionContext)
+	return b
+}
+
+// KeyProvider issues and unwraps data keys. A key is bound to the
+// encryption context it was issued with and unwraps only with the same one.
+type KeyProvider interface {
+	// GenerateDataKey returns a new 32-byte data key in plaintext and in the
+	// wrapped form that is stored with the values it encrypts.
+	GenerateDataKey(ctx context.Context, encryptionContext map[string]string) (plaintext, wrapped []byte, err error)
+	// Decrypt unwraps a data key returned by GenerateDataKey.
+	Decrypt(ctx context.Context, wrapped []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// Keyring encrypts and decrypts values with data keys from a KeyProvider,
+// caching them as described above. Each table and attribute gets its own
+// data keys.
+type Keyring struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	current map[keyScope]*dataKey
+	plain   map[string][]byte
+}
+
+type dataKey struct {
+	plaintext, wrapped []byte
+	expires            time.Time
+	uses               int
+}
+
+// NewKeyring returns a Keyring backed by p.
+func NewKeyring(p KeyProvider) *Keyring {
+	return &Keyring{provider: p, current: map[keyScope]*dataKey{}, plain: map[string][]byte{}}
+}
+
+// keyring is the Keyring Sealed and Open use.
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// Use makes p the provider Secret values are encrypted with. Lambdas call it
+// once at startup.
+func Use(p KeyProvider) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = NewKeyring(p)
+}
+
+func defaultKeyring() (*Keyring, error) {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	if keyring == nil {
+		return nil, ErrNoProvider
+	}
+	return keyring, nil
+}
+
+// Encrypt seals plaintext for storage at b and returns it in the stored
+// form, enc:v2:<wrapped key>:<nonce and ciphertext>, both base64. An empty
+// plaintext is not encrypted: it is returned as "", to be stored as nothing.
+func (k *Keyring) Encrypt(ctx context.Context, plaintext string, b Binding) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	key, err := k.encryptionKey(ctx, b.keyScope())
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key.plaintext)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), additionalData(b.encryptionContext()))
+	return prefix + base64.RawStdEncoding.EncodeToString(key.wrapped) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value Encrypt returned for b. Values without the
+// encrypted prefix are returned unchanged.
+func (k *Keyring) Decrypt(ctx context.Context, stored string, b Binding) (string, error) {
+	// Legacy values carry no binding: neither their key nor the value is
+	// bound to a context.
+	var keyContext, valueContext map[string]string
+	switch {
+	case strings.HasPrefix(stored, prefix):
+		keyContext, valueContext = b.keyScope().encryptionContext(), b.encryptionContext()
+	case strings.HasPrefix(stored, legacyPrefix):
+	default:
+		return stored, nil
+	}
+	wrappedB64, sealedB64, ok := strings.Cut(stored[len(prefix):], ":")
+	if !ok {
+		return "", ErrMalformed
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(wrappedB64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(sealedB64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	key, err := k.decryptionKey(ctx, wrapped, keyContext)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", ErrMalformed
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData(valueContext))
+	if err != nil {
+		return "", fmt.Errorf("fieldcrypt: decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether a stored value was written by Encrypt.
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, prefix) || strings.HasPrefix(stored, legacyPrefix)
+}
+
+func (k *Keyring) encryptionKey(ctx context.Context, scope keyScope) (*dataKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := k.current[scope]
+	if key == nil || key.uses >= dataKeyUses || time.Now().After(key.expires) {
+		encryptionContext := scope.encryptionContext()
+		plaintext, wrapped, err := k.provider.GenerateDataKey(ctx, encryptionContext)
+		if err != nil {
+			return nil, fmt.Errorf("fieldcrypt: generate data key: %w", err)
+		}
+		if len(k.current) >= maxCachedKeys {
+			k.current = map[keyScope]*dataKey{}
+		}
+		key = &dataKey{plaintext: plaintext, wrapped: wrapped, expires: time.Now().Add(dataKeyLifetime)}
+		k.current[scope] = key
+		k.remember(wrapped, encryptionContext, plaintext)
+	}
+	key.uses++
+	return key, nil
+}
+
+func (k *Keyring) decryptionKey(ctx context.Context, wrapped []byte, encryptionContext map[string]string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.plain[cacheKey(wrapped, encryptionContext)]; ok {
+		return key, nil
+	}
+	key, err := k.provider.Decrypt(ctx, wrapped, encryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: unwrap data key: %w", err)
+	}
+	k.remember(wrapped, encryptionContext, key)
+	return key, nil
+}
+
+// remember caches an unwrapped key, dropping the whole cache when it is full;
+// keys are cheap to unwrap again and few are live at once.
+func (k *Keyring) remember(wrapped []byte, encryptionContext map[string]string, plaintext []byte) {
+	if len(k.plain) >= maxCachedKeys {
+		k.plain = map[string][]byte{}
+	}
+	k.plain[cacheKey(wrapped, encryptionContext)] = plaintext
+}
+
+// cacheKey keys unwrapped keys by context as well, so a cached key is only
+// used for the table and attribute it was unwrapped for.
+func cacheKey(wrapped []byte, encryptionContext map[string]string) string {
+	return string(additionalData(encryptionContext)) + "\x00" + string(wrapped)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,399 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+// countingProvider counts the calls reaching the wrapped provider.
+type countingProvider struct {
+	KeyProvider
+	generated, decrypted int
+}
+
+func (p *countingProvider) GenerateDataKey(ctx context.Context, encryptionContext map[string]string) ([]byte, []byte, error) {
+	p.generated++
+	return p.KeyProvider.GenerateDataKey(ctx, encryptionContext)
+}
+
+func (p *countingProvider) Decrypt(ctx context.Context, wrapped []byte, encryptionContext map[string]string) ([]byte, error) {
+	p.decrypted++
+	return p.KeyProvider.Decrypt(ctx, wrapped, encryptionContext)
+}
+
+func localProvider(t *testing.T) *LocalProvider {
+	t.Helper()
+	p, err := NewLocalProvider(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+type payout struct {
+	Account Secret `json:"account,omitempty"`
+	Routing Secret `json:"routing,omitempty"`
+}
+
+type record struct {
+	ID     string  `json:"id"`
+	Phone  Secret  `json:"phone,omitempty"`
+	Email  string  `json:"email,omitempty"`
+	Payout *payout `json:"payout,omitempty"`
+}
+
+const testTable = "users"
+
+func itemKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "USER#" + id},
+		"SK": &types.AttributeValueMemberS{Value: "PROFILE#" + id},
+	}
+}
+
+func marshal(v interface{}) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMapWithOptions(v, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
+}
+
+// store seals r for the item u1 and marshals it.
+func store(t *testing.T, r record) map[string]types.AttributeValue {
+	t.Helper()
+	sealed, err := Sealed(context.Background(), testTable, itemKey("u1"), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := marshal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+// load unmarshals item and opens it as the item with the given ID.
+func load(item map[string]types.AttributeValue, table, id string) (record, error) {
+	var r record
+	if err := attributevalue.UnmarshalMap(item, &r); err != nil {
+		return r, err
+	}
+	return r, Open(context.Background(), table, itemKey(id), &r)
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	Use(localProvider(t))
+	r := record{ID: "u1", Phone: "+1 555 0100", Payout: &payout{Account: "000123456789"}}
+	item := store(t, r)
+	stored := item["phone"].(*types.AttributeValueMemberS).Value
+	if !IsEncrypted(stored) || strings.Contains(stored, "555") {
+		t.Fatalf("phone stored as %q, want ciphertext", stored)
+	}
+	account := item["payout"].(*types.AttributeValueMemberM).Value["account"].(*types.AttributeValueMemberS).Value
+	if !IsEncrypted(account) {
+		t.Fatalf("payout.account stored as %q, want ciphertext", account)
+	}
+	if r.Phone != "+1 555 0100" || r.Payout.Account != "000123456789" {
+		t.Errorf("Sealed changed its argument: %q %q", string(r.Phone), string(r.Payout.Account))
+	}
+	got, err := load(item, testTable, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phone != "+1 555 0100" || got.Payout.Account != "000123456789" {
+		t.Errorf("round trip gave %q %q", string(got.Phone), string(got.Payout.Account))
+	}
+}
+
+func TestUnsealedSecretIsNotMarshalled(t *testing.T) {
+	if _, err := marshal(record{ID: "u1", Phone: "+1 555 0100"}); !errors.Is(err, ErrNotSealed) {
+		t.Fatalf("marshal() error = %v, want ErrNotSealed", err)
+	}
+}
+
+func TestEmptySecretIsNotStored(t *testing.T) {
+	Use(localProvider(t))
+	item := store(t, record{ID: "u1", Payout: &payout{}})
+	if _, ok := item["phone"]; ok {
+		t.Errorf("empty phone was stored: %v", item["phone"])
+	}
+	if len(item["payout"].(*types.AttributeValueMemberM).Value) != 0 {
+		t.Errorf("empty payout fields were stored: %v", item["payout"])
+	}
+	// Without omitempty an empty Secret is NULL, not an encrypted "".
+	av, err := Secret("").MarshalDynamoDBAttributeValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := av.(*types.AttributeValueMemberNULL); !ok {
+		t.Errorf("empty Secret marshalled as %#v", av)
+	}
+	if s, err := NewKeyring(localProvider(t)).Encrypt(context.Background(), "", Binding{}); s != "" || err != nil {
+		t.Errorf("Encrypt(\"\") = %q, %v", s, err)
+	}
+}
+
+// A client sending a value that looks encrypted gets it stored encrypted and
+// back as sent, not stored as is.
+func TestValueLookingEncryptedIsSealed(t *testing.T) {
+	Use(localProvider(t))
+	copied := store(t, record{ID: "u2", Phone: "+1 555 0100"})["phone"].(*types.AttributeValueMemberS).Value
+	for _, sent := range []string{"enc:v1:x:y", copied} {
+		item := store(t, record{ID: "u1", Phone: Secret(sent)})
+		if item["phone"].(*types.AttributeValueMemberS).Value == sent {
+			t.Fatalf("%q stored as sent", sent)
+		}
+		got, err := load(item, testTable, "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Phone) != sent {
+			t.Errorf("phone = %q, want %q", string(got.Phone), sent)
+		}
+	}
+}
+
+func TestPlaintextIsReadAsIs(t *testing.T) {
+	Use(localProvider(t))
+	got, err := load(map[string]types.AttributeValue{
+		"phone": &types.AttributeValueMemberS{Value: "+1 555 0100"},
+	}, testTable, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phone != "+1 555 0100" {
+		t.Errorf("phone = %q", string(got.Phone))
+	}
+}
+
+// A value only decrypts in the table, item and attribute it was written to.
+func TestValueIsBoundToWhereItIsStored(t *testing.T) {
+	Use(localProvider(t))
+	item := store(t, record{ID: "u1", Phone: "+1 555 0100", Payout: &payout{Account: "000123456789", Routing: "021000021"}})
+	if _, err := load(item, testTable, "u2"); err == nil {
+		t.Error("opened under another item's key")
+	}
+	if _, err := load(item, "other", "u1"); err == nil {
+		t.Error("opened in another table")
+	}
+	m := item["payout"].(*types.AttributeValueMemberM).Value
+	m["account"], m["routing"] = m["routing"], m["account"]
+	if _, err := load(item, testTable, "u1"); err == nil {
+		t.Error("opened a value moved to another attribute")
+	}
+}
+
+// stubKMS wraps keys by remembering them with the encryption context they
+// were issued under, as KMS does.
+type stubKMS struct {
+	keys     map[string]map[string]string
+	contexts []map[string]string
+}
+
+func (s *stubKMS) GenerateDataKey(_ context.Context, in *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	s.contexts = append(s.contexts, in.EncryptionContext)
+	plaintext := bytes.Repeat([]byte{byte(len(s.keys) + 1)}, 32)
+	wrapped := fmt.Sprintf("blob-%d", len(s.keys))
+	s.keys[wrapped] = in.EncryptionContext
+	return &kms.GenerateDataKeyOutput{Plaintext: plaintext, CiphertextBlob: []byte(wrapped)}, nil
+}
+
+func (s *stubKMS) Decrypt(_ context.Context, in *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	s.contexts = append(s.contexts, in.EncryptionContext)
+	ec, ok := s.keys[string(in.CiphertextBlob)]
+	if !ok || !reflect.DeepEqual(ec, in.EncryptionContext) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	var n int
+	fmt.Sscanf(string(in.CiphertextBlob), "blob-%d", &n)
+	return &kms.DecryptOutput{Plaintext: bytes.Repeat([]byte{byte(n + 1)}, 32)}, nil
+}
+
+func TestKMSEncryptionContext(t *testing.T) {
+	stub := &stubKMS{keys: map[string]map[string]string{}}
+	ctx := context.Background()
+	b := Binding{Table: testTable, Key: "PK=USER#u1,SK=PROFILE#u1", Attribute: "payout.account"}
+	s, err := NewKeyring(NewKMSProvider(stub, "alias/fields")).Encrypt(ctx, "000123456789", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A cold keyring has to unwrap the key through KMS.
+	if got, err := NewKeyring(NewKMSProvider(stub, "alias/fields")).Decrypt(ctx, s, b); err != nil || got != "000123456789" {
+		t.Fatalf("Decrypt() = %q, %v", got, err)
+	}
+	// The item key stays out of the context, so one data key serves all items.
+	want := map[string]string{"table": testTable, "attribute": "payout.account"}
+	for _, ec := range stub.contexts {
+		if !reflect.DeepEqual(ec, want) {
+			t.Errorf("encryption context = %v, want %v", ec, want)
+		}
+	}
+	other := b
+	other.Attribute = "payout.routing"
+	if _, err := NewKeyring(NewKMSProvider(stub, "alias/fields")).Decrypt(ctx, s, other); err == nil {
+		t.Error("KMS unwrapped the key for another attribute")
+	}
+	other = b
+	other.Key = "PK=USER#u2,SK=PROFILE#u2"
+	if _, err := NewKeyring(NewKMSProvider(stub, "alias/fields")).Decrypt(ctx, s, other); err == nil {
+		t.Error("value decrypted for another item")
+	}
+}
+
+func TestDataKeysAreCached(t *testing.T) {
+	p := &countingProvider{KeyProvider: localProvider(t)}
+	k := NewKeyring(p)
+	ctx := context.Background()
+	// The same attribute of three items, as a list read sees it.
+	var bindings []Binding
+	var stored []string
+	for _, id := range []string{"u1", "u2", "u3"} {
+		b := Binding{Table: testTable, Key: keyString(itemKey(id)), Attribute: "phone"}
+		s, err := k.Encrypt(ctx, "phone of "+id, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bindings, stored = append(bindings, b), append(stored, s)
+	}
+	if p.generated != 1 {
+		t.Errorf("generated %d data keys for 3 items, want 1", p.generated)
+	}
+	// A cold keyring, as in another Lambda, unwraps the key once.
+	cold := &countingProvider{KeyProvider: p.KeyProvider}
+	k = NewKeyring(cold)
+	for i, s := range stored {
+		got, err := k.Decrypt(ctx, s, bindings[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"phone of u1", "phone of u2", "phone of u3"}[i]; got != want {
+			t.Errorf("decrypted %q, want %q", got, want)
+		}
+	}
+	if cold.decrypted != 1 {
+		t.Errorf("unwrapped %d data keys, want 1", cold.decrypted)
+	}
+	// Another attribute gets a key of its own.
+	b := bindings[0]
+	b.Attribute = "address"
+	if _, err := k.Encrypt(ctx, "d", b); err != nil {
+		t.Fatal(err)
+	}
+	if cold.generated != 1 {
+		t.Errorf("generated %d data keys for a new attribute, want 1", cold.generated)
+	}
+}
+
+// Values written before bindings were added are still read.
+func TestLegacyValuesAreRead(t *testing.T) {
+	p := localProvider(t)
+	ctx := context.Background()
+	plaintext, wrapped, err := p.GenerateDataKey(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := newGCM(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nonce, nonce, []byte("+1 555 0100"), nil)
+	stored := legacyPrefix + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(sealed)
+	got, err := NewKeyring(p).Decrypt(ctx, stored, Binding{Table: testTable, Key: "PK=USER#u1,SK=PROFILE#u1", Attribute: "phone"})
+	if err != nil || got != "+1 555 0100" {
+		t.Errorf("Decrypt() = %q, %v", got, err)
+	}
+}
+
+func TestTamperingIsDetected(t *testing.T) {
+	k := NewKeyring(localProvider(t))
+	ctx := context.Background()
+	b := Binding{Table: testTable, Key: "PK=USER#u1,SK=PROFILE#u1", Attribute: "routing"}
+	s, err := k.Encrypt(ctx, "021000021", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change a character inside the ciphertext, away from the padding bits.
+	i := len(s) - 8
+	flipped := byte('A')
+	if s[i] == 'A' {
+		flipped = 'B'
+	}
+	if _, err := k.Decrypt(ctx, s[:i]+string(flipped)+s[i+1:], b); err == nil {
+		t.Error("tampered ciphertext decrypted")
+	}
+	if _, err := k.Decrypt(ctx, prefix+"nonsense", b); err == nil {
+		t.Error("malformed value decrypted")
+	}
+}
+
+func TestWrongKeyFails(t *testing.T) {
+	ctx := context.Background()
+	b := Binding{Table: testTable, Key: "PK=USER#u1,SK=PROFILE#u1", Attribute: "phone"}
+	s, err := NewKeyring(localProvider(t)).Encrypt(ctx, "secret", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLocalProvider(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyring(other).Decrypt(ctx, s, b); err == nil {
+		t.Error("decrypted with the wrong master key")
+	}
+}
+
+func TestLocalProviderKey(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewLocalProvider(key); err == nil {
+			t.Errorf("NewLocalProvider(%q) accepted the key", key)
+		}
+	}
+}
+
+func TestSecretIsRedactedInLogs(t *testing.T) {
+	r := record{ID: "u1", Phone: "+1 555 0100"}
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("saved", slog.Any("phone", r.Phone))
+	for _, out := range []string{buf.String(), fmt.Sprint(r), fmt.Sprintf("%v %+v %#v %s", r.Phone, r, r, r.Phone)} {
+		if strings.Contains(out, "555") {
+			t.Errorf("plaintext leaked into %q", out)
+		}
+	}
+	// JSON is how the owner receives the value, so it stays plaintext.
+	body, _ := json.Marshal(r)
+	if !strings.Contains(string(body), "+1 555 0100") {
+		t.Errorf("JSON = %s, want plaintext", body)
+	}
+}
+
+func TestRedactedAndMasked(t *testing.T) {
+	cases := []struct {
+		in, redacted, masked Secret
+	}{
+		{"", "", ""},
+		{"123", "[redacted]", "[redacted]"},
+		{"000123456789", "[redacted]", "****6789"},
+	}
+	for _, c := range cases {
+		if got := c.in.Redacted(); got != c.redacted {
+			t.Errorf("Redacted(%q) = %q, want %q", string(c.in), string(got), string(c.redacted))
+		}
+		if got := c.in.Masked(); got != c.masked {
+			t.Errorf("Masked(%q) = %q, want %q", string(c.in), string(got), string(c.masked))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package fieldcrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// redacted replaces a sensitive value in logs and redacted views.
+const redacted = "[redacted]"
+
+// Secret is a string stored encrypted. It is plaintext in Go and in JSON
+// once opened, ciphertext in DynamoDB, and redacted when logged or
+// formatted.
+type Secret string
+
+// ErrNotSealed means a Secret holding plaintext was marshalled without
+// going through Sealed.
+var ErrNotSealed = errors.New("fieldcrypt: Secret marshalled without Sealed")
+
+// MarshalDynamoDBAttributeValue stores a value Sealed encrypted. It refuses
+// plaintext, so a record that skipped Sealed fails to save rather than
+// storing it, and stores an empty Secret as NULL.
+func (s Secret) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	switch {
+	case s == "":
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	case !IsEncrypted(string(s)):
+		return nil, ErrNotSealed
+	}
+	return &types.AttributeValueMemberS{Value: string(s)}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads the stored value as it is; Open
+// decrypts it.
+func (s *Secret) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	v, ok := av.(*types.AttributeValueMemberS)
+	if !ok {
+		*s = ""
+		return nil
+	}
+	*s = Secret(v.Value)
+	return nil
+}
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// Sealed returns a copy of v, a struct or a pointer to one, with each
+// non-empty Secret encrypted for the item with the given key in table. Every
+// Secret is taken to be plaintext, as Open leaves them: a value that looks
+// encrypted, such as one a client sent, is encrypted like any other, so it
+// is stored bound to this item and read back as sent. The
+// attribute a Secret is bound to is its path of json names, such as
+// payoutMethod.accountNumber; embedded structs add no name, as when
+// marshalled. v itself keeps its plaintext, for the response. Secrets in
+// lists and maps are not supported, and fail to marshal.
+func Sealed[T any](ctx context.Context, table string, key map[string]types.AttributeValue, v T) (T, error) {
+	k, err := defaultKeyring()
+	if err != nil {
+		return v, err
+	}
+	sealed, err := seal(ctx, k, Binding{Table: table, Key: keyString(key)}, reflect.ValueOf(&v).Elem())
+	if err != nil {
+		return v, err
+	}
+	return sealed.Interface().(T), nil
+}
+
+func seal(ctx context.Context, k *Keyring, b Binding, v reflect.Value) (reflect.Value, error) {
+	switch {
+	case v.Type() == secretType:
+		if v.String() == "" {
+			return v, nil
+		}
+		stored, err := k.Encrypt(ctx, v.String(), b)
+		return reflect.ValueOf(Secret(stored)), err
+	case v.Kind() == reflect.Pointer && !v.IsNil():
+		elem, err := seal(ctx, k, b, v.Elem())
+		if err != nil {
+			return v, err
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(elem)
+		return out, nil
+	case v.Kind() == reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			child, ok := fieldBinding(b, v.Type().Field(i))
+			if !ok {
+				continue
+			}
+			field, err := seal(ctx, k, child, v.Field(i))
+			if err != nil {
+				return v, err
+			}
+			out.Field(i).Set(field)
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// Open decrypts, in place, the Secrets of the struct v points to, as read
+// from the item with the given key in table.
+func Open(ctx context.Context, table string, key map[string]types.AttributeValue, v interface{}) error {
+	k, err := defaultKeyring()
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("fieldcrypt: Open needs a non-nil pointer, not %T", v)
+	}
+	return open(ctx, k, Binding{Table: table, Key: keyString(key)}, rv.Elem())
+}
+
+func open(ctx context.Context, k *Keyring, b Binding, v reflect.Value) error {
+	switch {
+	case v.Type() == secretType:
+		plaintext, err := k.Decrypt(ctx, v.String(), b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.Attribute, err)
+		}
+		v.SetString(plaintext)
+	case v.Kind() == reflect.Pointer && !v.IsNil():
+		return open(ctx, k, b, v.Elem())
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			child, ok := fieldBinding(b, v.Type().Field(i))
+			if !ok {
+				continue
+			}
+			if err := open(ctx, k, child, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldBinding extends b's attribute path with a struct field's json name.
+// It reports false for fields that are not stored, and for unexported ones,
+// which it cannot set.
+func fieldBinding(b Binding, f reflect.StructField) (Binding, bool) {
+	if !f.IsExported() {
+		return b, false
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch {
+	case name == "-":
+		return b, false
+	case name == "" && f.Anonymous:
+		return b, true
+	case name == "":
+		name = f.Name
+	}
+	if b.Attribute != "" {
+		name = b.Attribute + "." + name
+	}
+	b.Attribute = name
+	return b, true
+}
+
+// keyString renders an item key as name=value pairs in name order.
+func keyString(key map[string]types.AttributeValue) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		switch av := key[name].(type) {
+		case *types.AttributeValueMemberS:
+			v = av.Value
+		case *types.AttributeValueMemberN:
+			v = av.Value
+		case *types.AttributeValueMemberB:
+			v = base64.StdEncoding.EncodeToString(av.Value)
+		}
+		parts[i] = name + "=" + v
+	}
+	return strings.Join(parts, ",")
+}
+
+// String keeps the value out of fmt output.
+func (s Secret) String() string {
+	return redacted
+}
+
+// GoString keeps the value out of %#v.
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// LogValue keeps the value out of slog output.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// Redacted returns the value shown in place of s to callers who may not see
+// it, or "" when s is empty.
+func (s Secret) Redacted() Secret {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// Masked returns s with all but its last four characters hidden, as shown
+// for account numbers.
+func (s Secret) Masked() Secret {
+	r := []rune(string(s))
+	if len(r) <= 4 {
+		return s.Redacted()
+	}
+	return Secret("****" + string(r[len(r)-4:]))
+}
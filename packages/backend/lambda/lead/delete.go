@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// handleDeleteLead soft-deletes a lead. Converted leads are kept with their
+// referral and cannot be deleted.
+func handleDeleteLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	l, err := getLead(ctx, req.PathParameters["leadId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if !l.allows(api.Identity(req), "leads:delete") || l.DeletedAt != "" {
+		return api.NotFound(ctx, "lead not found")
+	}
+	if l.Status == leadStatusConverted {
+		return api.ClientError(ctx, http.StatusConflict, "converted leads are kept with their referral")
+	}
+	if !api.IfMatch(req, l.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.MarkDeleted(ctx, leadDataTable, leadKey(l.ID), l.Version, api.Actor(req))
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// handleRestoreLead clears a lead's deletion mark. Admins only.
+func handleRestoreLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	l, err := getLead(ctx, req.PathParameters["leadId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if l == nil {
+		return api.NotFound(ctx, "lead not found")
+	}
+	if l.DeletedAt == "" {
+		return api.ClientError(ctx, http.StatusConflict, "lead is not deleted")
+	}
+	if !api.IfMatch(req, l.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.RestoreDeleted(ctx, leadDataTable, leadKey(l.ID), l.Version)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	l.DeletedAt, l.DeletedBy = "", ""
+	l.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	l.Version++
+	body, _ := json.Marshal(l)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, l.Version), nil
+}
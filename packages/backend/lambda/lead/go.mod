@@ -3,11 +3,13 @@ module lead
 go 1.24.3
 
 require (
+	api v0.0.0
 	github.com/aws/aws-lambda-go v1.49.0
 	github.com/aws/aws-sdk-go-v2 v1.30.0
 	github.com/aws/aws-sdk-go-v2/config v1.27.2
 	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.13.9
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.30.4
+	github.com/google/uuid v1.6.0
 )
 
 require (
@@ -25,4 +27,9 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sts v1.27.2 // indirect
 	github.com/aws/smithy-go v1.20.2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	rbac v0.0.0
 )
+
+replace rbac => ../rbac
+
+replace api => ../api
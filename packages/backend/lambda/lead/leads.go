@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"api"
+	"rbac"
+)
+
+const (
+	// ownerIndex is the GSI on ownerId in the lead data table.
+	ownerIndex = "OwnerIndex"
+
+	leadStatusNew       = "NEW"
+	leadStatusConverted = "CONVERTED"
+)
+
+// Lead is a prospect captured by an agent before it is referred to a partner.
+type Lead struct {
+	ID              string   `json:"id"`
+	OwnerID         string   `json:"ownerId"`
+	Name            string   `json:"name" validate:"required"`
+	Email           string   `json:"email,omitempty" validate:"email"`
+	Phone           string   `json:"phone,omitempty"`
+	Company         string   `json:"company,omitempty"`
+	Source          string   `json:"source,omitempty"`
+	PartnerInterest []string `json:"partnerInterest,omitempty"`
+	Notes           string   `json:"notes,omitempty"`
+	Status          string   `json:"status,omitempty" validate:"oneof=NEW CONTACTED QUALIFIED CONVERTED LOST"`
+	ReferralID      string   `json:"referralId,omitempty"`
+	Version         int      `json:"version"`
+	CreatedAt       string   `json:"createdAt,omitempty"`
+	UpdatedAt       string   `json:"updatedAt,omitempty"`
+	DeletedAt       string   `json:"deletedAt,omitempty"`
+	DeletedBy       string   `json:"deletedBy,omitempty"`
+}
+
+// Referral mirrors the record the user function writes for createReferral.
+type Referral struct {
+	ID         string `json:"id"`
+	UserID     string `json:"userId"`
+	CompanyID  string `json:"companyId"`
+	LeadID     string `json:"leadId"`
+	ClientName string `json:"clientName"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"createdAt"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+type convertLeadInput struct {
+	PartnerID string `json:"partnerId"`
+}
+
+func leadKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("LEAD#%s", id)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", id)},
+	}
+}
+
+// putLead writes l over existing, or creates it when existing is nil. The
+// write fails with a ConditionalCheckFailedException if the stored lead is no
+// longer at existing's version, or already exists for a create.
+func putLead(ctx context.Context, l Lead, existing *Lead) error {
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		Lead
+	}{
+		PK:   fmt.Sprintf("LEAD#%s", l.ID),
+		SK:   fmt.Sprintf("METADATA#%s", l.ID),
+		Lead: l,
+	})
+	if err != nil {
+		return err
+	}
+	put := &dynamodb.PutItemInput{TableName: aws.String(leadDataTable), Item: item, ConditionExpression: aws.String("attribute_not_exists(PK)")}
+	if existing != nil {
+		cond, names, values := api.VersionCondition(existing.Version)
+		put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues = aws.String(cond), names, values
+	}
+	_, err = ddb.PutItem(ctx, put)
+	return err
+}
+
+func getLead(ctx context.Context, id string) (*Lead, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(leadDataTable), Key: leadKey(id)})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	var l Lead
+	if err := attributevalue.UnmarshalMap(out.Item, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// allows reports whether id may perform action on l.
+func (l *Lead) allows(id rbac.Identity, action rbac.Action) bool {
+	return l != nil && rbac.Allowed(id, action, l.OwnerID)
+}
+
+// handleListLeads returns the caller's leads, or every lead for admins.
+// Deleted leads are left out unless includeDeleted is set.
+func handleListLeads(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	id := api.Identity(req)
+	var leads []Lead
+	var err error
+	if rbac.Allowed(id, "leads:read", "") {
+		leads, err = allLeads(ctx)
+	} else {
+		leads, err = leadsOwnedBy(ctx, id.Sub)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if !api.IncludeDeleted(req) {
+		live := leads[:0]
+		for _, l := range leads {
+			if l.DeletedAt == "" {
+				live = append(live, l)
+			}
+		}
+		leads = live
+	}
+	body, _ := json.Marshal(leads)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+func allLeads(ctx context.Context) ([]Lead, error) {
+	leads := []Lead{}
+	p := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{TableName: aws.String(leadDataTable)})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []Lead
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		leads = append(leads, page...)
+	}
+	return leads, nil
+}
+
+func leadsOwnedBy(ctx context.Context, ownerID string) ([]Lead, error) {
+	leads := []Lead{}
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(leadDataTable),
+		IndexName:              aws.String(ownerIndex),
+		KeyConditionExpression: aws.String("ownerId = :owner"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: ownerID},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []Lead
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		leads = append(leads, page...)
+	}
+	return leads, nil
+}
+
+func handleCreateLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var l Lead
+	if err := json.Unmarshal([]byte(req.Body), &l); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if l.Status == "" {
+		l.Status = leadStatusNew
+	}
+	if errs := api.ValidateStruct(l); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	if l.Status == leadStatusConverted {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "status", Message: "is set by converting the lead"}})
+	}
+	l.ID = uuid.NewString()
+	l.OwnerID = api.CallerSub(req)
+	l.ReferralID = ""
+	l.DeletedAt, l.DeletedBy = "", ""
+	now := time.Now().UTC().Format(time.RFC3339)
+	l.CreatedAt = now
+	l.UpdatedAt = now
+	l.Version = 1
+	if err := putLead(ctx, l, nil); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(l)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, l.Version), nil
+}
+
+func handleGetLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	l, err := getLead(ctx, req.PathParameters["leadId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if !l.allows(api.Identity(req), "leads:read") || (l.DeletedAt != "" && !api.IncludeDeleted(req)) {
+		return api.NotFound(ctx, "lead not found")
+	}
+	body, _ := json.Marshal(l)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, l.Version), nil
+}
+
+func handlePutLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	existing, err := getLead(ctx, req.PathParameters["leadId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if !existing.allows(api.Identity(req), "leads:update") || existing.DeletedAt != "" {
+		return api.NotFound(ctx, "lead not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	var l Lead
+	if err := json.Unmarshal([]byte(req.Body), &l); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if l.Status == "" {
+		l.Status = existing.Status
+	}
+	if errs := api.ValidateStruct(l); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	if l.Status != existing.Status && (l.Status == leadStatusConverted || existing.Status == leadStatusConverted) {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "status", Message: "is set by converting the lead"}})
+	}
+	// Ownership, the referral link, the creation time and deletion are
+	// server-managed.
+	l.ID = existing.ID
+	l.OwnerID = existing.OwnerID
+	l.ReferralID = existing.ReferralID
+	l.CreatedAt = existing.CreatedAt
+	l.DeletedAt, l.DeletedBy = "", ""
+	l.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	l.Version = existing.Version + 1
+	err = putLead(ctx, l, existing)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(l)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, l.Version), nil
+}
+
+// partnerAcceptsReferrals checks, in the conversion's transaction, that the
+// partner exists and is ACTIVE, as a referral submitted directly must.
+func partnerAcceptsReferrals(partnerID string) types.TransactWriteItem {
+	return types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName: aws.String(partnersTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", partnerID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", partnerID)},
+		},
+		ConditionExpression:      aws.String("#status = :active AND attribute_not_exists(deletedAt)"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: "ACTIVE"},
+		},
+	}}
+}
+
+// handleConvertLead turns a lead into a referral for the chosen partner. The
+// referral carries the lead's name as its client name and both records point
+// at each other; they are written in one transaction so a lead converts once.
+func handleConvertLead(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	l, err := getLead(ctx, req.PathParameters["leadId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if !l.allows(api.Identity(req), "leads:convert") || l.DeletedAt != "" {
+		return api.NotFound(ctx, "lead not found")
+	}
+	if l.Status == leadStatusConverted {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("lead already converted to referral %s", l.ReferralID))
+	}
+	var in convertLeadInput
+	if req.Body != "" {
+		if err := json.Unmarshal([]byte(req.Body), &in); err != nil {
+			return api.BodyError(ctx, err)
+		}
+	}
+	if in.PartnerID == "" && len(l.PartnerInterest) == 1 {
+		in.PartnerID = l.PartnerInterest[0]
+	}
+	if in.PartnerID == "" {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "partnerId", Message: "is required"}})
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	r := Referral{
+		ID:         uuid.NewString(),
+		UserID:     l.OwnerID,
+		CompanyID:  in.PartnerID,
+		LeadID:     l.ID,
+		ClientName: l.Name,
+		Status:     "IN_PROGRESS",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		Referral
+	}{
+		PK:       fmt.Sprintf("REFERRAL#%s", r.ID),
+		SK:       fmt.Sprintf("METADATA#%s", r.ID),
+		Referral: r,
+	})
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	event, err := api.NewAuditEvent(api.AuditReferral, r.ID, api.CallerSub(req), nil, r)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	// The partner is notified through the outbox, as for a referral
+	// submitted directly, so the notification is recorded if and only if
+	// the conversion is.
+	notify := api.NewOutboxMessage(api.TopicReferralSubmitted, r, r.ID)
+	cond, names, values := api.VersionCondition(l.Version)
+	names["#s"] = "status"
+	values[":converted"] = &types.AttributeValueMemberS{Value: leadStatusConverted}
+	values[":rid"] = &types.AttributeValueMemberS{Value: r.ID}
+	values[":now"] = &types.AttributeValueMemberS{Value: now}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(l.Version + 1)}
+	err = api.WriteWithOutbox(ctx, []types.TransactWriteItem{
+		partnerAcceptsReferrals(in.PartnerID),
+		{Update: &types.Update{
+			TableName:                 aws.String(leadDataTable),
+			Key:                       leadKey(l.ID),
+			UpdateExpression:          aws.String("SET #s = :converted, referralId = :rid, updatedAt = :now, #version = :nextVersion"),
+			ConditionExpression:       aws.String("(" + cond + ") AND #s <> :converted AND attribute_not_exists(deletedAt)"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		}},
+		{Put: &types.Put{
+			TableName:           aws.String(referralsTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		}},
+	}, []api.OutboxMessage{notify}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.ClientError(ctx, http.StatusUnprocessableEntity, fmt.Sprintf("partner %s is not accepting referrals", in.PartnerID))
+	}
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		// The partner check passed, so the lead update's condition failed.
+		return api.ClientError(ctx, http.StatusConflict, "lead was changed by another request; fetch it again and retry")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(r)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -13,17 +15,26 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"rbac"
 )
 
 var (
 	ddb              *dynamodb.Client
 	userProfileTable string
+	referralsTable   string
+	paymentsTable    string
+	leadDataTable    string
+	partnersTable    string
 )
 
 type LeadUser struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Company string `json:"company,omitempty"`
 }
 
 func init() {
@@ -32,7 +43,15 @@ func init() {
 		panic(err)
 	}
 	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: getenv("AUDIT_TABLE"), Outbox: getenv("OUTBOX_TABLE")})
+	if err := api.CheckTags(Lead{}); err != nil {
+		panic(err)
+	}
 	userProfileTable = getenv("USER_PROFILE_TABLE")
+	referralsTable = getenv("REFERRALS_TABLE")
+	paymentsTable = getenv("PAYMENTS_TABLE")
+	leadDataTable = getenv("LEAD_DATA_TABLE")
+	partnersTable = getenv("PARTNERS_TABLE")
 }
 
 func getenv(key string) string {
@@ -44,25 +63,47 @@ func getenv(key string) string {
 }
 
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	if req.Resource == "/lead/users" && req.HTTPMethod == http.MethodGet {
-		return handleGetUsers(ctx)
+	switch {
+	case req.Resource == "/lead/users" && req.HTTPMethod == http.MethodGet:
+		return handleGetUsers(ctx, req)
+	case req.Resource == "/lead/users/{userId}/downline" && req.HTTPMethod == http.MethodGet:
+		return handleGetDownline(ctx, req)
+	case req.Resource == "/leads" && req.HTTPMethod == http.MethodGet:
+		return handleListLeads(ctx, req)
+	case req.Resource == "/leads" && req.HTTPMethod == http.MethodPost:
+		return handleCreateLead(ctx, req)
+	case req.Resource == "/leads/{leadId}" && req.HTTPMethod == http.MethodGet:
+		return handleGetLead(ctx, req)
+	case req.Resource == "/leads/{leadId}" && req.HTTPMethod == http.MethodPut:
+		return handlePutLead(ctx, req)
+	case req.Resource == "/leads/{leadId}" && req.HTTPMethod == http.MethodDelete:
+		return handleDeleteLead(ctx, req)
+	case req.Resource == "/leads/{leadId}/convert" && req.HTTPMethod == http.MethodPost:
+		return handleConvertLead(ctx, req)
+	case req.Resource == "/leads/{leadId}/restore" && req.HTTPMethod == http.MethodPost:
+		return handleRestoreLead(ctx, req)
+	default:
+		return api.NotFound(ctx, "route not found")
 	}
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
 }
 
-func handleGetUsers(ctx context.Context) (events.APIGatewayProxyResponse, error) {
-	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(userProfileTable)})
-	if err != nil {
-		return serverError(err)
-	}
+// handleGetUsers lists the profiles in the calling lead's downline, or every
+// profile for admins. ?company= filters by company and ?search= matches a
+// substring of the name, both case-insensitively.
+func handleGetUsers(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	id := api.Identity(req)
 	var users []LeadUser
-	for _, item := range out.Items {
-		var u LeadUser
-		if err := attributevalue.UnmarshalMap(item, &u); err != nil {
-			return serverError(err)
-		}
-		users = append(users, u)
+	var err error
+	if id.Has(rbac.Admins, "") {
+		users, err = allUsers(ctx)
+	} else {
+		users, err = teamUsers(ctx, id.Sub)
 	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	users = filterUsers(users, req.QueryStringParameters["company"], req.QueryStringParameters["search"])
+	sort.Slice(users, func(i, j int) bool { return strings.ToLower(users[i].Name) < strings.ToLower(users[j].Name) })
 	body, _ := json.Marshal(users)
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
@@ -71,10 +112,65 @@ func handleGetUsers(ctx context.Context) (events.APIGatewayProxyResponse, error)
 	}, nil
 }
 
-func serverError(err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+func allUsers(ctx context.Context) ([]LeadUser, error) {
+	users := []LeadUser{}
+	// The table also holds DOWNLINE# edge items; only profiles are users.
+	// Soft-deleted profiles are left out.
+	p := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{
+		TableName:        aws.String(userProfileTable),
+		FilterExpression: aws.String("begins_with(SK, :profile) AND attribute_not_exists(deletedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":profile": &types.AttributeValueMemberS{Value: "PROFILE#"},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []LeadUser
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		users = append(users, page...)
+	}
+	return users, nil
+}
+
+// teamUsers returns every profile whose upline chain includes leadID.
+func teamUsers(ctx context.Context, leadID string) ([]LeadUser, error) {
+	_, members, err := walkDownline(ctx, leadID, teamDepthLimit)
+	if err != nil {
+		return nil, err
+	}
+	delete(members, leadID)
+	if err := loadProfiles(ctx, members); err != nil {
+		return nil, err
+	}
+	users := make([]LeadUser, 0, len(members))
+	for _, m := range members {
+		if m.hasProfile {
+			users = append(users, LeadUser{ID: m.ID, Name: m.Name, Email: m.Email, Company: m.Company})
+		}
+	}
+	return users, nil
+}
+
+func filterUsers(users []LeadUser, company, search string) []LeadUser {
+	search = strings.ToLower(strings.TrimSpace(search))
+	filtered := users[:0]
+	for _, u := range users {
+		if company != "" && !strings.EqualFold(u.Company, company) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(u.Name), search) {
+			continue
+		}
+		filtered = append(filtered, u)
+	}
+	return filtered
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(api.WithLogging(api.WithPolicy(handler)))
 }
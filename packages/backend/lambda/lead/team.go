@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+const (
+	// userIndex is the GSI on userId shared by the referrals and payments tables.
+	userIndex = "UserIndex"
+
+	defaultDownlineDepth = 3
+	maxDownlineDepth     = 10
+
+	// teamDepthLimit bounds how far /lead/users follows the upline chain.
+	teamDepthLimit = 50
+
+	// statsConcurrency bounds the parallel per-member stats queries.
+	statsConcurrency = 8
+)
+
+// TeamMember is one node of a lead's downline tree.
+type TeamMember struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	Email         string        `json:"email"`
+	Company       string        `json:"company,omitempty"`
+	Relation      string        `json:"relation,omitempty"`
+	ReferralCount int           `json:"referralCount"`
+	Earnings      float64       `json:"earnings"`
+	Downline      []*TeamMember `json:"downline,omitempty"`
+
+	hasProfile bool
+}
+
+type downlineEdge struct {
+	MemberID string `dynamodbav:"memberId"`
+	Relation string `dynamodbav:"relation"`
+}
+
+// handleGetDownline returns the downline tree below {userId} to ?depth levels.
+// Each member appears once, at the shallowest level it is reachable from.
+func handleGetDownline(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	depth := defaultDownlineDepth
+	if v := req.QueryStringParameters["depth"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDownlineDepth {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "depth", Message: fmt.Sprintf("must be an integer from 1 to %d", maxDownlineDepth)}})
+		}
+		depth = n
+	}
+
+	root, err := buildDownline(ctx, req.PathParameters["userId"], depth)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if root == nil {
+		return api.NotFound(ctx, "user not found")
+	}
+	body, _ := json.Marshal(root)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// buildDownline walks the downline of leadID and fills in each member's
+// profile and stats. It returns nil if the lead has no profile.
+func buildDownline(ctx context.Context, leadID string, depth int) (*TeamMember, error) {
+	root, members, err := walkDownline(ctx, leadID, depth)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadProfiles(ctx, members); err != nil {
+		return nil, err
+	}
+	if !root.hasProfile {
+		return nil, nil
+	}
+	if err := loadStats(ctx, members); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// walkDownline follows upline edges breadth-first from leadID for up to depth
+// levels. It returns the tree root and every node keyed by user ID, the lead
+// included; profiles and stats are not loaded.
+func walkDownline(ctx context.Context, leadID string, depth int) (*TeamMember, map[string]*TeamMember, error) {
+	root := &TeamMember{ID: leadID}
+	members := map[string]*TeamMember{leadID: root}
+	level := []*TeamMember{root}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var next []*TeamMember
+		for _, m := range level {
+			edges, err := directDownline(ctx, m.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, e := range edges {
+				if _, seen := members[e.MemberID]; seen {
+					continue
+				}
+				child := &TeamMember{ID: e.MemberID, Relation: e.Relation}
+				members[e.MemberID] = child
+				m.Downline = append(m.Downline, child)
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	return root, members, nil
+}
+
+func directDownline(ctx context.Context, uplineID string) ([]downlineEdge, error) {
+	var edges []downlineEdge
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(userProfileTable),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :downline)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":       &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", uplineID)},
+			":downline": &types.AttributeValueMemberS{Value: "DOWNLINE#"},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []downlineEdge
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		edges = append(edges, page...)
+	}
+	return edges, nil
+}
+
+// loadProfiles fills in name, email and company for every member, 100 keys
+// per BatchGetItem call. Soft-deleted profiles count as missing.
+func loadProfiles(ctx context.Context, members map[string]*TeamMember) error {
+	var keys []map[string]types.AttributeValue
+	for id := range members {
+		keys = append(keys, map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
+		})
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), 100)
+		batch := map[string]types.KeysAndAttributes{userProfileTable: {Keys: keys[:n]}}
+		keys = keys[n:]
+		for len(batch) > 0 {
+			out, err := ddb.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: batch})
+			if err != nil {
+				return err
+			}
+			var profiles []struct {
+				ID        string
+				Name      string
+				Email     string
+				Company   string
+				DeletedAt string
+			}
+			if err := attributevalue.UnmarshalListOfMaps(out.Responses[userProfileTable], &profiles); err != nil {
+				return err
+			}
+			for _, p := range profiles {
+				if m, ok := members[p.ID]; ok && p.DeletedAt == "" {
+					m.Name, m.Email, m.Company = p.Name, p.Email, p.Company
+					m.hasProfile = true
+				}
+			}
+			batch = out.UnprocessedKeys
+		}
+	}
+	return nil
+}
+
+// loadStats sets each member's referral count and paid earnings.
+func loadStats(ctx context.Context, members map[string]*TeamMember) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, statsConcurrency)
+	)
+	for _, m := range members {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *TeamMember) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			count, err := referralCount(ctx, m.ID)
+			if err == nil {
+				m.ReferralCount = count
+				m.Earnings, err = paidEarnings(ctx, m.ID)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func referralCount(ctx context.Context, userID string) (int, error) {
+	var count int
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(referralsTable),
+		IndexName:              aws.String(userIndex),
+		KeyConditionExpression: aws.String("userId = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+		Select: types.SelectCount,
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		count += int(out.Count)
+	}
+	return count, nil
+}
+
+// paidEarnings sums the user's processed payments in dollars, matching the
+// totalEarnings figure on the dashboard.
+func paidEarnings(ctx context.Context, userID string) (float64, error) {
+	var total int64
+	values := map[string]types.AttributeValue{
+		":uid": &types.AttributeValueMemberS{Value: userID},
+	}
+	statuses := make([]string, len(api.EarnedPaymentStatuses))
+	for i, status := range api.EarnedPaymentStatuses {
+		statuses[i] = fmt.Sprintf(":s%d", i)
+		values[statuses[i]] = &types.AttributeValueMemberS{Value: status}
+	}
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:                 aws.String(paymentsTable),
+		IndexName:                 aws.String(userIndex),
+		KeyConditionExpression:    aws.String("userId = :uid"),
+		FilterExpression:          aws.String("#s IN (" + strings.Join(statuses, ", ") + ")"),
+		ProjectionExpression:      aws.String("amount"),
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: values,
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		var payments []struct{ Amount int64 }
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &payments); err != nil {
+			return 0, err
+		}
+		for _, pay := range payments {
+			total += pay.Amount
+		}
+	}
+	return api.CentsToDollars(total), nil
+}
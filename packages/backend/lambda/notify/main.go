@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var (
+	ddb                *dynamodb.Client
+	userProfileTable   string
+	notificationsTable string
+	// notifiers deliver a rendered notification on each channel. They are
+	// set up in main, so tests can use file sinks.
+	notifiers map[string]notifier
+)
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
+}
+
+// domainEvent is the detail of the events the stream function puts on the
+// domain event bus.
+type domainEvent struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	OccurredAt string          `json:"occurredAt"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// handler notifies the user a referral or payment event is about on every
+// channel they have not turned off. An error makes EventBridge retry the
+// whole event, so channels that already succeeded may be notified again;
+// in-app notifications are keyed by event and so are not duplicated.
+func handler(ctx context.Context, e events.CloudWatchEvent) error {
+	var evt domainEvent
+	if err := json.Unmarshal(e.Detail, &evt); err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+	tmpl, data, err := templateFor(evt)
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
+		return nil
+	}
+	user, err := getRecipient(ctx, data.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		logger.InfoContext(ctx, "no recipient for notification", slog.String("eventId", evt.ID), slog.String("userId", data.UserID))
+		return nil
+	}
+	data.Name = user.Name
+	return deliver(ctx, evt, tmpl, data, user)
+}
+
+// deliver renders tmpl for user and sends it on every channel they have
+// not turned off.
+func deliver(ctx context.Context, evt domainEvent, tmpl *notificationTemplate, data templateData, user *recipient) error {
+	for _, channel := range channels {
+		if !user.wants(channel) {
+			continue
+		}
+		n, err := tmpl.render(data)
+		if err != nil {
+			return err
+		}
+		n.ID = evt.ID
+		n.UserID = user.ID
+		n.Channel = channel
+		n.EventType = evt.Type
+		n.CreatedAt = evt.OccurredAt
+		if channel == channelEmail {
+			if user.Email == "" {
+				continue
+			}
+			n.To = user.Email
+		}
+		if err := notifiers[channel].Notify(ctx, n); err != nil {
+			return fmt.Errorf("notify %s on %s: %w", user.ID, channel, err)
+		}
+		logger.InfoContext(ctx, "notification sent",
+			slog.String("eventId", evt.ID),
+			slog.String("userId", user.ID),
+			slog.String("channel", channel),
+		)
+	}
+	return nil
+}
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	userProfileTable = getenv("USER_PROFILE_TABLE")
+	notificationsTable = getenv("NOTIFICATIONS_TABLE")
+
+	email, err := newNotifier(os.Getenv("EMAIL_SINK"), func() notifier {
+		return &sesNotifier{client: sesv2.NewFromConfig(cfg), from: getenv("EMAIL_FROM")}
+	})
+	if err != nil {
+		panic(err)
+	}
+	inApp, err := newNotifier(os.Getenv("IN_APP_SINK"), func() notifier {
+		return &inAppNotifier{}
+	})
+	if err != nil {
+		panic(err)
+	}
+	notifiers = map[string]notifier{channelEmail: email, channelInApp: inApp}
+	lambda.Start(handler)
+}
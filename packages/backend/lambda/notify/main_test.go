@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useFileSinks points both channels at files in a temporary directory and
+// returns a function that reads back what each received.
+func useFileSinks(t *testing.T) func() map[string][]notification {
+	dir := t.TempDir()
+	paths := map[string]string{}
+	notifiers = map[string]notifier{}
+	for _, channel := range channels {
+		paths[channel] = filepath.Join(dir, channel+".jsonl")
+		n, err := newNotifier("file:"+paths[channel], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifiers[channel] = n
+	}
+	return func() map[string][]notification {
+		sent := map[string][]notification{}
+		for channel, path := range paths {
+			f, err := os.Open(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			lines := bufio.NewScanner(f)
+			for lines.Scan() {
+				var n notification
+				if err := json.Unmarshal(lines.Bytes(), &n); err != nil {
+					t.Fatal(err)
+				}
+				sent[channel] = append(sent[channel], n)
+			}
+		}
+		return sent
+	}
+}
+
+func event(typ, detail string) domainEvent {
+	return domainEvent{ID: "e1#" + typ, Type: typ, OccurredAt: "2025-03-01T12:00:00Z", Detail: json.RawMessage(detail)}
+}
+
+func TestTemplates(t *testing.T) {
+	cases := []struct {
+		name    string
+		evt     domainEvent
+		subject string
+		body    []string
+	}{
+		{"in review", event("ReferralStatusChanged", `{"userId":"u1","clientName":"Ada","status":"IN_REVIEW"}`),
+			"Your referral for Ada is in review", []string{"Hi Grace,", "referral for Ada has moved to review"}},
+		{"paid", event("ReferralStatusChanged", `{"userId":"u1","clientName":"Ada","status":"PAID","amount":150050}`),
+			"Your referral for Ada has been paid", []string{"Hi Grace,", "referral of Ada ($1500.50)"}},
+		{"paid without amount", event("ReferralStatusChanged", `{"userId":"u1","clientName":"Ada","status":"PAID"}`),
+			"Your referral for Ada has been paid", []string{"referral of Ada\nhas been paid"}},
+		{"rejected", event("ReferralStatusChanged", `{"userId":"u1","clientName":"Ada","status":"REJECTED"}`),
+			"Your referral for Ada was not accepted", []string{"did not accept your referral of Ada."}},
+		{"payment", event("PaymentProcessed", `{"userId":"u1","amount":2500,"status":"PROCESSED"}`),
+			"Payment of $25.00 processed", []string{"A payment of $25.00 has been processed"}},
+	}
+	user := &recipient{ID: "u1", Name: "Grace", Email: "grace@example.com"}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sent := useFileSinks(t)
+			tmpl, data, err := templateFor(c.evt)
+			if err != nil || tmpl == nil {
+				t.Fatalf("templateFor() = %v, %v", tmpl, err)
+			}
+			data.Name = user.Name
+			if err := deliver(context.Background(), c.evt, tmpl, data, user); err != nil {
+				t.Fatal(err)
+			}
+			got := sent()
+			for _, channel := range channels {
+				if len(got[channel]) != 1 {
+					t.Fatalf("%s got %d notifications, want 1", channel, len(got[channel]))
+				}
+				n := got[channel][0]
+				if n.ID != c.evt.ID || n.UserID != "u1" || n.Channel != channel || n.EventType != c.evt.Type || n.CreatedAt != c.evt.OccurredAt {
+					t.Errorf("%s notification = %+v", channel, n)
+				}
+				if n.Subject != c.subject {
+					t.Errorf("%s subject = %q, want %q", channel, n.Subject, c.subject)
+				}
+				for _, want := range c.body {
+					if !strings.Contains(n.Body, want) {
+						t.Errorf("%s body = %q, want it to contain %q", channel, n.Body, want)
+					}
+				}
+			}
+			if to := got[channelEmail][0].To; to != user.Email {
+				t.Errorf("email to = %q", to)
+			}
+			if to := got[channelInApp][0].To; to != "" {
+				t.Errorf("in-app to = %q", to)
+			}
+		})
+	}
+}
+
+func TestUnnotifiedEvents(t *testing.T) {
+	for _, evt := range []domainEvent{
+		event("ReferralCreated", `{"userId":"u1","status":"IN_PROGRESS"}`),
+		event("ReferralStatusChanged", `{"userId":"u1","status":"APPROVED"}`),
+		event("ReferralPaid", `{"userId":"u1","status":"PAID"}`),
+	} {
+		if tmpl, _, err := templateFor(evt); tmpl != nil || err != nil {
+			t.Errorf("templateFor(%s %s) = %v, %v, want no template", evt.Type, evt.Detail, tmpl, err)
+		}
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	on, off := true, false
+	cases := []struct {
+		name string
+		user recipient
+		want []string
+	}{
+		{"no preferences", recipient{Email: "grace@example.com"}, []string{channelEmail, channelInApp}},
+		{"unset channels", recipient{Email: "grace@example.com", Preferences: &notificationPreferences{}}, []string{channelEmail, channelInApp}},
+		{"both on", recipient{Email: "grace@example.com", Preferences: &notificationPreferences{Email: &on, InApp: &on}}, []string{channelEmail, channelInApp}},
+		{"email off", recipient{Email: "grace@example.com", Preferences: &notificationPreferences{Email: &off}}, []string{channelInApp}},
+		{"in-app off", recipient{Email: "grace@example.com", Preferences: &notificationPreferences{InApp: &off}}, []string{channelEmail}},
+		{"both off", recipient{Email: "grace@example.com", Preferences: &notificationPreferences{Email: &off, InApp: &off}}, nil},
+		{"no email address", recipient{}, []string{channelInApp}},
+	}
+	evt := event("PaymentProcessed", `{"userId":"u1","amount":2500}`)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sent := useFileSinks(t)
+			tmpl, data, err := templateFor(evt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := c.user
+			user.ID = "u1"
+			if err := deliver(context.Background(), evt, tmpl, data, &user); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, channel := range channels {
+				if len(sent()[channel]) > 0 {
+					got = append(got, channel)
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("notified on %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// Notification channels, in the order they are tried.
+const (
+	channelEmail = "email"
+	channelInApp = "inApp"
+)
+
+var channels = []string{channelEmail, channelInApp}
+
+// inAppRetention is how long in-app notifications are kept.
+const inAppRetention = 90 * 24 * time.Hour
+
+// notification is one rendered message to one user on one channel. ID is
+// the domain event ID, so redeliveries of an event carry the same ID.
+type notification struct {
+	ID        string `json:"id"`
+	UserID    string `json:"userId"`
+	Channel   string `json:"channel"`
+	EventType string `json:"eventType"`
+	To        string `json:"to,omitempty"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// notifier delivers notifications on one channel.
+type notifier interface {
+	Notify(ctx context.Context, n notification) error
+}
+
+// newNotifier returns the notifier a sink setting names: "file:<path>"
+// appends JSON lines to a file and "smtp://<host:port>" sends plain mail
+// through an SMTP server such as a local catcher. An empty setting uses the
+// production notifier that prod returns.
+func newNotifier(sink string, prod func() notifier) (notifier, error) {
+	switch {
+	case sink == "":
+		return prod(), nil
+	case strings.HasPrefix(sink, "file:"):
+		return &fileNotifier{path: strings.TrimPrefix(sink, "file:")}, nil
+	case strings.HasPrefix(sink, "smtp://"):
+		return &smtpNotifier{addr: strings.TrimPrefix(sink, "smtp://"), from: "notifications@localhost"}, nil
+	}
+	return nil, fmt.Errorf("unknown notification sink %q", sink)
+}
+
+// sesNotifier sends email through SES.
+type sesNotifier struct {
+	client *sesv2.Client
+	from   string
+}
+
+func (s *sesNotifier) Notify(ctx context.Context, n notification) error {
+	_, err := s.client.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(s.from),
+		Destination:      &sestypes.Destination{ToAddresses: []string{n.To}},
+		Content: &sestypes.EmailContent{Simple: &sestypes.Message{
+			Subject: &sestypes.Content{Data: aws.String(n.Subject), Charset: aws.String("UTF-8")},
+			Body: &sestypes.Body{
+				Text: &sestypes.Content{Data: aws.String(n.Body), Charset: aws.String("UTF-8")},
+			},
+		}},
+	})
+	return err
+}
+
+// inAppNotifier stores notifications in the notifications table, where the
+// profile function lists them. Items are keyed by event, so a redelivered
+// event is stored once.
+type inAppNotifier struct{}
+
+func (inAppNotifier) Notify(ctx context.Context, n notification) error {
+	item, err := attributevalue.MarshalMapWithOptions(struct {
+		PK string `json:"PK"`
+		SK string `json:"SK"`
+		notification
+		ExpiresAt int64 `json:"expiresAt"`
+	}{
+		PK:           "USER#" + n.UserID,
+		SK:           fmt.Sprintf("NOTIFICATION#%s#%s", n.CreatedAt, n.ID),
+		notification: n,
+		ExpiresAt:    time.Now().Add(inAppRetention).Unix(),
+	}, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ddb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(notificationsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil
+	}
+	return err
+}
+
+// fileNotifier appends each notification to a file as a JSON line.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *fileNotifier) Notify(_ context.Context, n notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// smtpNotifier sends plain-text mail through an SMTP server without
+// authentication.
+type smtpNotifier struct {
+	addr string
+	from string
+}
+
+func (s *smtpNotifier) Notify(_ context.Context, n notification) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.from, n.To, n.Subject, strings.ReplaceAll(n.Body, "\n", "\r\n"))
+	return smtp.SendMail(s.addr, nil, s.from, []string{n.To}, []byte(msg))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// notificationPreferences mirrors the profile attribute of the same name.
+// A channel left unset is on.
+type notificationPreferences struct {
+	Email *bool `json:"email,omitempty"`
+	InApp *bool `json:"inApp,omitempty"`
+}
+
+// recipient is the part of a user profile notifications need.
+type recipient struct {
+	ID          string                   `json:"id"`
+	Name        string                   `json:"name"`
+	Email       string                   `json:"email"`
+	Preferences *notificationPreferences `json:"notificationPreferences"`
+	DeletedAt   string                   `json:"deletedAt"`
+}
+
+// wants reports whether the user has channel turned on.
+func (r *recipient) wants(channel string) bool {
+	if r.Preferences == nil {
+		return true
+	}
+	var on *bool
+	switch channel {
+	case channelEmail:
+		on = r.Preferences.Email
+	case channelInApp:
+		on = r.Preferences.InApp
+	}
+	return on == nil || *on
+}
+
+// getRecipient loads the profile of userID, returning nil if there is none
+// or it is deleted.
+func getRecipient(ctx context.Context, userID string) (*recipient, error) {
+	if userID == "" {
+		return nil, nil
+	}
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(userProfileTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", userID)},
+		},
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	var r recipient
+	if err := attributevalue.UnmarshalMapWithOptions(out.Item, &r, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return nil, err
+	}
+	if r.DeletedAt != "" {
+		return nil, nil
+	}
+	return &r, nil
+}
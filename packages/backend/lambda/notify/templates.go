@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// templateData is what templates can refer to: the event detail, which is
+// the referral or payment, and the recipient's name. Amounts are in cents, as
+// stored; the dollars function formats them.
+type templateData struct {
+	ID             string  `json:"id"`
+	UserID         string  `json:"userId"`
+	ClientName     string  `json:"clientName"`
+	Status         string  `json:"status"`
+	PreviousStatus string  `json:"previousStatus"`
+	Amount         float64 `json:"amount"`
+	Name           string  `json:"-"`
+}
+
+// notificationTemplate renders the subject and body of one kind of
+// notification. The same text is used on every channel.
+type notificationTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"dollars": func(cents float64) string { return fmt.Sprintf("$%.2f", cents/100) },
+}
+
+func mustTemplate(subject, body string) *notificationTemplate {
+	return &notificationTemplate{
+		subject: template.Must(template.New("subject").Funcs(templateFuncs).Parse(subject)),
+		body:    template.Must(template.New("body").Funcs(templateFuncs).Parse(body)),
+	}
+}
+
+// templates are keyed by event type, and for referral status changes by
+// the new status. Events without a template are not notified.
+var templates = map[string]*notificationTemplate{
+	"ReferralStatusChanged:IN_REVIEW": mustTemplate(
+		"Your referral for {{.ClientName}} is in review",
+		`Hi {{.Name}},
+
+Your referral for {{.ClientName}} has moved to review. We will let you know
+as soon as the partner has made a decision.`),
+	"ReferralStatusChanged:PAID": mustTemplate(
+		"Your referral for {{.ClientName}} has been paid",
+		`Hi {{.Name}},
+
+Good news: the commission for your referral of {{.ClientName}}{{if .Amount}} ({{dollars .Amount}}){{end}}
+has been paid. You can see it on your dashboard.`),
+	"ReferralStatusChanged:REJECTED": mustTemplate(
+		"Your referral for {{.ClientName}} was not accepted",
+		`Hi {{.Name}},
+
+Unfortunately the partner did not accept your referral of {{.ClientName}}.
+Contact your team lead if you have questions.`),
+	"PaymentProcessed": mustTemplate(
+		"Payment of {{dollars .Amount}} processed",
+		`Hi {{.Name}},
+
+A payment of {{dollars .Amount}} has been processed and is on its way to
+your account.`),
+}
+
+// templateFor returns the template for evt and the data to render it with,
+// or a nil template if evt is not notified.
+func templateFor(evt domainEvent) (*notificationTemplate, templateData, error) {
+	var data templateData
+	if err := json.Unmarshal(evt.Detail, &data); err != nil {
+		return nil, data, fmt.Errorf("decode %s detail: %w", evt.Type, err)
+	}
+	key := evt.Type
+	if evt.Type == "ReferralStatusChanged" {
+		key += ":" + data.Status
+	}
+	return templates[key], data, nil
+}
+
+// render fills in the subject and body of a notification.
+func (t *notificationTemplate) render(data templateData) (notification, error) {
+	var subject, body strings.Builder
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return notification{}, err
+	}
+	if err := t.body.Execute(&body, data); err != nil {
+		return notification{}, err
+	}
+	return notification{Subject: subject.String(), Body: body.String()}, nil
+}
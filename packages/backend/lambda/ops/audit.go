@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// The audit log is written by the functions that mutate referrals, payments,
+// bonus pools and partner compensation; this function only reads it. Events
+// are returned newest first, a page at a time.
+
+const (
+	// actorIndex is the GSI on actor and at in the audit table.
+	actorIndex        = "ActorIndex"
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditPage is one page of events. NextToken is set when there are more.
+type auditPage struct {
+	Events    []api.AuditEvent `json:"events"`
+	NextToken string           `json:"nextToken,omitempty"`
+}
+
+// handleEntityAudit returns the history of one entity.
+func handleEntityAudit(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	entityType := req.PathParameters["entityType"]
+	known := false
+	for _, t := range api.AuditEntityTypes {
+		known = known || t == entityType
+	}
+	if !known {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "entityType", Message: "must be one of " + strings.Join(api.AuditEntityTypes, ", ")}})
+	}
+	return queryAudit(ctx, req, &dynamodb.QueryInput{
+		TableName:              aws.String(auditTable),
+		KeyConditionExpression: aws.String("PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("AUDIT#%s#%s", entityType, req.PathParameters["entityId"])},
+		},
+	})
+}
+
+// handleActorAudit returns the events recorded for one actor across all
+// entities.
+func handleActorAudit(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return queryAudit(ctx, req, &dynamodb.QueryInput{
+		TableName:              aws.String(auditTable),
+		IndexName:              aws.String(actorIndex),
+		KeyConditionExpression: aws.String("actor = :actor"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":actor": &types.AttributeValueMemberS{Value: req.PathParameters["actor"]},
+		},
+	})
+}
+
+// queryAudit runs input newest first, paged by ?limit and ?nextToken.
+func queryAudit(ctx context.Context, req events.APIGatewayProxyRequest, input *dynamodb.QueryInput) (events.APIGatewayProxyResponse, error) {
+	limit := defaultAuditLimit
+	if v := req.QueryStringParameters["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "limit", Message: fmt.Sprintf("must be an integer from 1 to %d", maxAuditLimit)}})
+		}
+		limit = n
+	}
+	if v := req.QueryStringParameters["nextToken"]; v != "" {
+		start, err := decodeToken(v)
+		if err != nil {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "nextToken", Message: "is not a token from a previous page"}})
+		}
+		input.ExclusiveStartKey = start
+	}
+	input.Limit = aws.Int32(int32(limit))
+	input.ScanIndexForward = aws.Bool(false)
+
+	out, err := ddb.Query(ctx, input)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	page := auditPage{Events: []api.AuditEvent{}}
+	if err := attributevalue.UnmarshalListOfMapsWithOptions(out.Items, &page.Events, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(out.LastEvaluatedKey) > 0 {
+		if page.NextToken, err = encodeToken(out.LastEvaluatedKey); err != nil {
+			return api.ServerError(ctx, err)
+		}
+	}
+	body, _ := json.Marshal(page)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// encodeToken turns a LastEvaluatedKey, whose attributes are all strings in
+// this table, into an opaque page token.
+func encodeToken(key map[string]types.AttributeValue) (string, error) {
+	var m map[string]string
+	if err := attributevalue.UnmarshalMap(key, &m); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeToken(token string) (map[string]types.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return attributevalue.MarshalMap(m)
+}
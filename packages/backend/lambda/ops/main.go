@@ -1,27 +1,71 @@
 package main
 
 import (
-    "context"
-    "encoding/json"
-    "net/http"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
 
-    "github.com/aws/aws-lambda-go/events"
-    "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"api"
+)
+
+var (
+	ddb        *dynamodb.Client
+	auditTable string
 )
 
-type response struct {
-    Message string `json:"message"`
+// stubRoutes lists the DocuSign and bonus pool endpoints wired to this
+// function. None of them are implemented yet.
+var stubRoutes = map[string]bool{
+	http.MethodPost + " /docusign/envelopes":             true,
+	http.MethodGet + " /docusign/envelopes/{envelopeId}": true,
+	http.MethodGet + " /bonus-pools":                     true,
+	http.MethodPost + " /bonus-pools":                    true,
+	http.MethodGet + " /bonus-pools/{poolId}":            true,
+	http.MethodPut + " /bonus-pools/{poolId}":            true,
+	http.MethodGet + " /bonus-pools/{poolId}/report":     true,
+}
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: getenv("AUDIT_TABLE")})
+	auditTable = getenv("AUDIT_TABLE")
+}
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
 }
 
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    body, _ := json.Marshal(response{Message: "not implemented"})
-    return events.APIGatewayProxyResponse{
-        StatusCode: http.StatusOK,
-        Headers:    map[string]string{"Content-Type": "application/json"},
-        Body:       string(body),
-    }, nil
+	switch {
+	case req.Resource == "/audit/entities/{entityType}/{entityId}" && req.HTTPMethod == http.MethodGet:
+		return handleEntityAudit(ctx, req)
+	case req.Resource == "/audit/actors/{actor}" && req.HTTPMethod == http.MethodGet:
+		return handleActorAudit(ctx, req)
+	case req.Resource == "/docusign/callback" && req.HTTPMethod == http.MethodPost:
+		// DocuSign retries a callback until it gets a 2xx, so it is
+		// acknowledged even though nothing processes it yet.
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: `{"message":"not implemented"}`, Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	case stubRoutes[req.HTTPMethod+" "+req.Resource]:
+		return api.ErrorResponse(ctx, http.StatusNotImplemented, "NOT_IMPLEMENTED", "not implemented", nil)
+	default:
+		return api.NotFound(ctx, "route not found")
+	}
 }
 
 func main() {
-    lambda.Start(handler)
+	lambda.Start(api.WithLogging(api.WithPolicy(handler)))
 }
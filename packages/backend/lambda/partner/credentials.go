@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// Partners call the partner API (/partner-api/...) with their own
+// credential, mlp_<keyId>_<secret>, in the Authorization header. The
+// authorizer function resolves it to the partner and passes partnerId to
+// the handlers, which only ever serve that partner's data. Credentials live
+// in the partners table next to the partner: PK PARTNER#<partnerId>, SK
+// CREDENTIAL#<keyId>, with the CredentialIndex GSI on keyId. Only the
+// SHA-256 of the key is stored; the key itself is shown once.
+
+// Credential statuses. A rotated credential keeps working for
+// rotationGracePeriod so the partner can switch to its replacement.
+const (
+	credentialActive  = "ACTIVE"
+	credentialRotated = "ROTATED"
+	credentialRevoked = "REVOKED"
+)
+
+const (
+	credentialKeyPrefix = "mlp_"
+	rotationGracePeriod = 24 * time.Hour
+)
+
+// credential is a stored partner credential. KeyHash never leaves the
+// table.
+type credential struct {
+	ID         string `json:"id"`
+	PartnerID  string `json:"partnerId"`
+	KeyID      string `json:"keyId"`
+	KeyHash    string `json:"-"`
+	Prefix     string `json:"prefix"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"createdAt"`
+	CreatedBy  string `json:"createdBy"`
+	ExpiresAt  string `json:"expiresAt,omitempty"`
+	ReplacedBy string `json:"replacedBy,omitempty"`
+	RevokedAt  string `json:"revokedAt,omitempty"`
+	RevokedBy  string `json:"revokedBy,omitempty"`
+}
+
+// issuedCredential is the response to issuing a credential, the only time
+// the key is returned.
+type issuedCredential struct {
+	credential
+	Key string `json:"key"`
+}
+
+func credentialKey(partnerID, keyID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", partnerID)},
+		"SK": &types.AttributeValueMemberS{Value: "CREDENTIAL#" + keyID},
+	}
+}
+
+// newCredential generates a key for the partner.
+func newCredential(partnerID, by string) (issuedCredential, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return issuedCredential{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return issuedCredential{}, err
+	}
+	keyID := hex.EncodeToString(id)
+	key := credentialKeyPrefix + keyID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(key))
+	return issuedCredential{
+		credential: credential{
+			ID:        keyID,
+			PartnerID: partnerID,
+			KeyID:     keyID,
+			KeyHash:   hex.EncodeToString(sum[:]),
+			Prefix:    credentialKeyPrefix + keyID,
+			Status:    credentialActive,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			CreatedBy: by,
+		},
+		Key: key,
+	}, nil
+}
+
+// credentialPut is the transaction item that stores c.
+func credentialPut(c credential) (types.TransactWriteItem, error) {
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		credential
+		KeyHash string `json:"keyHash"`
+	}{
+		PK:         fmt.Sprintf("PARTNER#%s", c.PartnerID),
+		SK:         "CREDENTIAL#" + c.KeyID,
+		credential: c,
+		KeyHash:    c.KeyHash,
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(partnersTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}}, nil
+}
+
+// handleCreateCredential issues a new credential for a partner. Admins only.
+func handleCreateCredential(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || p.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	issued, err := newCredential(p.ID, api.Actor(req))
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	put, err := credentialPut(issued.credential)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if _, err := ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{put}}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(issued)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"}}, nil
+}
+
+// handleListCredentials lists a partner's credentials, without their keys.
+// Admins only.
+func handleListCredentials(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	creds := []credential{}
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(partnersTable),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", req.PathParameters["partnerId"])},
+			":prefix": &types.AttributeValueMemberS{Value: "CREDENTIAL#"},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		var page []credential
+		if err := attributevalue.UnmarshalListOfMapsWithOptions(out.Items, &page, func(o *attributevalue.DecoderOptions) {
+			o.TagKey = "json"
+		}); err != nil {
+			return api.ServerError(ctx, err)
+		}
+		creds = append(creds, page...)
+	}
+	body, _ := json.Marshal(creds)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// handleRotateCredential issues a replacement for an active credential. The
+// old one is marked ROTATED and keeps working for rotationGracePeriod.
+// Admins only.
+func handleRotateCredential(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || p.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	issued, err := newCredential(p.ID, api.Actor(req))
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	put, err := credentialPut(issued.credential)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	// The old credential is updated first so a failed condition on it is
+	// the one reported.
+	_, err = ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		{Update: &types.Update{
+			TableName:                aws.String(partnersTable),
+			Key:                      credentialKey(p.ID, req.PathParameters["credentialId"]),
+			UpdateExpression:         aws.String("SET #status = :rotated, expiresAt = :expiresAt, replacedBy = :replacedBy"),
+			ConditionExpression:      aws.String("#status = :active"),
+			ExpressionAttributeNames: map[string]string{"#status": "status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":rotated":    &types.AttributeValueMemberS{Value: credentialRotated},
+				":active":     &types.AttributeValueMemberS{Value: credentialActive},
+				":expiresAt":  &types.AttributeValueMemberS{Value: time.Now().UTC().Add(rotationGracePeriod).Format(time.RFC3339)},
+				":replacedBy": &types.AttributeValueMemberS{Value: issued.ID},
+			},
+		}},
+		put,
+	}})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 && aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return api.NotFound(ctx, "no active credential with that ID")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(issued)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"}}, nil
+}
+
+// handleRevokeCredential stops a credential from working, including one in
+// its rotation grace period. Admins only.
+func handleRevokeCredential(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	_, err := ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(partnersTable),
+		Key:                      credentialKey(req.PathParameters["partnerId"], req.PathParameters["credentialId"]),
+		UpdateExpression:         aws.String("SET #status = :revoked, revokedAt = :now, revokedBy = :by"),
+		ConditionExpression:      aws.String("attribute_exists(PK) AND #status <> :revoked"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked": &types.AttributeValueMemberS{Value: credentialRevoked},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+			":by":      &types.AttributeValueMemberS{Value: api.Actor(req)},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.NotFound(ctx, "no unrevoked credential with that ID")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"referralstatus"
+)
+
+// companyIndex is the GSI on companyId in the referrals table.
+const companyIndex = "CompanyIndex"
+
+// openReferralStatuses are the referral states a partner still has to act on.
+var openReferralStatuses = []string{referralstatus.InProgress, referralstatus.InReview}
+
+// openReferralCount counts the partner's referrals that are not yet paid or
+// rejected.
+func openReferralCount(ctx context.Context, partnerID string) (int, error) {
+	var count int
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:                aws.String(referralsTable),
+		IndexName:                aws.String(companyIndex),
+		KeyConditionExpression:   aws.String("companyId = :pid"),
+		FilterExpression:         aws.String("#s IN (:open0, :open1)"),
+		ExpressionAttributeNames: map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pid":   &types.AttributeValueMemberS{Value: partnerID},
+			":open0": &types.AttributeValueMemberS{Value: openReferralStatuses[0]},
+			":open1": &types.AttributeValueMemberS{Value: openReferralStatuses[1]},
+		},
+		Select: types.SelectCount,
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		count += int(out.Count)
+	}
+	return count, nil
+}
+
+// handleDeletePartner soft-deletes a partner. Partners with open referrals
+// cannot be deleted.
+func handleDeletePartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	existing, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	open, err := openReferralCount(ctx, existing.ID)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if open > 0 {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("partner has %d open referrals", open))
+	}
+	err = api.MarkDeleted(ctx, partnersTable, partnerKey(existing.ID), existing.Version, api.Actor(req))
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// handleRestorePartner clears a partner's deletion mark. Admins only.
+func handleRestorePartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil {
+		return api.NotFound(ctx, "partner not found")
+	}
+	if p.DeletedAt == "" {
+		return api.ClientError(ctx, http.StatusConflict, "partner is not deleted")
+	}
+	if !api.IfMatch(req, p.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.RestoreDeleted(ctx, partnersTable, partnerKey(p.ID), p.Version)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	p.DeletedAt, p.DeletedBy = "", ""
+	p.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	p.Version++
+	body, _ := json.Marshal(p)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"rbac"
+)
+
+// New partners start as DRAFT and go live only once an admin approves them:
+// DRAFT → PENDING_APPROVAL → ACTIVE → INACTIVE, moved along
+// partnerTransitions by POST /partners/{partnerId}/status. Only ACTIVE
+// partners are listed to agents and accept new referrals, and a partner
+// cannot be submitted or approved until its compensation is complete.
+
+// Partner statuses.
+const (
+	partnerDraft           = "DRAFT"
+	partnerPendingApproval = "PENDING_APPROVAL"
+	partnerActive          = "ACTIVE"
+	partnerInactive        = "INACTIVE"
+)
+
+// partnerTransitions is the partner state machine: the statuses each status
+// can move to. A pending partner can be sent back to DRAFT, and an inactive
+// one goes through approval again to come back.
+var partnerTransitions = map[string][]string{
+	partnerDraft:           {partnerPendingApproval},
+	partnerPendingApproval: {partnerActive, partnerDraft},
+	partnerActive:          {partnerInactive},
+	partnerInactive:        {partnerPendingApproval},
+}
+
+// lifecycleStatus returns the stored status s as a lifecycle status. Before
+// the lifecycle, status was optional free text; partners with no status or
+// one outside it are DRAFT, so they can be edited and submitted for
+// approval like any draft.
+func lifecycleStatus(s string) string {
+	if _, ok := partnerTransitions[s]; !ok {
+		return partnerDraft
+	}
+	return s
+}
+
+func canMovePartner(from, to string) bool {
+	for _, s := range partnerTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkComplete returns why c is not yet a compensation structure a partner
+// can go live with: it must give the agent a share, and the shares together
+// must be a part of the commission, at most all of it. Partners typically
+// pay out 25-40% of revenue, so the shares need not add up to 1.
+func checkComplete(c *Compensation) []api.FieldError {
+	if c == nil {
+		return []api.FieldError{{Field: "compensation", Message: "is required"}}
+	}
+	var errs []api.FieldError
+	if c.AgentPercentage <= 0 {
+		errs = append(errs, api.FieldError{Field: "compensation.agentPercentage", Message: "must be greater than 0"})
+	}
+	if total := c.total(); total <= 0 || total > 1 {
+		errs = append(errs, api.FieldError{Field: "compensation", Message: "percentages must add up to more than 0 and at most 1"})
+	}
+	return errs
+}
+
+// keepLifecycle carries the stored status and approval over to p, which
+// replaces existing, as only POST /partners/{partnerId}/status changes them.
+// A new partner starts as DRAFT.
+func keepLifecycle(existing *Partner, p *Partner) []api.FieldError {
+	status := partnerDraft
+	if existing != nil {
+		status = existing.Status
+		p.ApprovedAt, p.ApprovedBy = existing.ApprovedAt, existing.ApprovedBy
+	}
+	if p.Status == "" {
+		p.Status = status
+	}
+	if p.Status != status {
+		if existing == nil {
+			return []api.FieldError{{Field: "status", Message: "must be DRAFT for a new partner"}}
+		}
+		return []api.FieldError{{Field: "status", Message: "is changed with POST /partners/{partnerId}/status"}}
+	}
+	return nil
+}
+
+// partnerStatusUpdate is the body of POST /partners/{partnerId}/status.
+type partnerStatusUpdate struct {
+	Status string `json:"status" validate:"required,oneof=DRAFT PENDING_APPROVAL ACTIVE INACTIVE"`
+}
+
+// handlePartnerStatus moves a partner along partnerTransitions. Approval
+// needs the partners:approve action on top of the route's, so opening
+// drafting to more roles never opens approval with it.
+func handlePartnerStatus(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var in partnerStatusUpdate
+	if err := json.Unmarshal([]byte(req.Body), &in); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if errs := api.ValidateStruct(in); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	if in.Status == partnerActive && !rbac.Allowed(api.Identity(req), "partners:approve", "") {
+		return api.ClientError(ctx, http.StatusForbidden, "not allowed to partners:approve")
+	}
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || p.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	if !api.IfMatch(req, p.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	if !canMovePartner(p.Status, in.Status) {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("partner cannot move from %s to %s", p.Status, in.Status))
+	}
+	if in.Status == partnerPendingApproval || in.Status == partnerActive {
+		if errs := checkComplete(p.Compensation); len(errs) > 0 {
+			return api.ValidationError(ctx, errs)
+		}
+	}
+
+	before := *p
+	p.Status = in.Status
+	p.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	p.Version++
+	cond, names, values := api.VersionCondition(before.Version)
+	names["#status"] = "status"
+	names["#updatedAt"] = "updatedAt"
+	values[":status"] = &types.AttributeValueMemberS{Value: p.Status}
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: p.UpdatedAt}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(p.Version)}
+	update := "SET #status = :status, #updatedAt = :updatedAt, #version = :nextVersion"
+	if p.Status == partnerActive {
+		p.ApprovedAt, p.ApprovedBy = p.UpdatedAt, api.Actor(req)
+		names["#approvedAt"] = "approvedAt"
+		names["#approvedBy"] = "approvedBy"
+		values[":approvedAt"] = &types.AttributeValueMemberS{Value: p.ApprovedAt}
+		values[":approvedBy"] = &types.AttributeValueMemberS{Value: p.ApprovedBy}
+		update += ", #approvedAt = :approvedAt, #approvedBy = :approvedBy"
+	}
+	event, err := api.NewAuditEvent(api.AuditPartnerStatus, p.ID, api.Actor(req), partnerStatusOf(before), partnerStatusOf(*p))
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	err = api.WriteAudited(ctx, types.TransactWriteItem{Update: &types.Update{
+		TableName:                 aws.String(partnersTable),
+		Key:                       partnerKey(p.ID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(p)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
+}
+
+// partnerStatusOf is what the audit log records for a status change.
+func partnerStatusOf(p Partner) interface{} {
+	return struct {
+		Status     string `json:"status"`
+		ApprovedAt string `json:"approvedAt,omitempty"`
+		ApprovedBy string `json:"approvedBy,omitempty"`
+	}{p.Status, p.ApprovedAt, p.ApprovedBy}
+}
+
+// canReview reports whether the caller sees partners that are not ACTIVE.
+func canReview(req events.APIGatewayProxyRequest) bool {
+	return rbac.Allowed(api.Identity(req), "partners:review", "")
+}
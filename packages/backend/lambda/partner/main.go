@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -16,20 +17,29 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+
+	"api"
 )
 
 var (
-	ddb           *dynamodb.Client
-	partnersTable string
+	ddb            *dynamodb.Client
+	partnersTable  string
+	referralsTable string
+	webhooksTable  string
 )
 
+// Compensation percentages are stored as decimals, e.g. 0.15 for 15%.
 type Compensation struct {
-	AgentPercentage      float64 `json:"agentPercentage,omitempty"`
-	SmdPercentage        float64 `json:"smdPercentage,omitempty"`
-	EvcPercentage        float64 `json:"evcPercentage,omitempty"`
-	BonusPoolPercentage  float64 `json:"bonusPoolPercentage,omitempty"`
-	MrnPercentage        float64 `json:"mrnPercentage,omitempty"`
-	ContractorPercentage float64 `json:"contractorPercentage,omitempty"`
+	AgentPercentage      float64 `json:"agentPercentage,omitempty" validate:"min=0,max=1"`
+	SmdPercentage        float64 `json:"smdPercentage,omitempty" validate:"min=0,max=1"`
+	EvcPercentage        float64 `json:"evcPercentage,omitempty" validate:"min=0,max=1"`
+	BonusPoolPercentage  float64 `json:"bonusPoolPercentage,omitempty" validate:"min=0,max=1"`
+	MrnPercentage        float64 `json:"mrnPercentage,omitempty" validate:"min=0,max=1"`
+	ContractorPercentage float64 `json:"contractorPercentage,omitempty" validate:"min=0,max=1"`
+}
+
+func (c Compensation) total() float64 {
+	return c.AgentPercentage + c.SmdPercentage + c.EvcPercentage + c.BonusPoolPercentage + c.MrnPercentage + c.ContractorPercentage
 }
 
 type CommissionInfo struct {
@@ -39,17 +49,36 @@ type CommissionInfo struct {
 
 type Partner struct {
 	ID             string          `json:"id"`
-	Name           string          `json:"name"`
-	Email          string          `json:"email"`
-	Website        string          `json:"website,omitempty"`
+	Name           string          `json:"name" validate:"required"`
+	Email          string          `json:"email" validate:"required,email"`
+	Website        string          `json:"website,omitempty" validate:"required,url"`
 	Description    string          `json:"description,omitempty"`
-	Status         string          `json:"status,omitempty"`
+	Status         string          `json:"status,omitempty" validate:"required,oneof=DRAFT PENDING_APPROVAL ACTIVE INACTIVE"`
 	Compensation   *Compensation   `json:"compensation,omitempty"`
 	CommissionInfo *CommissionInfo `json:"commissionInfo,omitempty"`
-	TrainingLinks  []string        `json:"trainingLinks,omitempty"`
+	TrainingLinks  []string        `json:"trainingLinks,omitempty" validate:"url"`
 	Tags           []string        `json:"tags,omitempty"`
+	WebhookURL     string          `json:"webhookUrl,omitempty" validate:"https"`
+	Version        int             `json:"version"`
 	CreatedAt      string          `json:"createdAt,omitempty"`
 	UpdatedAt      string          `json:"updatedAt,omitempty"`
+	DeletedAt      string          `json:"deletedAt,omitempty"`
+	DeletedBy      string          `json:"deletedBy,omitempty"`
+	ApprovedAt     string          `json:"approvedAt,omitempty"`
+	ApprovedBy     string          `json:"approvedBy,omitempty"`
+}
+
+// validate applies the field rules declared on Partner and checks that the
+// compensation split does not exceed the whole commission, and that an
+// ACTIVE partner's compensation stays complete.
+func (p Partner) validate() []api.FieldError {
+	errs := api.ValidateStruct(p)
+	if p.Compensation != nil && p.Compensation.total() > 1 {
+		errs = append(errs, api.FieldError{Field: "compensation", Message: "percentages must not add up to more than 1"})
+	} else if p.Status == partnerActive {
+		errs = append(errs, checkComplete(p.Compensation)...)
+	}
+	return errs
 }
 
 func init() {
@@ -58,7 +87,13 @@ func init() {
 		panic(err)
 	}
 	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: getenv("AUDIT_TABLE"), Idempotency: getenv("IDEMPOTENCY_TABLE"), Outbox: getenv("OUTBOX_TABLE")})
+	if err := api.CheckTags(Partner{}, partnerStatusUpdate{}); err != nil {
+		panic(err)
+	}
 	partnersTable = getenv("PARTNERS_TABLE")
+	referralsTable = getenv("REFERRALS_TABLE")
+	webhooksTable = getenv("WEBHOOKS_TABLE")
 }
 
 func getenv(key string) string {
@@ -72,28 +107,98 @@ func getenv(key string) string {
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	switch {
 	case req.Resource == "/partners" && req.HTTPMethod == http.MethodGet:
-		return handleListPartners(ctx)
+		return handleListPartners(ctx, req)
 	case req.Resource == "/partners" && req.HTTPMethod == http.MethodPost:
-		return handleCreatePartner(ctx, req)
+		return api.WithIdempotency(ctx, req, "createPartner", handleCreatePartner)
 	case req.Resource == "/partners/{partnerId}" && req.HTTPMethod == http.MethodGet:
 		return handleGetPartner(ctx, req)
 	case req.Resource == "/partners/{partnerId}" && req.HTTPMethod == http.MethodPut:
 		return handlePutPartner(ctx, req)
+	case req.Resource == "/partners/{partnerId}" && req.HTTPMethod == http.MethodPatch:
+		return handlePatchPartner(ctx, req)
+	case req.Resource == "/partners/{partnerId}" && req.HTTPMethod == http.MethodDelete:
+		return handleDeletePartner(ctx, req)
+	case req.Resource == "/partners/{partnerId}/restore" && req.HTTPMethod == http.MethodPost:
+		return handleRestorePartner(ctx, req)
+	case req.Resource == "/partners/{partnerId}/status" && req.HTTPMethod == http.MethodPost:
+		return handlePartnerStatus(ctx, req)
+	case req.Resource == "/partners/{partnerId}/webhook-secret" && req.HTTPMethod == http.MethodPost:
+		return handleRotateWebhookSecret(ctx, req)
+	case req.Resource == "/partners/{partnerId}/webhook-deliveries" && req.HTTPMethod == http.MethodGet:
+		return handleListWebhookDeliveries(ctx, req)
+	case req.Resource == "/partners/{partnerId}/webhook-deliveries/{deliveryId}/replay" && req.HTTPMethod == http.MethodPost:
+		return handleReplayWebhookDelivery(ctx, req)
+	case req.Resource == "/webhook-dead-letters" && req.HTTPMethod == http.MethodGet:
+		return handleListDeadLetters(ctx, req)
+	case req.Resource == "/partners/{partnerId}/credentials" && req.HTTPMethod == http.MethodGet:
+		return handleListCredentials(ctx, req)
+	case req.Resource == "/partners/{partnerId}/credentials" && req.HTTPMethod == http.MethodPost:
+		return handleCreateCredential(ctx, req)
+	case req.Resource == "/partners/{partnerId}/credentials/{credentialId}/rotate" && req.HTTPMethod == http.MethodPost:
+		return handleRotateCredential(ctx, req)
+	case req.Resource == "/partners/{partnerId}/credentials/{credentialId}" && req.HTTPMethod == http.MethodDelete:
+		return handleRevokeCredential(ctx, req)
+	case req.Resource == "/partner-api/partner" && req.HTTPMethod == http.MethodGet:
+		return handlePartnerGetProfile(ctx, req)
+	case req.Resource == "/partner-api/referrals" && req.HTTPMethod == http.MethodGet:
+		return handlePartnerListReferrals(ctx, req)
+	case req.Resource == "/partner-api/referrals/{referralId}/status" && req.HTTPMethod == http.MethodPost:
+		return handlePartnerReferralStatus(ctx, req)
 	default:
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return api.NotFound(ctx, "route not found")
 	}
 }
 
-func handleListPartners(ctx context.Context) (events.APIGatewayProxyResponse, error) {
-	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(partnersTable),
-	})
-	if err != nil {
-		return serverError(err)
+// handleListPartners lists ACTIVE partners, or for admins partners in any
+// status, narrowed by the optional status query parameter.
+func handleListPartners(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// The table also holds the partners' credentials.
+	filter := "begins_with(SK, :profile)"
+	if !api.IncludeDeleted(req) {
+		filter += " AND attribute_not_exists(deletedAt)"
 	}
-	var partners []Partner
-	if err := attributevalue.UnmarshalListOfMaps(out.Items, &partners); err != nil {
-		return serverError(err)
+	values := map[string]types.AttributeValue{
+		":profile": &types.AttributeValueMemberS{Value: "PROFILE#"},
+	}
+	var names map[string]string
+	status := req.QueryStringParameters["status"]
+	if !canReview(req) {
+		status = partnerActive
+	}
+	switch {
+	case status == partnerDraft:
+		// Partners stored with a status from before the lifecycle are drafts.
+		filter += " AND (attribute_not_exists(#status) OR NOT #status IN (:pending, :active, :inactive))"
+		names = map[string]string{"#status": "status"}
+		values[":pending"] = &types.AttributeValueMemberS{Value: partnerPendingApproval}
+		values[":active"] = &types.AttributeValueMemberS{Value: partnerActive}
+		values[":inactive"] = &types.AttributeValueMemberS{Value: partnerInactive}
+	case status != "":
+		filter += " AND #status = :status"
+		names = map[string]string{"#status": "status"}
+		values[":status"] = &types.AttributeValueMemberS{Value: status}
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(partnersTable),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	partners := []Partner{}
+	p := dynamodb.NewScanPaginator(ddb, input)
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		var page []Partner
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return api.ServerError(ctx, err)
+		}
+		for i := range page {
+			page[i].Status = lifecycleStatus(page[i].Status)
+		}
+		partners = append(partners, page...)
 	}
 	body, _ := json.Marshal(partners)
 	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
@@ -102,7 +207,10 @@ func handleListPartners(ctx context.Context) (events.APIGatewayProxyResponse, er
 func handleCreatePartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var p Partner
 	if err := json.Unmarshal([]byte(req.Body), &p); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	if errs := append(keepLifecycle(nil, &p), p.validate()...); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 	if p.ID == "" {
 		p.ID = uuid.NewString()
@@ -110,8 +218,24 @@ func handleCreatePartner(ctx context.Context, req events.APIGatewayProxyRequest)
 	now := time.Now().UTC().Format(time.RFC3339)
 	p.CreatedAt = now
 	p.UpdatedAt = now
+	p.Version = 1
 
-	item, err := attributevalue.MarshalMap(struct {
+	err := putPartner(ctx, req, nil, p, "attribute_not_exists(PK)", nil, nil)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("partner %s already exists", p.ID))
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(p)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
+}
+
+// putPartner writes p if cond holds for the stored item, auditing any change
+// to its compensation from existing.
+func putPartner(ctx context.Context, req events.APIGatewayProxyRequest, existing *Partner, p Partner, cond string, names map[string]string, values map[string]types.AttributeValue) error {
+	item, err := api.MarshalItem(struct {
 		PK string `dynamodbav:"PK"`
 		SK string `dynamodbav:"SK"`
 		Partner
@@ -121,76 +245,176 @@ func handleCreatePartner(ctx context.Context, req events.APIGatewayProxyRequest)
 		Partner: p,
 	})
 	if err != nil {
-		return serverError(err)
+		return err
 	}
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(partnersTable), Item: item}); err != nil {
-		return serverError(err)
+	event, err := compensationEvent(req, existing, p)
+	if err != nil {
+		return err
 	}
-	body, _ := json.Marshal(p)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WriteAudited(ctx, types.TransactWriteItem{Put: &types.Put{
+		TableName:                 aws.String(partnersTable),
+		Item:                      item,
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}, event)
 }
 
-func handleGetPartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	id := req.PathParameters["partnerId"]
-	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(partnersTable),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", id)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
-		},
-	})
+// compensationEvent returns the audit event for a change to the partner's
+// compensation, or nil if it is unchanged.
+func compensationEvent(req events.APIGatewayProxyRequest, existing *Partner, p Partner) (*api.AuditEvent, error) {
+	var before *Compensation
+	if existing != nil {
+		before = existing.Compensation
+	}
+	return api.NewAuditEvent(api.AuditPartnerCompensation, p.ID, api.Actor(req), before, p.Compensation)
+}
+
+// versionOf returns the version of p, or 0 if it does not exist.
+func versionOf(p *Partner) int {
+	if p == nil {
+		return 0
+	}
+	return p.Version
+}
+
+func partnerKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", id)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
+	}
+}
+
+// getPartner loads a partner by ID, returning nil if none exists.
+func getPartner(ctx context.Context, id string) (*Partner, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(partnersTable), Key: partnerKey(id)})
 	if err != nil {
-		return serverError(err)
+		return nil, err
 	}
 	if out.Item == nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return nil, nil
 	}
 	var p Partner
 	if err := attributevalue.UnmarshalMap(out.Item, &p); err != nil {
-		return serverError(err)
+		return nil, err
+	}
+	p.Status = lifecycleStatus(p.Status)
+	return &p, nil
+}
+
+func handleGetPartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || (p.DeletedAt != "" && !api.IncludeDeleted(req)) || (p.Status != partnerActive && !canReview(req)) {
+		return api.NotFound(ctx, "partner not found")
 	}
 	body, _ := json.Marshal(p)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
 }
 
+// handlePutPartner replaces a partner, creating it if it does not exist. The
+// write only succeeds if the stored version still matches If-Match, or the
+// version read here when the header is absent; otherwise it is a 412.
 func handlePutPartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	id := req.PathParameters["partnerId"]
 	var p Partner
 	if err := json.Unmarshal([]byte(req.Body), &p); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	existing, err := getPartner(ctx, id)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing != nil && existing.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	if errs := append(keepLifecycle(existing, &p), p.validate()...); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 	p.ID = id
 	p.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	if p.CreatedAt == "" {
-		p.CreatedAt = p.UpdatedAt
+	if !api.IfMatch(req, versionOf(existing), existing != nil) {
+		return api.PreconditionFailed(ctx)
 	}
-	item, err := attributevalue.MarshalMap(struct {
-		PK string `dynamodbav:"PK"`
-		SK string `dynamodbav:"SK"`
-		Partner
-	}{
-		PK:      fmt.Sprintf("PARTNER#%s", id),
-		SK:      fmt.Sprintf("PROFILE#%s", id),
-		Partner: p,
-	})
-	if err != nil {
-		return serverError(err)
+	cond, names, values := "attribute_not_exists(PK)", map[string]string(nil), map[string]types.AttributeValue(nil)
+	p.CreatedAt = p.UpdatedAt
+	if existing != nil {
+		cond, names, values = api.VersionCondition(existing.Version)
+		p.CreatedAt = existing.CreatedAt
 	}
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(partnersTable), Item: item}); err != nil {
-		return serverError(err)
+	p.Version = versionOf(existing) + 1
+	err = putPartner(ctx, req, existing, p, cond, names, values)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
 	}
 	body, _ := json.Marshal(p)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
 }
 
-func serverError(err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
-}
+// handlePatchPartner applies a JSON Merge Patch to a partner, writing only
+// the attributes the patch names.
+func handlePatchPartner(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	patch, err := api.ParsePatch(req.Body)
+	if err != nil {
+		return api.ClientError(ctx, http.StatusBadRequest, err.Error())
+	}
+	if errs := api.CheckPatchFields(patch, Partner{}, "status", "approvedAt", "approvedBy"); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	existing, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	var p Partner
+	if err := api.ApplyPatch(existing, patch, &p); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if errs := p.validate(); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	p.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	p.Version = existing.Version + 1
 
-func clientError(code int, msg string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: code, Body: msg}, nil
+	item, err := api.MarshalItem(p)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	update, cond, names, values := api.PatchUpdate(api.SortedKeys(patch), item, p.UpdatedAt, existing.Version)
+	event, err := compensationEvent(req, existing, p)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	err = api.WriteAudited(ctx, types.TransactWriteItem{Update: &types.Update{
+		TableName:                 aws.String(partnersTable),
+		Key:                       partnerKey(p.ID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(p)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(api.WithLogging(api.WithPolicy(handler)))
 }
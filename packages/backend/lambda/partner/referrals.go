@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"referralstatus"
+)
+
+// Partners list the referrals sent to them with GET /partner-api/referrals
+// and report what happened to them through POST
+// /partner-api/referrals/{referralId}/status, authenticated with their own
+// credential (see credentials.go). A partner can only see and move its own
+// referrals, and only along referralstatus.Transitions.
+
+// maxRejectionReason bounds the reason a partner gives for a rejection.
+const maxRejectionReason = 500
+
+// referral is a referral as stored, with the fields partners may set.
+type referral struct {
+	ID              string  `json:"id"`
+	UserID          string  `json:"userId"`
+	CompanyID       string  `json:"companyId"`
+	CustomerID      string  `json:"customerId,omitempty"`
+	LeadID          string  `json:"leadId,omitempty"`
+	ClientName      string  `json:"clientName"`
+	Status          string  `json:"status"`
+	Amount          float64 `json:"amount,omitempty"`
+	RejectionReason string  `json:"rejectionReason,omitempty"`
+	PaidAt          string  `json:"paidAt,omitempty"`
+	CreatedAt       string  `json:"createdAt"`
+	UpdatedAt       string  `json:"updatedAt"`
+}
+
+// statusUpdate is the body of a partner status update. Amount, the
+// commission in cents, is required for PAID; Reason is required for
+// REJECTED. Neither is accepted otherwise.
+type statusUpdate struct {
+	Status string   `json:"status"`
+	Amount *float64 `json:"amount,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+func (u statusUpdate) validate() []api.FieldError {
+	var errs []api.FieldError
+	switch u.Status {
+	case referralstatus.InReview, referralstatus.Paid, referralstatus.Rejected:
+	default:
+		return []api.FieldError{{Field: "status", Message: "must be one of IN_REVIEW, PAID, REJECTED"}}
+	}
+	switch {
+	case u.Status == referralstatus.Paid && u.Amount == nil:
+		errs = append(errs, api.FieldError{Field: "amount", Message: "is required"})
+	case u.Status == referralstatus.Paid && (*u.Amount <= 0 || *u.Amount != math.Trunc(*u.Amount)):
+		errs = append(errs, api.FieldError{Field: "amount", Message: "must be a positive whole number of cents"})
+	case u.Status != referralstatus.Paid && u.Amount != nil:
+		errs = append(errs, api.FieldError{Field: "amount", Message: "is only accepted with status PAID"})
+	}
+	reason := strings.TrimSpace(u.Reason)
+	switch {
+	case u.Status == referralstatus.Rejected && reason == "":
+		errs = append(errs, api.FieldError{Field: "reason", Message: "is required"})
+	case u.Status == referralstatus.Rejected && len(reason) > maxRejectionReason:
+		errs = append(errs, api.FieldError{Field: "reason", Message: fmt.Sprintf("must be at most %d characters", maxRejectionReason)})
+	case u.Status != referralstatus.Rejected && reason != "":
+		errs = append(errs, api.FieldError{Field: "reason", Message: "is only accepted with status REJECTED"})
+	}
+	return errs
+}
+
+func referralKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFERRAL#%s", id)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", id)},
+	}
+}
+
+// getReferral loads a referral by ID, returning nil if none exists.
+func getReferral(ctx context.Context, id string) (*referral, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(referralsTable), Key: referralKey(id)})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	var r referral
+	if err := attributevalue.UnmarshalMapWithOptions(out.Item, &r, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// handlePartnerReferralStatus moves one of the calling partner's referrals
+// to IN_REVIEW, PAID or REJECTED. Referrals of other partners are reported
+// as not found.
+func handlePartnerReferralStatus(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	partnerID := api.AuthorizedPartner(req)
+	if partnerID == "" {
+		return api.ClientError(ctx, http.StatusUnauthorized, "partner credential required")
+	}
+	var u statusUpdate
+	if err := json.Unmarshal([]byte(req.Body), &u); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	if errs := u.validate(); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	before, err := getReferral(ctx, req.PathParameters["referralId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if before == nil || before.CompanyID != partnerID {
+		return api.NotFound(ctx, "referral not found")
+	}
+	if !referralstatus.CanTransition(before.Status, u.Status) {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("referral cannot move from %s to %s", before.Status, u.Status))
+	}
+
+	after := *before
+	after.Status = u.Status
+	after.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	update := "SET #status = :status, updatedAt = :updatedAt"
+	values := map[string]types.AttributeValue{
+		":status":    &types.AttributeValueMemberS{Value: after.Status},
+		":updatedAt": &types.AttributeValueMemberS{Value: after.UpdatedAt},
+		":prev":      &types.AttributeValueMemberS{Value: before.Status},
+		":partnerId": &types.AttributeValueMemberS{Value: partnerID},
+	}
+	switch u.Status {
+	case referralstatus.Paid:
+		after.Amount = *u.Amount
+		after.PaidAt = after.UpdatedAt
+		update += ", amount = :amount, paidAt = :paidAt"
+		values[":amount"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%.0f", after.Amount)}
+		values[":paidAt"] = &types.AttributeValueMemberS{Value: after.PaidAt}
+	case referralstatus.Rejected:
+		after.RejectionReason = strings.TrimSpace(u.Reason)
+		update += ", rejectionReason = :reason"
+		values[":reason"] = &types.AttributeValueMemberS{Value: after.RejectionReason}
+	}
+	event, err := api.NewAuditEvent(api.AuditReferral, after.ID, api.Actor(req), before, after)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	err = api.WriteAudited(ctx, types.TransactWriteItem{Update: &types.Update{
+		TableName:        aws.String(referralsTable),
+		Key:              referralKey(after.ID),
+		UpdateExpression: aws.String(update),
+		// The audited before state must still be the stored one.
+		ConditionExpression:       aws.String("#status = :prev AND companyId = :partnerId"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	}}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.ClientError(ctx, http.StatusConflict, "referral changed while its status was updated; read it again and retry")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(after)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// handlePartnerListReferrals lists the calling partner's referrals.
+func handlePartnerListReferrals(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	partnerID := api.AuthorizedPartner(req)
+	if partnerID == "" {
+		return api.ClientError(ctx, http.StatusUnauthorized, "partner credential required")
+	}
+	referrals := []referral{}
+	p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+		TableName:              aws.String(referralsTable),
+		IndexName:              aws.String(companyIndex),
+		KeyConditionExpression: aws.String("companyId = :pid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pid": &types.AttributeValueMemberS{Value: partnerID},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		var page []referral
+		if err := attributevalue.UnmarshalListOfMapsWithOptions(out.Items, &page, func(o *attributevalue.DecoderOptions) {
+			o.TagKey = "json"
+		}); err != nil {
+			return api.ServerError(ctx, err)
+		}
+		referrals = append(referrals, page...)
+	}
+	body, _ := json.Marshal(referrals)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// handlePartnerGetProfile returns the calling partner's own record.
+func handlePartnerGetProfile(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	partnerID := api.AuthorizedPartner(req)
+	if partnerID == "" {
+		return api.ClientError(ctx, http.StatusUnauthorized, "partner credential required")
+	}
+	p, err := getPartner(ctx, partnerID)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || p.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	body, _ := json.Marshal(p)
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, p.Version), nil
+}
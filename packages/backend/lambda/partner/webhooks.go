@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// The webhook function POSTs each new referral to its partner's webhookUrl,
+// signed with the partner's secret, and logs every delivery in the webhooks
+// table: PK PARTNER#<partnerId>, SK SECRET for the secret and SK
+// DELIVERY#<deliveryId> per delivery. Deliveries that exhaust their retries
+// are dead-lettered. The routes here, all admin-only, issue secrets, read the
+// delivery log and replay dead letters.
+
+const (
+	defaultDeliveryLimit = 20
+	maxDeliveryLimit     = 100
+)
+
+// Delivery statuses, as the webhook function writes them.
+const (
+	deliveryDeadLetter      = "DEAD_LETTER"
+	deliveryReplayRequested = "REPLAY_REQUESTED"
+)
+
+var deliveryStatuses = map[string]bool{"PENDING": true, "DELIVERED": true, deliveryDeadLetter: true, deliveryReplayRequested: true}
+
+// webhookSecret is returned once, when it is issued.
+type webhookSecret struct {
+	PartnerID string `json:"partnerId"`
+	Secret    string `json:"secret"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type deliveryAttempt struct {
+	At         string `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// webhookDelivery is one entry in a partner's delivery log. Payload is the
+// exact body that was signed, kept as a string so it is returned unchanged.
+type webhookDelivery struct {
+	ID        string            `json:"id"`
+	PartnerID string            `json:"partnerId"`
+	EventType string            `json:"eventType"`
+	URL       string            `json:"url"`
+	Payload   string            `json:"payload"`
+	Status    string            `json:"status"`
+	Attempts  []deliveryAttempt `json:"attempts"`
+	LastError string            `json:"lastError,omitempty"`
+	Replays   int               `json:"replays,omitempty"`
+	CreatedAt string            `json:"createdAt"`
+	UpdatedAt string            `json:"updatedAt,omitempty"`
+}
+
+// deliveryPage is one page of deliveries. NextToken is set when there are
+// more.
+type deliveryPage struct {
+	Deliveries []webhookDelivery `json:"deliveries"`
+	NextToken  string            `json:"nextToken,omitempty"`
+}
+
+// replayRequest is the payload of a webhook.replayRequested message.
+type replayRequest struct {
+	PartnerID  string `json:"partnerId"`
+	DeliveryID string `json:"deliveryId"`
+}
+
+func deliveryKey(partnerID, deliveryID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "PARTNER#" + partnerID},
+		"SK": &types.AttributeValueMemberS{Value: "DELIVERY#" + deliveryID},
+	}
+}
+
+// handleRotateWebhookSecret issues a new signing secret for the partner,
+// replacing any previous one at once. The secret is only ever shown in this
+// response.
+func handleRotateWebhookSecret(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	p, err := getPartner(ctx, req.PathParameters["partnerId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if p == nil || p.DeletedAt != "" {
+		return api.NotFound(ctx, "partner not found")
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	s := webhookSecret{
+		PartnerID: p.ID,
+		Secret:    "whsec_" + base64.RawURLEncoding.EncodeToString(raw),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	item, err := api.MarshalItem(struct {
+		PK string `dynamodbav:"PK"`
+		SK string `dynamodbav:"SK"`
+		webhookSecret
+		RotatedBy string `json:"rotatedBy"`
+	}{
+		PK:            "PARTNER#" + p.ID,
+		SK:            "SECRET",
+		webhookSecret: s,
+		RotatedBy:     api.Actor(req),
+	})
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(webhooksTable), Item: item}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(s)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"}}, nil
+}
+
+// handleListWebhookDeliveries returns a partner's delivery log, newest
+// first, optionally only deliveries in one status.
+func handleListWebhookDeliveries(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(webhooksTable),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: "PARTNER#" + req.PathParameters["partnerId"]},
+			":prefix": &types.AttributeValueMemberS{Value: "DELIVERY#"},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if status := req.QueryStringParameters["status"]; status != "" {
+		if !deliveryStatuses[status] {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "status", Message: "must be one of PENDING, DELIVERED, DEAD_LETTER, REPLAY_REQUESTED"}})
+		}
+		input.FilterExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames = map[string]string{"#status": "status"}
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+	}
+	return queryDeliveries(ctx, req, input)
+}
+
+// handleListDeadLetters returns dead-lettered deliveries across all
+// partners, newest first.
+func handleListDeadLetters(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return queryDeliveries(ctx, req, &dynamodb.QueryInput{
+		TableName:              aws.String(webhooksTable),
+		IndexName:              aws.String("DeadLetterIndex"),
+		KeyConditionExpression: aws.String("deadLetter = :deadLetter"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deadLetter": &types.AttributeValueMemberS{Value: deliveryDeadLetter},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+}
+
+// queryDeliveries runs input with the limit and nextToken of req and
+// returns one page of deliveries.
+func queryDeliveries(ctx context.Context, req events.APIGatewayProxyRequest, input *dynamodb.QueryInput) (events.APIGatewayProxyResponse, error) {
+	limit := defaultDeliveryLimit
+	if v := req.QueryStringParameters["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "limit", Message: fmt.Sprintf("must be an integer from 1 to %d", maxDeliveryLimit)}})
+		}
+		limit = n
+	}
+	input.Limit = aws.Int32(int32(limit))
+	if v := req.QueryStringParameters["nextToken"]; v != "" {
+		start, err := decodePageToken(v)
+		if err != nil {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "nextToken", Message: "is not a token from a previous page"}})
+		}
+		input.ExclusiveStartKey = start
+	}
+	out, err := ddb.Query(ctx, input)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	page := deliveryPage{Deliveries: []webhookDelivery{}}
+	if err := attributevalue.UnmarshalListOfMapsWithOptions(out.Items, &page.Deliveries, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(out.LastEvaluatedKey) > 0 {
+		if page.NextToken, err = encodePageToken(out.LastEvaluatedKey); err != nil {
+			return api.ServerError(ctx, err)
+		}
+	}
+	body, _ := json.Marshal(page)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// handleReplayWebhookDelivery queues a dead-lettered delivery to be sent
+// again. The delivery leaves the dead-letter store and the replay request
+// is written to the outbox in one transaction; the webhook function picks it
+// up and sends the original payload to the partner's current URL.
+func handleReplayWebhookDelivery(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	partnerID, deliveryID := req.PathParameters["partnerId"], req.PathParameters["deliveryId"]
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(webhooksTable),
+		Key:            deliveryKey(partnerID, deliveryID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if out.Item == nil {
+		return api.NotFound(ctx, "delivery not found")
+	}
+	var d webhookDelivery
+	if err := attributevalue.UnmarshalMapWithOptions(out.Item, &d, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if d.Status != deliveryDeadLetter {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("delivery is %s, only dead letters can be replayed", d.Status))
+	}
+	// The replay count is part of the message key, so each replay of the
+	// same delivery is a distinct message.
+	msg := api.NewOutboxMessage(api.TopicWebhookReplayRequested, replayRequest{PartnerID: partnerID, DeliveryID: deliveryID}, partnerID, deliveryID, strconv.Itoa(d.Replays+1))
+	err = api.WriteWithOutbox(ctx, []types.TransactWriteItem{{Update: &types.Update{
+		TableName:           aws.String(webhooksTable),
+		Key:                 deliveryKey(partnerID, deliveryID),
+		UpdateExpression:    aws.String("SET #status = :requested, replays = :replays, updatedAt = :now REMOVE deadLetter, lastError"),
+		ConditionExpression: aws.String("#status = :deadLetter AND (attribute_not_exists(replays) OR replays = :previous)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":requested":  &types.AttributeValueMemberS{Value: deliveryReplayRequested},
+			":deadLetter": &types.AttributeValueMemberS{Value: deliveryDeadLetter},
+			":replays":    &types.AttributeValueMemberN{Value: strconv.Itoa(d.Replays + 1)},
+			":previous":   &types.AttributeValueMemberN{Value: strconv.Itoa(d.Replays)},
+			":now":        &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	}}}, []api.OutboxMessage{msg})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.ClientError(ctx, http.StatusConflict, "delivery is already being replayed")
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	d.Status = deliveryReplayRequested
+	d.Replays++
+	d.LastError = ""
+	body, _ := json.Marshal(d)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusAccepted, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// encodePageToken turns a LastEvaluatedKey, whose attributes are all
+// strings in this table and its index, into an opaque page token.
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	var m map[string]string
+	if err := attributevalue.UnmarshalMap(key, &m); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return attributevalue.MarshalMap(m)
+}
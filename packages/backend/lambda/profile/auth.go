@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"api"
+)
+
+// This function's routes use API Gateway's Cognito authorizer, which verifies
+// the ID token and attaches its claims to the request for api.WithPolicy. Where no
+// authorizer ran (sam local, tests against a local JWKS) withCaller verifies
+// the token in the Authorization header itself, against the key set at
+// COGNITO_JWKS_URL (an https:// URL or a file path), the issuer in
+// COGNITO_ISSUER and the app client in COGNITO_CLIENT_ID, and attaches the
+// claims the same way. Unless all three are set, only gateway claims are
+// trusted.
+
+// jwksRefreshInterval bounds how often an unknown key ID triggers a reload of
+// the key set, so forged kids cannot make us hammer the endpoint.
+const jwksRefreshInterval = 5 * time.Minute
+
+// jwtLeeway absorbs clock skew when checking exp.
+const jwtLeeway = time.Minute
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// tokenClaims are the Cognito ID and access token claims we rely on.
+type tokenClaims struct {
+	Sub      string   `json:"sub"`
+	Issuer   string   `json:"iss"`
+	Audience string   `json:"aud"`
+	ClientID string   `json:"client_id"`
+	TokenUse string   `json:"token_use"`
+	Expiry   int64    `json:"exp"`
+	Groups   []string `json:"cognito:groups"`
+	Email    string   `json:"email"`
+}
+
+// jwks is the cached Cognito key set.
+var jwks struct {
+	sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	loadedAt time.Time
+}
+
+// withCaller attaches verified Cognito claims to requests that did not pass
+// through the gateway's authorizer. Requests without a token go through
+// unchanged; a token that fails verification is a 401.
+func withCaller(next api.Handler) api.Handler {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if _, ok := req.RequestContext.Authorizer["claims"]; ok || os.Getenv("COGNITO_JWKS_URL") == "" || os.Getenv("COGNITO_ISSUER") == "" || os.Getenv("COGNITO_CLIENT_ID") == "" {
+			return next(ctx, req)
+		}
+		claims, err := verifyToken(ctx, bearerToken(req))
+		if errors.Is(err, errNoToken) {
+			return next(ctx, req)
+		}
+		if err != nil && !errors.Is(err, errInvalidToken) {
+			return api.ServerError(ctx, err)
+		}
+		if err != nil {
+			api.LoggerFrom(ctx).WarnContext(ctx, "token rejected", slog.String("error", err.Error()))
+			return api.ClientError(ctx, http.StatusUnauthorized, "invalid or expired token")
+		}
+		// Same shape as the gateway's claims, groups flattened to a string.
+		req.RequestContext.Authorizer = map[string]interface{}{
+			"claims": map[string]interface{}{
+				"sub":            claims.Sub,
+				"email":          claims.Email,
+				"cognito:groups": strings.Join(claims.Groups, ","),
+			},
+		}
+		return next(ctx, req)
+	}
+}
+
+func bearerToken(req events.APIGatewayProxyRequest) string {
+	h := api.Header(req, "Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		h = h[7:]
+	}
+	return strings.TrimSpace(h)
+}
+
+// verifyToken checks an RS256 Cognito JWT's signature against the key set
+// and its issuer, use, app client and expiry. ID tokens name the app client
+// in aud, access tokens in client_id.
+func verifyToken(ctx context.Context, token string) (*tokenClaims, error) {
+	if token == "" {
+		return nil, errNoToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	var head struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &head); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errInvalidToken, err)
+	}
+	if head.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: alg %q", errInvalidToken, head.Alg)
+	}
+	key, err := signingKey(ctx, head.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+	var c tokenClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	switch {
+	case c.Issuer != os.Getenv("COGNITO_ISSUER"):
+		return nil, fmt.Errorf("%w: issuer %q", errInvalidToken, c.Issuer)
+	case c.TokenUse != "id" && c.TokenUse != "access":
+		return nil, fmt.Errorf("%w: token_use %q", errInvalidToken, c.TokenUse)
+	case c.TokenUse == "id" && c.Audience != os.Getenv("COGNITO_CLIENT_ID"):
+		return nil, fmt.Errorf("%w: aud %q", errInvalidToken, c.Audience)
+	case c.TokenUse == "access" && c.ClientID != os.Getenv("COGNITO_CLIENT_ID"):
+		return nil, fmt.Errorf("%w: client_id %q", errInvalidToken, c.ClientID)
+	case time.Unix(c.Expiry, 0).Add(jwtLeeway).Before(time.Now()):
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	case c.Sub == "":
+		return nil, fmt.Errorf("%w: no sub", errInvalidToken)
+	}
+	return &c, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// signingKey returns the key with the given ID, reloading the key set when
+// the ID is unknown and the set is older than jwksRefreshInterval.
+func signingKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	jwks.Lock()
+	defer jwks.Unlock()
+	if key, ok := jwks.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(jwks.loadedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown kid %q", errInvalidToken, kid)
+	}
+	keys, err := loadJWKS(ctx, os.Getenv("COGNITO_JWKS_URL"))
+	if err != nil {
+		return nil, err
+	}
+	jwks.keys, jwks.loadedAt = keys, time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kid %q", errInvalidToken, kid)
+}
+
+// loadJWKS reads the RSA keys of a JSON Web Key Set from an https:// URL or
+// a local file. Plain http is refused: whoever could alter the response
+// could sign tokens.
+func loadJWKS(ctx context.Context, location string) (map[string]*rsa.PublicKey, error) {
+	var raw []byte
+	if strings.Contains(location, "://") && !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "file://") {
+		return nil, fmt.Errorf("jwks location %q: only https:// URLs and files are allowed", location)
+	}
+	if strings.HasPrefix(location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetch jwks: %s", resp.Status)
+		}
+		if raw, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("fetch jwks: %w", err)
+		}
+	} else {
+		var err error
+		if raw, err = os.ReadFile(strings.TrimPrefix(location, "file://")); err != nil {
+			return nil, fmt.Errorf("read jwks: %w", err)
+		}
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testIssuer   = "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_test"
+	testClientID = "client-1"
+	testKid      = "key-1"
+)
+
+// testKey signs the tokens the JWKS file trusts; otherKey signs forgeries.
+var testKey, otherKey = mustKey(), mustKey()
+
+func mustKey() *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// useTestJWKS writes testKey's public half to a JWKS file and points
+// verification at it.
+func useTestJWKS(t *testing.T) {
+	set, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": testKid,
+		"n":   base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, set, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COGNITO_JWKS_URL", path)
+	t.Setenv("COGNITO_ISSUER", testIssuer)
+	t.Setenv("COGNITO_CLIENT_ID", testClientID)
+	jwks.Lock()
+	jwks.keys, jwks.loadedAt = nil, time.Time{}
+	jwks.Unlock()
+}
+
+// idClaims are the claims of a valid ID token.
+func idClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":            "u1",
+		"iss":            testIssuer,
+		"aud":            testClientID,
+		"token_use":      "id",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          "u1@example.com",
+		"cognito:groups": []string{"admins"},
+	}
+}
+
+func sign(key *rsa.PrivateKey, kid, alg string, claims map[string]interface{}) string {
+	head, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyToken(t *testing.T) {
+	with := func(change func(map[string]interface{})) string {
+		c := idClaims()
+		change(c)
+		return sign(testKey, testKid, "RS256", c)
+	}
+	cases := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"id token", with(func(map[string]interface{}) {}), ""},
+		{"access token", with(func(c map[string]interface{}) {
+			delete(c, "aud")
+			c["token_use"], c["client_id"] = "access", testClientID
+		}), ""},
+		{"within leeway", with(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }), ""},
+		{"expired", with(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }), "expired"},
+		{"wrong issuer", with(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }), "issuer"},
+		{"wrong token_use", with(func(c map[string]interface{}) { c["token_use"] = "refresh" }), "token_use"},
+		{"wrong audience", with(func(c map[string]interface{}) { c["aud"] = "client-2" }), "aud"},
+		{"access token for another client", with(func(c map[string]interface{}) {
+			c["token_use"], c["client_id"] = "access", "client-2"
+		}), "client_id"},
+		{"no sub", with(func(c map[string]interface{}) { delete(c, "sub") }), "no sub"},
+		{"bad signature", sign(otherKey, testKid, "RS256", idClaims()), "bad signature"},
+		{"unknown key", sign(otherKey, "key-2", "RS256", idClaims()), "unknown kid"},
+		{"other algorithm", sign(testKey, testKid, "HS256", idClaims()), "alg"},
+		{"malformed", "not.a-token", "malformed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTestJWKS(t)
+			claims, err := verifyToken(context.Background(), c.token)
+			if c.want == "" {
+				if err != nil || claims.Sub != "u1" {
+					t.Fatalf("verifyToken() = %v, %v", claims, err)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("verifyToken() error = %v, want an invalid token error containing %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadJWKSRefusesPlainHTTP(t *testing.T) {
+	_, err := loadJWKS(context.Background(), "http://cognito.example.com/.well-known/jwks.json")
+	if err == nil || !strings.Contains(err.Error(), "only https://") {
+		t.Fatalf("loadJWKS() error = %v", err)
+	}
+}
+
+func TestWithCaller(t *testing.T) {
+	useTestJWKS(t)
+	var seen events.APIGatewayProxyRequest
+	h := withCaller(func(_ context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		seen = req
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	call := func(token string) int {
+		seen = events.APIGatewayProxyRequest{}
+		req := events.APIGatewayProxyRequest{}
+		if token != "" {
+			req.Headers = map[string]string{"Authorization": "Bearer " + token}
+		}
+		resp, err := h(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := call(sign(testKey, testKid, "RS256", idClaims())); code != http.StatusOK {
+		t.Fatalf("valid token: status %d", code)
+	}
+	claims, _ := seen.RequestContext.Authorizer["claims"].(map[string]interface{})
+	if claims["sub"] != "u1" || claims["email"] != "u1@example.com" || claims["cognito:groups"] != "admins" {
+		t.Errorf("claims = %v", claims)
+	}
+
+	if code := call(sign(otherKey, testKid, "RS256", idClaims())); code != http.StatusUnauthorized {
+		t.Errorf("forged token: status %d, want 401", code)
+	}
+
+	if code := call(""); code != http.StatusOK || seen.RequestContext.Authorizer != nil {
+		t.Errorf("no token: status %d, authorizer %v", code, seen.RequestContext.Authorizer)
+	}
+}
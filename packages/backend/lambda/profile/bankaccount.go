@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+	"fieldcrypt"
+)
+
+// A user's payout method is the bank account their payments are sent to. It
+// is set with PUT /users/{userId}/bank-account once the routing number
+// passes the ABA checksum and the account number looks like one, and kept on
+// the profile: the full numbers encrypted, their last four digits in clear.
+// Responses only ever show the last four.
+
+// Payout method types and statuses.
+const (
+	payoutBankAccount = "BANK_ACCOUNT"
+	payoutVerified    = "VERIFIED"
+)
+
+// PayoutMethod is where a user's payments are sent.
+type PayoutMethod struct {
+	Type          string            `json:"type"`
+	AccountHolder string            `json:"accountHolder,omitempty"`
+	AccountType   string            `json:"accountType"`
+	RoutingNumber fieldcrypt.Secret `json:"routingNumber,omitempty"`
+	AccountNumber fieldcrypt.Secret `json:"accountNumber,omitempty"`
+	RoutingLast4  string            `json:"routingLast4"`
+	AccountLast4  string            `json:"accountLast4"`
+	Status        string            `json:"status"`
+	VerifiedAt    string            `json:"verifiedAt"`
+}
+
+// public returns the payout method without its full numbers.
+func (m *PayoutMethod) public() *PayoutMethod {
+	if m == nil {
+		return nil
+	}
+	out := *m
+	out.RoutingNumber, out.AccountNumber = "", ""
+	return &out
+}
+
+// bankAccountRequest is the body of PUT /users/{userId}/bank-account.
+type bankAccountRequest struct {
+	AccountHolder string `json:"accountHolder,omitempty"`
+	RoutingNumber string `json:"routingNumber" validate:"required"`
+	AccountNumber string `json:"accountNumber" validate:"required"`
+	AccountType   string `json:"accountType" validate:"required,oneof=CHECKING SAVINGS"`
+}
+
+// US account numbers run from 4 to 17 digits.
+const (
+	minAccountDigits = 4
+	maxAccountDigits = 17
+)
+
+// validRoutingNumber reports whether s is a nine-digit ABA routing number
+// with a valid Federal Reserve prefix and checksum: 3, 7 and 1 times the
+// digits in turn must add up to a multiple of 10.
+func validRoutingNumber(s string) bool {
+	if len(s) != 9 || !allDigits(s) {
+		return false
+	}
+	// 00 is the US government, 01-12 and 21-32 Federal Reserve districts,
+	// 61-72 thrifts and 80 traveller's cheques.
+	prefix, _ := strconv.Atoi(s[:2])
+	if !(prefix <= 12 || (prefix >= 21 && prefix <= 32) || (prefix >= 61 && prefix <= 72) || prefix == 80) {
+		return false
+	}
+	sum := 0
+	for i, weight := range []int{3, 7, 1, 3, 7, 1, 3, 7, 1} {
+		sum += int(s[i]-'0') * weight
+	}
+	return sum%10 == 0
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// stripSeparators drops the spaces and hyphens people type in numbers.
+func stripSeparators(s string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(s)
+}
+
+func checkBankAccount(in bankAccountRequest) []api.FieldError {
+	var errs []api.FieldError
+	if in.RoutingNumber != "" && !validRoutingNumber(in.RoutingNumber) {
+		errs = append(errs, api.FieldError{Field: "routingNumber", Message: "is not a valid ABA routing number"})
+	}
+	if in.AccountNumber != "" && (!allDigits(in.AccountNumber) || len(in.AccountNumber) < minAccountDigits || len(in.AccountNumber) > maxAccountDigits) {
+		errs = append(errs, api.FieldError{Field: "accountNumber", Message: "must be 4 to 17 digits"})
+	}
+	return errs
+}
+
+// handlePutBankAccount checks a bank account and makes it the user's payout
+// method, replacing any earlier one.
+func handlePutBankAccount(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var in bankAccountRequest
+	if err := json.Unmarshal([]byte(req.Body), &in); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	in.RoutingNumber = stripSeparators(in.RoutingNumber)
+	in.AccountNumber = stripSeparators(in.AccountNumber)
+	if errs := append(api.ValidateStruct(in), checkBankAccount(in)...); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	method := &PayoutMethod{
+		Type:          payoutBankAccount,
+		AccountHolder: in.AccountHolder,
+		AccountType:   in.AccountType,
+		RoutingNumber: fieldcrypt.Secret(in.RoutingNumber),
+		AccountNumber: fieldcrypt.Secret(in.AccountNumber),
+		RoutingLast4:  in.RoutingNumber[len(in.RoutingNumber)-4:],
+		AccountLast4:  in.AccountNumber[len(in.AccountNumber)-4:],
+		Status:        payoutVerified,
+		VerifiedAt:    now,
+	}
+	return updatePayoutMethod(ctx, req, method, now)
+}
+
+// handleDeleteBankAccount removes the user's payout method.
+func handleDeleteBankAccount(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return updatePayoutMethod(ctx, req, nil, time.Now().UTC().Format(time.RFC3339))
+}
+
+// updatePayoutMethod sets the profile's payout method, or removes it when
+// method is nil, and returns the updated profile.
+func updatePayoutMethod(ctx context.Context, req events.APIGatewayProxyRequest, method *PayoutMethod, now string) (events.APIGatewayProxyResponse, error) {
+	profile, err := getUserProfile(ctx, req.PathParameters["userId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if profile == nil || profile.DeletedAt != "" {
+		return api.NotFound(ctx, "user not found")
+	}
+	if method == nil && profile.PayoutMethod == nil {
+		return api.NotFound(ctx, "no bank account on file")
+	}
+	if !api.IfMatch(req, profile.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	cond, names, values := api.VersionCondition(profile.Version)
+	names["#payoutMethod"] = "payoutMethod"
+	names["#updatedAt"] = "updatedAt"
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: now}
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(profile.Version + 1)}
+	update := "SET #updatedAt = :updatedAt, #version = :nextVersion REMOVE #payoutMethod"
+	if method != nil {
+		// Seal the method where it is stored, so each number is bound to
+		// payoutMethod.<field> of this profile.
+		sealed, err := fieldcrypt.Sealed(ctx, userProfileTable, profileKey(profile.ID), struct {
+			PayoutMethod *PayoutMethod `json:"payoutMethod"`
+		}{method})
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		item, err := api.MarshalItem(sealed.PayoutMethod)
+		if err != nil {
+			return api.ServerError(ctx, err)
+		}
+		values[":payoutMethod"] = &types.AttributeValueMemberM{Value: item}
+		update = "SET #payoutMethod = :payoutMethod, #updatedAt = :updatedAt, #version = :nextVersion"
+	}
+	_, err = ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(userProfileTable),
+		Key:                       profileKey(profile.ID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	profile.PayoutMethod = method
+	profile.UpdatedAt = now
+	profile.Version++
+	body, _ := json.Marshal(profile.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, profile.Version), nil
+}
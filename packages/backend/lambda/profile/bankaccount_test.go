@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidRoutingNumber(t *testing.T) {
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"021000021", true},
+		{"011000015", true},
+		{"322271627", true},
+		{"611000004", true},
+		{"800000006", true},
+		{"000000000", true},
+		{"021000022", false},
+		{"130000006", false},
+		{"500000005", false},
+		{"02100002", false},
+		{"0210000210", false},
+		{"02100002a", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := validRoutingNumber(c.in); got != c.want {
+			t.Errorf("validRoutingNumber(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCheckBankAccount(t *testing.T) {
+	cases := []struct {
+		name    string
+		routing string
+		account string
+		want    []string
+	}{
+		{"valid", "021000021", "000123456789", nil},
+		{"shortest account", "021000021", "1234", nil},
+		{"longest account", "021000021", "12345678901234567", nil},
+		{"bad checksum", "021000022", "000123456789", []string{"routingNumber"}},
+		{"short account", "021000021", "123", []string{"accountNumber"}},
+		{"long account", "021000021", "123456789012345678", []string{"accountNumber"}},
+		{"letters in account", "021000021", "12345x", []string{"accountNumber"}},
+		{"both bad", "130000006", "12", []string{"routingNumber", "accountNumber"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var fields []string
+			for _, e := range checkBankAccount(bankAccountRequest{RoutingNumber: c.routing, AccountNumber: c.account}) {
+				fields = append(fields, e.Field)
+			}
+			if !reflect.DeepEqual(fields, c.want) {
+				t.Errorf("errors on %v, want %v", fields, c.want)
+			}
+		})
+	}
+}
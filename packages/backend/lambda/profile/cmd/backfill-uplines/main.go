@@ -0,0 +1,183 @@
+// Command backfill-uplines replaces the free-text upline names stored on
+// profiles written before uplines had to be user IDs with the ID of the one
+// live profile of that name, and writes the upline edges that go with it.
+// Names that match no profile, or more than one, are reported and left for a
+// person to fix through PATCH /users/{userId}.
+//
+// It only reports what it would change unless -apply is given:
+//
+//	USER_PROFILE_TABLE=<table> go run ./cmd/backfill-uplines [-apply]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type profile struct {
+	ID        string `dynamodbav:"id"`
+	Name      string `dynamodbav:"name"`
+	UplineEVC string `dynamodbav:"uplineEVC"`
+	UplineSMD string `dynamodbav:"uplineSMD"`
+	DeletedAt string `dynamodbav:"deletedAt"`
+}
+
+// fix is one upline name resolved to a user ID.
+type fix struct {
+	memberID, relation, field, name, uplineID string
+}
+
+func main() {
+	apply := flag.Bool("apply", false, "write the changes instead of only reporting them")
+	flag.Parse()
+	table := os.Getenv("USER_PROFILE_TABLE")
+	if table == "" {
+		fmt.Fprintln(os.Stderr, "USER_PROFILE_TABLE not set")
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ddb := dynamodb.NewFromConfig(cfg)
+
+	profiles, err := scanProfiles(ctx, ddb, table)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fixes, unresolved := resolve(profiles)
+	for _, u := range unresolved {
+		fmt.Println("unresolved:", u)
+	}
+	failed := 0
+	for _, f := range fixes {
+		fmt.Printf("%s %s: %q -> %s\n", f.memberID, f.field, f.name, f.uplineID)
+		if !*apply {
+			continue
+		}
+		if err := write(ctx, ddb, table, f); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", f.memberID, f.field, err)
+			failed++
+		}
+	}
+	fmt.Printf("%d resolved, %d unresolved, %d failed, applied=%t\n", len(fixes), len(unresolved), failed, *apply)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// scanProfiles reads every profile item, skipping upline edges.
+func scanProfiles(ctx context.Context, ddb *dynamodb.Client, table string) ([]profile, error) {
+	var profiles []profile
+	pages := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{
+		TableName:                 aws.String(table),
+		FilterExpression:          aws.String("begins_with(SK, :profile)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":profile": &types.AttributeValueMemberS{Value: "PROFILE#"}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var batch []profile
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, batch...)
+	}
+	return profiles, nil
+}
+
+// resolve maps each upline that is not the ID of a live profile to the one
+// live profile whose name matches it, ignoring case and surrounding spaces.
+func resolve(profiles []profile) ([]fix, []string) {
+	ids := map[string]bool{}
+	byName := map[string][]string{}
+	for _, p := range profiles {
+		if p.DeletedAt != "" {
+			continue
+		}
+		ids[p.ID] = true
+		key := strings.ToLower(strings.TrimSpace(p.Name))
+		byName[key] = append(byName[key], p.ID)
+	}
+	var fixes []fix
+	var unresolved []string
+	for _, p := range profiles {
+		if p.DeletedAt != "" {
+			continue
+		}
+		for _, u := range []struct{ relation, field, value string }{
+			{"EVC", "uplineEVC", p.UplineEVC},
+			{"SMD", "uplineSMD", p.UplineSMD},
+		} {
+			if u.value == "" || ids[u.value] {
+				continue
+			}
+			matches := byName[strings.ToLower(strings.TrimSpace(u.value))]
+			if len(matches) != 1 || matches[0] == p.ID {
+				unresolved = append(unresolved, fmt.Sprintf("%s %s: %q matches %d profiles", p.ID, u.field, u.value, len(matches)))
+				continue
+			}
+			fixes = append(fixes, fix{memberID: p.ID, relation: u.relation, field: u.field, name: u.value, uplineID: matches[0]})
+		}
+	}
+	return fixes, unresolved
+}
+
+// write stores the resolved ID on the profile, bumping its version, and
+// moves the upline edge from the name's partition to the ID's, in one
+// transaction that fails if the upline changed since the scan.
+func write(ctx context.Context, ddb *dynamodb.Client, table string, f fix) error {
+	edgeSK := fmt.Sprintf("DOWNLINE#%s#%s", f.memberID, f.relation)
+	_, err := ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		{Update: &types.Update{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: "USER#" + f.memberID},
+				"SK": &types.AttributeValueMemberS{Value: "PROFILE#" + f.memberID},
+			},
+			UpdateExpression:         aws.String("SET #upline = :id, #updatedAt = :now, #version = if_not_exists(#version, :zero) + :one"),
+			ConditionExpression:      aws.String("#upline = :name"),
+			ExpressionAttributeNames: map[string]string{"#upline": f.field, "#updatedAt": "updatedAt", "#version": "version"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id":   &types.AttributeValueMemberS{Value: f.uplineID},
+				":name": &types.AttributeValueMemberS{Value: f.name},
+				":now":  &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+				":one":  &types.AttributeValueMemberN{Value: "1"},
+			},
+		}},
+		{Delete: &types.Delete{
+			TableName: aws.String(table),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: "USER#" + f.name},
+				"SK": &types.AttributeValueMemberS{Value: edgeSK},
+			},
+		}},
+		{Put: &types.Put{
+			TableName: aws.String(table),
+			Item: map[string]types.AttributeValue{
+				"PK":       &types.AttributeValueMemberS{Value: "USER#" + f.uplineID},
+				"SK":       &types.AttributeValueMemberS{Value: edgeSK},
+				"uplineId": &types.AttributeValueMemberS{Value: f.uplineID},
+				"memberId": &types.AttributeValueMemberS{Value: f.memberID},
+				"relation": &types.AttributeValueMemberS{Value: f.relation},
+			},
+		}},
+	}})
+	return err
+}
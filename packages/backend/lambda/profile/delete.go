@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// handleDeleteUser soft-deletes a user profile. The upline edges stay in
+// place until the purge job removes the user, so a restore brings the team
+// back as it was; deleted members are skipped when teams are listed.
+func handleDeleteUser(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	existing, err := getUserProfile(ctx, req.PathParameters["userId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" {
+		return api.NotFound(ctx, "user not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.MarkDeleted(ctx, userProfileTable, profileKey(existing.ID), existing.Version, api.Actor(req))
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent}, nil
+}
+
+// handleRestoreUser clears a user profile's deletion mark. Admins only.
+func handleRestoreUser(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	profile, err := getUserProfile(ctx, req.PathParameters["userId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if profile == nil {
+		return api.NotFound(ctx, "user not found")
+	}
+	if profile.DeletedAt == "" {
+		return api.ClientError(ctx, http.StatusConflict, "user is not deleted")
+	}
+	if !api.IfMatch(req, profile.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	err = api.RestoreDeleted(ctx, userProfileTable, profileKey(profile.ID), profile.Version)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	profile.DeletedAt, profile.DeletedBy = "", ""
+	profile.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	profile.Version++
+	body, _ := json.Marshal(profile.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, profile.Version), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+
+	"api"
+)
+
+// ledgerPosting is the payload of a ledger.paymentPosted message: the
+// payment as written, with the amount and status it replaced.
+type ledgerPosting struct {
+	PaymentID      string `json:"paymentId"`
+	UserID         string `json:"userId"`
+	ReferralID     string `json:"referralId"`
+	Amount         int64  `json:"amount"`
+	Status         string `json:"status"`
+	PreviousAmount int64  `json:"previousAmount"`
+	PreviousStatus string `json:"previousStatus,omitempty"`
+	Version        int    `json:"version"`
+}
+
+// ledgerMessages returns the ledger posting for a payment write, or none
+// when neither the amount nor the status changed. before is nil for a new
+// payment. The key includes the version, so each write posts at most once.
+func ledgerMessages(before *Payment, after Payment) []api.OutboxMessage {
+	posting := ledgerPosting{
+		PaymentID:  after.ID,
+		UserID:     after.UserID,
+		ReferralID: after.ReferralID,
+		Amount:     after.Amount,
+		Status:     after.Status,
+		Version:    after.Version,
+	}
+	if before != nil {
+		if before.Amount == after.Amount && before.Status == after.Status {
+			return nil
+		}
+		posting.PreviousAmount = before.Amount
+		posting.PreviousStatus = before.Status
+	}
+	return []api.OutboxMessage{api.NewOutboxMessage(api.TopicPaymentPosted, posting, after.ID, strconv.Itoa(after.Version))}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -16,46 +17,59 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+
+	"api"
+	"fieldcrypt"
+	"rbac"
 )
 
 var (
-	ddb              *dynamodb.Client
-	userProfileTable string
-	paymentsTable    string
+	ddb                *dynamodb.Client
+	userProfileTable   string
+	paymentsTable      string
+	notificationsTable string
 )
 
 type UserProfile struct {
-	ID               string `json:"id"`
-	Name             string `json:"name"`
-	Email            string `json:"email"`
-	Phone            string `json:"phone,omitempty"`
-	Address          string `json:"address,omitempty"`
-	Company          string `json:"company,omitempty"`
-	UplineEVC        string `json:"uplineEVC,omitempty"`
-	UplineSMD        string `json:"uplineSMD,omitempty"`
-	BankInfoDocument string `json:"bankInfoDocument,omitempty"`
-	TaxDocument      string `json:"taxDocument,omitempty"`
-	CreatedAt        string `json:"createdAt,omitempty"`
-	UpdatedAt        string `json:"updatedAt,omitempty"`
+	ID               string            `json:"id"`
+	Name             string            `json:"name" validate:"required"`
+	Email            string            `json:"email" validate:"required,email"`
+	Phone            fieldcrypt.Secret `json:"phone,omitempty"`
+	Address          fieldcrypt.Secret `json:"address,omitempty"`
+	Company          string            `json:"company,omitempty"`
+	UplineEVC        string            `json:"uplineEVC,omitempty"`
+	UplineSMD        string            `json:"uplineSMD,omitempty"`
+	BankInfoDocument string            `json:"bankInfoDocument,omitempty"`
+	TaxDocument      string            `json:"taxDocument,omitempty"`
+	// NotificationPreferences is nil until the user changes a channel.
+	NotificationPreferences *NotificationPreferences `json:"notificationPreferences,omitempty"`
+	PayoutMethod            *PayoutMethod            `json:"payoutMethod,omitempty"`
+	Version                 int                      `json:"version"`
+	CreatedAt               string                   `json:"createdAt,omitempty"`
+	UpdatedAt               string                   `json:"updatedAt,omitempty"`
+	DeletedAt               string                   `json:"deletedAt,omitempty"`
+	DeletedBy               string                   `json:"deletedBy,omitempty"`
 }
 
 type Payment struct {
-	ID         string  `json:"id"`
-	ReferralID string  `json:"referralId"`
-	UserID     string  `json:"userId"`
-	Amount     float64 `json:"amount"`
-	Date       string  `json:"date"`
-	Status     string  `json:"status"`
+	ID         string    `json:"id"`
+	ReferralID string    `json:"referralId" validate:"required"`
+	UserID     string    `json:"userId" validate:"required"`
+	Amount     int64     `json:"amount" validate:"required,min=1"`
+	Type       string    `json:"type" validate:"required,oneof=COMMISSION BONUS_POOL UPLINE"`
+	Date       string    `json:"date"`
+	Status     string    `json:"status" validate:"required,oneof=PENDING PROCESSED FAILED"`
+	BankInfo   *BankInfo `json:"bankInfo,omitempty"`
+	Version    int       `json:"version"`
+	CreatedAt  string    `json:"createdAt,omitempty"`
+	UpdatedAt  string    `json:"updatedAt,omitempty"`
 }
 
-func init() {
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		panic(err)
-	}
-	ddb = dynamodb.NewFromConfig(cfg)
-	userProfileTable = getenv("USER_PROFILE_TABLE")
-	paymentsTable = getenv("PAYMENTS_TABLE")
+// BankInfo is the account a payment was sent to.
+type BankInfo struct {
+	AccountNumber fieldcrypt.Secret `json:"accountNumber,omitempty"`
+	RoutingNumber fieldcrypt.Secret `json:"routingNumber,omitempty"`
+	AccountType   string            `json:"accountType,omitempty"`
 }
 
 func getenv(key string) string {
@@ -72,75 +86,250 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		return handleGetUser(ctx, req)
 	case req.Resource == "/users/{userId}" && req.HTTPMethod == http.MethodPut:
 		return handlePutUser(ctx, req)
+	case req.Resource == "/users/{userId}" && req.HTTPMethod == http.MethodPatch:
+		return handlePatchUser(ctx, req)
+	case req.Resource == "/users/{userId}" && req.HTTPMethod == http.MethodDelete:
+		return handleDeleteUser(ctx, req)
+	case req.Resource == "/users/{userId}/restore" && req.HTTPMethod == http.MethodPost:
+		return handleRestoreUser(ctx, req)
+	case req.Resource == "/users/{userId}/bank-account" && req.HTTPMethod == http.MethodPut:
+		return handlePutBankAccount(ctx, req)
+	case req.Resource == "/users/{userId}/bank-account" && req.HTTPMethod == http.MethodDelete:
+		return handleDeleteBankAccount(ctx, req)
+	case req.Resource == "/users/{userId}/notifications" && req.HTTPMethod == http.MethodGet:
+		return handleListNotifications(ctx, req)
 	case req.Resource == "/users/{userId}/payments" && req.HTTPMethod == http.MethodGet:
 		return handleGetPayments(ctx, req)
 	case req.Resource == "/payments" && req.HTTPMethod == http.MethodGet:
 		return handleGetAllPayments(ctx, req)
 	case req.Resource == "/payments" && req.HTTPMethod == http.MethodPost:
-		return handleCreatePayment(ctx, req)
+		return api.WithIdempotency(ctx, req, "createPayment", handleCreatePayment)
 	case req.Resource == "/payments/{paymentId}" && req.HTTPMethod == http.MethodGet:
 		return handleGetPayment(ctx, req)
 	case req.Resource == "/payments/{paymentId}" && req.HTTPMethod == http.MethodPut:
 		return handleUpdatePayment(ctx, req)
+	case req.Resource == "/payments/{paymentId}" && req.HTTPMethod == http.MethodPatch:
+		return handlePatchPayment(ctx, req)
 	default:
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return api.NotFound(ctx, "route not found")
 	}
 }
 
 func handleGetUser(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	userID := req.PathParameters["userId"]
-	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(userProfileTable),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
-			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", userID)},
-		},
-	})
+	profile, err := getUserProfile(ctx, req.PathParameters["userId"])
 	if err != nil {
-		return serverError(err)
-	}
-	if out.Item == nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return api.ServerError(ctx, err)
 	}
-	var profile UserProfile
-	if err := attributevalue.UnmarshalMap(out.Item, &profile); err != nil {
-		return serverError(err)
+	if profile == nil || (profile.DeletedAt != "" && !api.IncludeDeleted(req)) {
+		return api.NotFound(ctx, "user not found")
 	}
-	body, _ := json.Marshal(profile)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	body, _ := json.Marshal(profile.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, profile.Version), nil
 }
 
 func handlePutUser(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	userID := req.PathParameters["userId"]
 	var profile UserProfile
 	if err := json.Unmarshal([]byte(req.Body), &profile); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	profile.ID = userID
+	existing, err := getUserProfile(ctx, userID)
+	if err != nil {
+		return api.ServerError(ctx, err)
 	}
+	if existing != nil && existing.DeletedAt != "" {
+		return api.NotFound(ctx, "user not found")
+	}
+	errs := api.ValidateStruct(profile)
+	uplineErrs, err := validateUplines(ctx, existing, profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if errs = append(errs, uplineErrs...); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	var old UserProfile
+	if existing != nil {
+		old = *existing
+	}
+	if !api.IfMatch(req, old.Version, existing != nil) {
+		return api.PreconditionFailed(ctx)
+	}
+	profile.keepRedacted(old)
+	profile.PayoutMethod = old.PayoutMethod
 	now := time.Now().UTC().Format(time.RFC3339)
-	if profile.CreatedAt == "" {
-		profile.CreatedAt = now
+	profile.CreatedAt = now
+	if existing != nil {
+		profile.CreatedAt = existing.CreatedAt
 	}
 	profile.UpdatedAt = now
-	profile.ID = userID
+	profile.Version = old.Version + 1
 
-	item, err := attributevalue.MarshalMap(struct {
+	sealed, err := fieldcrypt.Sealed(ctx, userProfileTable, profileKey(userID), profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	item, err := api.MarshalItem(struct {
 		PK string `dynamodbav:"PK"`
 		SK string `dynamodbav:"SK"`
 		UserProfile
 	}{
 		PK:          fmt.Sprintf("USER#%s", userID),
 		SK:          fmt.Sprintf("PROFILE#%s", userID),
-		UserProfile: profile,
+		UserProfile: sealed,
 	})
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
+	writes, err := uplineEdgeWrites(old, profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	put := &types.Put{TableName: aws.String(userProfileTable), Item: item, ConditionExpression: aws.String("attribute_not_exists(PK)")}
+	if existing != nil {
+		cond, names, values := api.VersionCondition(existing.Version)
+		put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues = aws.String(cond), names, values
+	}
+	writes = append([]types.TransactWriteItem{{Put: put}}, writes...)
 
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(userProfileTable), Item: item}); err != nil {
-		return serverError(err)
+	_, err = ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	if err != nil {
+		return profileWriteError(ctx, err)
 	}
-	body, _ := json.Marshal(profile)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	body, _ := json.Marshal(profile.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, profile.Version), nil
+}
+
+// handlePatchUser applies a JSON Merge Patch to a profile, writing only the
+// attributes the patch names, and moves the upline edges with it.
+func handlePatchUser(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	patch, err := api.ParsePatch(req.Body)
+	if err != nil {
+		return api.ClientError(ctx, http.StatusBadRequest, err.Error())
+	}
+	if errs := api.CheckPatchFields(patch, UserProfile{}, "payoutMethod"); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	existing, err := getUserProfile(ctx, req.PathParameters["userId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil || existing.DeletedAt != "" {
+		return api.NotFound(ctx, "user not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	var profile UserProfile
+	if err := api.ApplyPatch(existing, patch, &profile); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	profile.keepRedacted(*existing)
+	errs := api.ValidateStruct(profile)
+	uplineErrs, err := validateUplines(ctx, existing, profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if errs = append(errs, uplineErrs...); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	profile.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	profile.Version = existing.Version + 1
+
+	sealed, err := fieldcrypt.Sealed(ctx, userProfileTable, profileKey(profile.ID), profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	item, err := api.MarshalItem(sealed)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	update, cond, names, values := api.PatchUpdate(api.SortedKeys(patch), item, profile.UpdatedAt, existing.Version)
+	writes, err := uplineEdgeWrites(*existing, profile)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	writes = append([]types.TransactWriteItem{{Update: &types.Update{
+		TableName:                 aws.String(userProfileTable),
+		Key:                       profileKey(profile.ID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}}, writes...)
+
+	_, err = ddb.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	if err != nil {
+		return profileWriteError(ctx, err)
+	}
+	body, _ := json.Marshal(profile.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, profile.Version), nil
+}
+
+// profileWriteError answers a failed profile transaction, whose first item
+// is the profile write and the rest the upline edges, which carry no
+// conditions. Only the profile's version condition is a 412; a transaction
+// that collided with another is a 409 the caller can retry, and anything
+// else, such as throttling, a 500.
+func profileWriteError(ctx context.Context, err error) (events.APIGatewayProxyResponse, error) {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return api.ServerError(ctx, err)
+	}
+	for i, reason := range canceled.CancellationReasons {
+		switch code := aws.ToString(reason.Code); {
+		case i == 0 && code == "ConditionalCheckFailed":
+			return api.PreconditionFailed(ctx)
+		case code == "TransactionConflict":
+			return api.ClientError(ctx, http.StatusConflict, "profile is being changed by another request; retry")
+		}
+	}
+	return api.ServerError(ctx, err)
+}
+
+func profileKey(userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", userID)},
+	}
+}
+
+// getUserProfile loads a profile by user ID, returning nil if none exists.
+func getUserProfile(ctx context.Context, userID string) (*UserProfile, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String(userProfileTable), Key: profileKey(userID)})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	var profile UserProfile
+	if err := attributevalue.UnmarshalMap(out.Item, &profile); err != nil {
+		return nil, err
+	}
+	if err := fieldcrypt.Open(ctx, userProfileTable, profileKey(userID), &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func paymentKey(paymentID, userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PAYMENT#%s", paymentID)},
+		"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", userID)},
+	}
+}
+
+// openPayments decrypts the bank details of payments read from the table.
+func openPayments(ctx context.Context, payments []Payment) error {
+	for i := range payments {
+		p := &payments[i]
+		if err := fieldcrypt.Open(ctx, paymentsTable, paymentKey(p.ID, p.UserID), p); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func handleGetPayments(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -153,13 +342,16 @@ func handleGetPayments(ctx context.Context, req events.APIGatewayProxyRequest) (
 		},
 	})
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
 	var payments []Payment
 	if err := attributevalue.UnmarshalListOfMaps(out.Items, &payments); err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
-	body, _ := json.Marshal(payments)
+	if err := openPayments(ctx, payments); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(paymentsForCaller(req, payments))
 	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
 }
 
@@ -168,130 +360,263 @@ func handleGetAllPayments(ctx context.Context, req events.APIGatewayProxyRequest
 		TableName: aws.String(paymentsTable),
 	})
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
 	var payments []Payment
 	if err := attributevalue.UnmarshalListOfMaps(out.Items, &payments); err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
+	}
+	if err := openPayments(ctx, payments); err != nil {
+		return api.ServerError(ctx, err)
 	}
-	body, _ := json.Marshal(payments)
+	body, _ := json.Marshal(paymentsForCaller(req, payments))
 	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
 }
 
 func handleCreatePayment(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	var payment Payment
 	if err := json.Unmarshal([]byte(req.Body), &payment); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	if errs := api.ValidateStruct(payment); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 
 	now := time.Now().UTC().Format(time.RFC3339)
-	if payment.ID == "" {
-		payment.ID = uuid.NewString()
-	}
+	// The ID is always assigned here: the item key also holds the user ID,
+	// so the put's condition cannot stop a client-chosen ID from being used
+	// twice for different users. Retries are made safe by Idempotency-Key.
+	payment.ID = uuid.NewString()
 	if payment.Date == "" {
 		payment.Date = now
 	}
+	payment.CreatedAt = now
+	payment.UpdatedAt = now
+	payment.Version = 1
 
-	item, err := attributevalue.MarshalMap(struct {
+	sealed, err := fieldcrypt.Sealed(ctx, paymentsTable, paymentKey(payment.ID, payment.UserID), payment)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	item, err := api.MarshalItem(struct {
 		PK string `dynamodbav:"PK"`
 		SK string `dynamodbav:"SK"`
 		Payment
 	}{
 		PK:      fmt.Sprintf("PAYMENT#%s", payment.ID),
 		SK:      fmt.Sprintf("USER#%s", payment.UserID),
-		Payment: payment,
+		Payment: sealed,
 	})
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
 
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(paymentsTable), Item: item}); err != nil {
-		return serverError(err)
+	event, err := api.NewAuditEvent(api.AuditPayment, payment.ID, api.Actor(req), nil, payment.redacted())
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	err = api.WriteWithOutbox(ctx, []types.TransactWriteItem{{Put: &types.Put{
+		TableName:           aws.String(paymentsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}}}, ledgerMessages(nil, payment), event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.ClientError(ctx, http.StatusConflict, fmt.Sprintf("payment %s already exists", payment.ID))
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
 	}
-	body, _ := json.Marshal(payment)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	body, _ := json.Marshal(payment.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusCreated, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, payment.Version), nil
 }
 
-func handleGetPayment(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	paymentID := req.PathParameters["paymentId"]
-
-	// First try to find by scanning for the payment ID
-	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{
-		TableName:        aws.String(paymentsTable),
-		FilterExpression: aws.String("#id = :pid"),
-		ExpressionAttributeNames: map[string]string{
-			"#id": "id",
-		},
+// findPayment loads a payment by ID, returning nil if none exists. The sort
+// key holds the user ID, so the payment is found by querying its partition.
+func findPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	out, err := ddb.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(paymentsTable),
+		KeyConditionExpression: aws.String("PK = :pk"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pid": &types.AttributeValueMemberS{Value: paymentID},
+			":pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("PAYMENT#%s", paymentID)},
 		},
+		Limit: aws.Int32(1),
 	})
 	if err != nil {
-		return serverError(err)
+		return nil, err
 	}
 	if len(out.Items) == 0 {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+		return nil, nil
 	}
 	var payment Payment
 	if err := attributevalue.UnmarshalMap(out.Items[0], &payment); err != nil {
-		return serverError(err)
+		return nil, err
 	}
-	body, _ := json.Marshal(payment)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	if err := fieldcrypt.Open(ctx, paymentsTable, paymentKey(payment.ID, payment.UserID), &payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func handleGetPayment(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	payment, err := findPayment(ctx, req.PathParameters["paymentId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if payment == nil || !rbac.Allowed(api.Identity(req), "payments:read", payment.UserID) {
+		return api.NotFound(ctx, "payment not found")
+	}
+	body, _ := json.Marshal(payment.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, payment.Version), nil
 }
 
+// handleUpdatePayment replaces a payment if its stored version still matches
+// If-Match, or the version read here when the header is absent.
 func handleUpdatePayment(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	paymentID := req.PathParameters["paymentId"]
 	var payment Payment
 	if err := json.Unmarshal([]byte(req.Body), &payment); err != nil {
-		return clientError(http.StatusBadRequest, "invalid body")
+		return api.BodyError(ctx, err)
+	}
+	if errs := api.ValidateStruct(payment); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
 	}
 	payment.ID = paymentID
 
-	// First find the existing payment to get the correct PK/SK
-	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{
-		TableName:        aws.String(paymentsTable),
-		FilterExpression: aws.String("id = :pid"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pid": &types.AttributeValueMemberS{Value: paymentID},
-		},
-	})
+	existing, err := findPayment(ctx, paymentID)
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
-	if len(out.Items) == 0 {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+	if existing == nil {
+		return api.NotFound(ctx, "payment not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	// The user ID is part of the key.
+	if payment.UserID != existing.UserID {
+		return api.ValidationError(ctx, []api.FieldError{{Field: "userId", Message: "cannot be changed"}})
 	}
+	payment.keepRedacted(*existing)
+	payment.CreatedAt = existing.CreatedAt
+	payment.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	payment.Version = existing.Version + 1
 
-	// Update with the new data
-	item, err := attributevalue.MarshalMap(struct {
+	sealed, err := fieldcrypt.Sealed(ctx, paymentsTable, paymentKey(payment.ID, payment.UserID), payment)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	item, err := api.MarshalItem(struct {
 		PK string `dynamodbav:"PK"`
 		SK string `dynamodbav:"SK"`
 		Payment
 	}{
 		PK:      fmt.Sprintf("PAYMENT#%s", payment.ID),
 		SK:      fmt.Sprintf("USER#%s", payment.UserID),
-		Payment: payment,
+		Payment: sealed,
 	})
 	if err != nil {
-		return serverError(err)
+		return api.ServerError(ctx, err)
 	}
-
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(paymentsTable), Item: item}); err != nil {
-		return serverError(err)
+	event, err := api.NewAuditEvent(api.AuditPayment, payment.ID, api.Actor(req), existing.redacted(), payment.redacted())
+	if err != nil {
+		return api.ServerError(ctx, err)
 	}
-	body, _ := json.Marshal(payment)
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	cond, names, values := api.VersionCondition(existing.Version)
+	err = api.WriteWithOutbox(ctx, []types.TransactWriteItem{{Put: &types.Put{
+		TableName:                 aws.String(paymentsTable),
+		Item:                      item,
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}}, ledgerMessages(existing, payment), event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(payment.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, payment.Version), nil
 }
 
-func serverError(err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
-}
+// handlePatchPayment applies a JSON Merge Patch to a payment, writing only
+// the attributes the patch names. userId is part of the key and cannot change.
+func handlePatchPayment(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	patch, err := api.ParsePatch(req.Body)
+	if err != nil {
+		return api.ClientError(ctx, http.StatusBadRequest, err.Error())
+	}
+	if errs := api.CheckPatchFields(patch, Payment{}, "userId"); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	existing, err := findPayment(ctx, req.PathParameters["paymentId"])
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if existing == nil {
+		return api.NotFound(ctx, "payment not found")
+	}
+	if !api.IfMatch(req, existing.Version, true) {
+		return api.PreconditionFailed(ctx)
+	}
+	var payment Payment
+	if err := api.ApplyPatch(existing, patch, &payment); err != nil {
+		return api.BodyError(ctx, err)
+	}
+	payment.keepRedacted(*existing)
+	if errs := api.ValidateStruct(payment); len(errs) > 0 {
+		return api.ValidationError(ctx, errs)
+	}
+	payment.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	payment.Version = existing.Version + 1
 
-func clientError(code int, msg string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: code, Body: msg}, nil
+	sealed, err := fieldcrypt.Sealed(ctx, paymentsTable, paymentKey(payment.ID, payment.UserID), payment)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	item, err := api.MarshalItem(sealed)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	update, cond, names, values := api.PatchUpdate(api.SortedKeys(patch), item, payment.UpdatedAt, existing.Version)
+	event, err := api.NewAuditEvent(api.AuditPayment, payment.ID, api.Actor(req), existing.redacted(), payment.redacted())
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	err = api.WriteWithOutbox(ctx, []types.TransactWriteItem{{Update: &types.Update{
+		TableName:                 aws.String(paymentsTable),
+		Key:                       paymentKey(payment.ID, payment.UserID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}}}, ledgerMessages(existing, payment), event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return api.PreconditionFailed(ctx)
+	}
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	body, _ := json.Marshal(payment.forCaller(req))
+	return api.WithETag(events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, payment.Version), nil
 }
 
 func main() {
-	lambda.Start(handler)
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: getenv("AUDIT_TABLE"), Idempotency: getenv("IDEMPOTENCY_TABLE"), Outbox: getenv("OUTBOX_TABLE")})
+	if err := api.CheckTags(UserProfile{}, Payment{}, bankAccountRequest{}); err != nil {
+		panic(err)
+	}
+	useFieldEncryption(cfg)
+	userProfileTable = getenv("USER_PROFILE_TABLE")
+	paymentsTable = getenv("PAYMENTS_TABLE")
+	notificationsTable = getenv("NOTIFICATIONS_TABLE")
+	lambda.Start(api.WithLogging(withCaller(api.WithPolicy(handler))))
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestProfileWriteError(t *testing.T) {
+	canceled := func(codes ...string) error {
+		e := &types.TransactionCanceledException{}
+		for _, c := range codes {
+			e.CancellationReasons = append(e.CancellationReasons, types.CancellationReason{Code: aws.String(c)})
+		}
+		return e
+	}
+	cases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"stale version", canceled("ConditionalCheckFailed", "None"), http.StatusPreconditionFailed},
+		{"concurrent transaction", canceled("None", "TransactionConflict"), http.StatusConflict},
+		{"throttled", canceled("ThrottlingError", "None"), http.StatusInternalServerError},
+		{"other error", errors.New("network down"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, _ := profileWriteError(context.Background(), c.err)
+			if resp.StatusCode != c.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// In-app notifications are written by the notify function when a user's
+// referral or payment changes status, and listed here newest first. PK
+// USER#<userId>, SK NOTIFICATION#<createdAt>#<eventId>.
+
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+// NotificationPreferences turns notification channels on or off. A channel
+// left unset is on.
+type NotificationPreferences struct {
+	Email *bool `json:"email,omitempty"`
+	InApp *bool `json:"inApp,omitempty"`
+}
+
+type notification struct {
+	ID        string `json:"id"`
+	EventType string `json:"eventType"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// notificationPage is one page of notifications. NextToken is set when
+// there are more.
+type notificationPage struct {
+	Notifications []notification `json:"notifications"`
+	NextToken     string         `json:"nextToken,omitempty"`
+}
+
+func handleListNotifications(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	limit := defaultNotificationLimit
+	if v := req.QueryStringParameters["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxNotificationLimit {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "limit", Message: fmt.Sprintf("must be an integer from 1 to %d", maxNotificationLimit)}})
+		}
+		limit = n
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(notificationsTable),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: fmt.Sprintf("USER#%s", req.PathParameters["userId"])},
+			":prefix": &types.AttributeValueMemberS{Value: "NOTIFICATION#"},
+		},
+		Limit:            aws.Int32(int32(limit)),
+		ScanIndexForward: aws.Bool(false),
+	}
+	if v := req.QueryStringParameters["nextToken"]; v != "" {
+		start, err := decodePageToken(v)
+		if err != nil {
+			return api.ValidationError(ctx, []api.FieldError{{Field: "nextToken", Message: "is not a token from a previous page"}})
+		}
+		input.ExclusiveStartKey = start
+	}
+	out, err := ddb.Query(ctx, input)
+	if err != nil {
+		return api.ServerError(ctx, err)
+	}
+	page := notificationPage{Notifications: []notification{}}
+	if err := attributevalue.UnmarshalListOfMapsWithOptions(out.Items, &page.Notifications, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	}); err != nil {
+		return api.ServerError(ctx, err)
+	}
+	if len(out.LastEvaluatedKey) > 0 {
+		if page.NextToken, err = encodePageToken(out.LastEvaluatedKey); err != nil {
+			return api.ServerError(ctx, err)
+		}
+	}
+	body, _ := json.Marshal(page)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+}
+
+// encodePageToken turns a LastEvaluatedKey, whose attributes are all
+// strings in this table, into an opaque page token.
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	var m map[string]string
+	if err := attributevalue.UnmarshalMap(key, &m); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return attributevalue.MarshalMap(m)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"api"
+	"fieldcrypt"
+)
+
+// Phone numbers, addresses and bank account details are fieldcrypt.Secret
+// values: encrypted in the table under the KMS key in
+// FIELD_ENCRYPTION_KEY_ID, redacted in logs, and shown in full only to the
+// user they belong to. Under sam local FIELD_ENCRYPTION_LOCAL_KEY, a
+// base64-encoded 32-byte key, replaces KMS.
+
+func useFieldEncryption(cfg aws.Config) {
+	if key := os.Getenv("FIELD_ENCRYPTION_LOCAL_KEY"); key != "" {
+		p, err := fieldcrypt.NewLocalProvider(key)
+		if err != nil {
+			panic(err)
+		}
+		fieldcrypt.Use(p)
+		return
+	}
+	fieldcrypt.Use(fieldcrypt.NewKMSProvider(kms.NewFromConfig(cfg), getenv("FIELD_ENCRYPTION_KEY_ID")))
+}
+
+// redacted returns the profile with its sensitive fields hidden.
+func (p UserProfile) redacted() UserProfile {
+	p.Phone = p.Phone.Redacted()
+	p.Address = p.Address.Redacted()
+	p.PayoutMethod = p.PayoutMethod.public()
+	return p
+}
+
+// forCaller returns the profile as the caller may see it. The payout
+// method's full numbers are never returned, not even to the user.
+func (p UserProfile) forCaller(req events.APIGatewayProxyRequest) UserProfile {
+	if api.CallerSub(req) == p.ID {
+		p.PayoutMethod = p.PayoutMethod.public()
+		return p
+	}
+	return p.redacted()
+}
+
+// redacted returns the payment with its account and routing numbers cut to
+// their last four digits. Audit events record payments this way too.
+func (p Payment) redacted() Payment {
+	if p.BankInfo != nil {
+		bank := *p.BankInfo
+		bank.AccountNumber = bank.AccountNumber.Masked()
+		bank.RoutingNumber = bank.RoutingNumber.Masked()
+		p.BankInfo = &bank
+	}
+	return p
+}
+
+// forCaller returns the payment as the caller may see it.
+func (p Payment) forCaller(req events.APIGatewayProxyRequest) Payment {
+	if api.CallerSub(req) == p.UserID {
+		return p
+	}
+	return p.redacted()
+}
+
+func paymentsForCaller(req events.APIGatewayProxyRequest, payments []Payment) []Payment {
+	for i := range payments {
+		payments[i] = payments[i].forCaller(req)
+	}
+	return payments
+}
+
+// keepRedacted restores the stored values of sensitive fields that come back
+// as their redacted form, so a non-owner writing back a profile it read does
+// not replace them with the placeholder.
+func (p *UserProfile) keepRedacted(stored UserProfile) {
+	if p.Phone != "" && p.Phone == stored.Phone.Redacted() {
+		p.Phone = stored.Phone
+	}
+	if p.Address != "" && p.Address == stored.Address.Redacted() {
+		p.Address = stored.Address
+	}
+}
+
+// keepRedacted does the same for a payment's masked bank numbers.
+func (p *Payment) keepRedacted(stored Payment) {
+	if p.BankInfo == nil || stored.BankInfo == nil {
+		return
+	}
+	bank := *p.BankInfo
+	if bank.AccountNumber != "" && bank.AccountNumber == stored.BankInfo.AccountNumber.Masked() {
+		bank.AccountNumber = stored.BankInfo.AccountNumber
+	}
+	if bank.RoutingNumber != "" && bank.RoutingNumber == stored.BankInfo.RoutingNumber.Masked() {
+		bank.RoutingNumber = stored.BankInfo.RoutingNumber
+	}
+	p.BankInfo = &bank
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"api"
+)
+
+// wfgCompany is the company value whose affiliates must name both uplines.
+const wfgCompany = "WFG"
+
+// validateUplines enforces that WFG affiliates name an upline EVC and SMD and
+// that every upline given is the ID of another existing user profile, so
+// commission routing can follow it. old is the stored profile, or nil for a
+// new one; uplines it already has are not checked again, so a write that
+// leaves them alone is not rejected for a name stored before IDs were
+// required or for an upline deleted since.
+func validateUplines(ctx context.Context, old *UserProfile, profile UserProfile) ([]api.FieldError, error) {
+	var prev UserProfile
+	if old != nil {
+		prev = *old
+	}
+	uplines := []struct {
+		field string
+		id    string
+		prev  string
+	}{
+		{"uplineEVC", profile.UplineEVC, prev.UplineEVC},
+		{"uplineSMD", profile.UplineSMD, prev.UplineSMD},
+	}
+	wfg := strings.EqualFold(profile.Company, wfgCompany)
+	becameWFG := wfg && (old == nil || !strings.EqualFold(prev.Company, wfgCompany))
+
+	var errs []api.FieldError
+	var lookup []string
+	for _, u := range uplines {
+		changed := old == nil || u.id != u.prev
+		switch {
+		case u.id == "" && wfg && (changed || becameWFG):
+			errs = append(errs, api.FieldError{Field: u.field, Message: "is required for WFG affiliates"})
+		case !changed:
+		case u.id == profile.ID && u.id != "":
+			errs = append(errs, api.FieldError{Field: u.field, Message: "cannot be the user themselves"})
+		case u.id != "":
+			lookup = append(lookup, u.id)
+		}
+	}
+	if len(lookup) == 0 {
+		return errs, nil
+	}
+
+	found, err := existingUserIDs(ctx, lookup)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range uplines {
+		if u.id != "" && u.id != u.prev && u.id != profile.ID && !found[u.id] {
+			errs = append(errs, api.FieldError{Field: u.field, Message: "must be the ID of an existing user"})
+		}
+	}
+	return errs, nil
+}
+
+// existingUserIDs reports which of ids have a profile in the user table that
+// is not soft-deleted.
+func existingUserIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	seen := map[string]bool{}
+	var keys []map[string]types.AttributeValue
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, profileKey(id))
+	}
+	out, err := ddb.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]types.KeysAndAttributes{
+			userProfileTable: {
+				Keys:                     keys,
+				ProjectionExpression:     aws.String("#id, #deletedAt"),
+				ExpressionAttributeNames: map[string]string{"#id": "id", "#deletedAt": "deletedAt"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.UnprocessedKeys) > 0 {
+		return nil, fmt.Errorf("upline lookup throttled: %d keys unprocessed", len(out.UnprocessedKeys[userProfileTable].Keys))
+	}
+	var rows []struct {
+		ID        string `dynamodbav:"id"`
+		DeletedAt string `dynamodbav:"deletedAt"`
+	}
+	if err := attributevalue.UnmarshalListOfMaps(out.Responses[userProfileTable], &rows); err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		found[r.ID] = r.DeletedAt == ""
+	}
+	return found, nil
+}
+
+// uplineEdge records that member sits directly below upline. Edges live in the
+// upline's partition of the user profile table (PK USER#<uplineId>, SK
+// DOWNLINE#<memberId>#<relation>) so a lead's direct downline is one Query.
+type uplineEdge struct {
+	PK       string `dynamodbav:"PK"`
+	SK       string `dynamodbav:"SK"`
+	UplineID string `dynamodbav:"uplineId"`
+	MemberID string `dynamodbav:"memberId"`
+	Relation string `dynamodbav:"relation"`
+}
+
+func uplineEdges(profile UserProfile) []uplineEdge {
+	var edges []uplineEdge
+	for _, u := range []struct{ relation, id string }{
+		{"EVC", profile.UplineEVC},
+		{"SMD", profile.UplineSMD},
+	} {
+		if u.id == "" {
+			continue
+		}
+		edges = append(edges, uplineEdge{
+			PK:       fmt.Sprintf("USER#%s", u.id),
+			SK:       fmt.Sprintf("DOWNLINE#%s#%s", profile.ID, u.relation),
+			UplineID: u.id,
+			MemberID: profile.ID,
+			Relation: u.relation,
+		})
+	}
+	return edges
+}
+
+// uplineEdgeWrites returns the transaction items that replace the edges for
+// old's uplines with those for updated's. Unchanged edges are left alone.
+func uplineEdgeWrites(old, updated UserProfile) ([]types.TransactWriteItem, error) {
+	keep := map[string]bool{}
+	for _, e := range uplineEdges(old) {
+		keep[e.PK+"|"+e.SK] = false
+	}
+	var writes []types.TransactWriteItem
+	for _, e := range uplineEdges(updated) {
+		if _, ok := keep[e.PK+"|"+e.SK]; ok {
+			keep[e.PK+"|"+e.SK] = true
+			continue
+		}
+		item, err := attributevalue.MarshalMap(e)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(userProfileTable), Item: item}})
+	}
+	for _, e := range uplineEdges(old) {
+		if keep[e.PK+"|"+e.SK] {
+			continue
+		}
+		writes = append(writes, types.TransactWriteItem{Delete: &types.Delete{
+			TableName: aws.String(userProfileTable),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: e.PK},
+				"SK": &types.AttributeValueMemberS{Value: e.SK},
+			},
+		}})
+	}
+	return writes, nil
+}
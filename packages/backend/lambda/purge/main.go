@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// defaultRetentionDays is how long soft-deleted records are kept when
+// RETENTION_DAYS is not set.
+const defaultRetentionDays = 30
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+var (
+	ddb              *dynamodb.Client
+	userProfileTable string
+	partnersTable    string
+	customersTable   string
+	leadDataTable    string
+	retention        time.Duration
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	userProfileTable = getenv("USER_PROFILE_TABLE")
+	partnersTable = getenv("PARTNERS_TABLE")
+	customersTable = getenv("CUSTOMERS_TABLE")
+	leadDataTable = getenv("LEAD_DATA_TABLE")
+	days := defaultRetentionDays
+	if v := os.Getenv("RETENTION_DAYS"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil || days < 1 {
+			panic(fmt.Sprintf("RETENTION_DAYS must be a positive integer, got %q", v))
+		}
+	}
+	retention = time.Duration(days) * 24 * time.Hour
+}
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
+}
+
+// purgeResult counts the records removed from each table.
+type purgeResult struct {
+	Cutoff    string `json:"cutoff"`
+	Partners  int    `json:"partners"`
+	Customers int    `json:"customers"`
+	Users     int    `json:"users"`
+	Leads     int    `json:"leads"`
+}
+
+// handler runs on a schedule and removes soft-deleted partners, customers,
+// users and leads whose deletedAt is older than the retention period, together
+// with the items that only exist for them.
+func handler(ctx context.Context, _ events.CloudWatchEvent) (purgeResult, error) {
+	cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339)
+	res := purgeResult{Cutoff: cutoff}
+	var err error
+	if res.Partners, err = purgePartners(ctx, cutoff); err != nil {
+		return res, fmt.Errorf("purge partners: %w", err)
+	}
+	if res.Customers, err = purgeCustomers(ctx, cutoff); err != nil {
+		return res, fmt.Errorf("purge customers: %w", err)
+	}
+	if res.Users, err = purgeUsers(ctx, cutoff); err != nil {
+		return res, fmt.Errorf("purge users: %w", err)
+	}
+	if res.Leads, err = purgeLeads(ctx, cutoff); err != nil {
+		return res, fmt.Errorf("purge leads: %w", err)
+	}
+	logger.InfoContext(ctx, "purge completed",
+		slog.String("cutoff", cutoff),
+		slog.Int("partners", res.Partners),
+		slog.Int("customers", res.Customers),
+		slog.Int("users", res.Users),
+		slog.Int("leads", res.Leads),
+	)
+	return res, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// batchWriteLimit is the most requests one BatchWriteItem call accepts.
+const batchWriteLimit = 25
+
+// expired is a soft-deleted record found by scanExpired. Uplines are only
+// set for user profiles.
+type expired struct {
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	ID        string `dynamodbav:"id"`
+	DeletedAt string `dynamodbav:"deletedAt"`
+	UplineEVC string `dynamodbav:"uplineEVC"`
+	UplineSMD string `dynamodbav:"uplineSMD"`
+}
+
+// scanExpired returns the items in table whose sort key starts with
+// skPrefix and that were deleted before cutoff. deletedAt is RFC 3339 UTC, so
+// string order is time order.
+func scanExpired(ctx context.Context, table, skPrefix, cutoff string) ([]expired, error) {
+	var records []expired
+	p := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{
+		TableName:        aws.String(table),
+		FilterExpression: aws.String("begins_with(SK, :prefix) AND deletedAt < :cutoff"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: skPrefix},
+			":cutoff": &types.AttributeValueMemberS{Value: cutoff},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []expired
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+	}
+	return records, nil
+}
+
+// deleteExpired removes r unless it was restored or deleted again since the
+// scan, and reports whether it did.
+func deleteExpired(ctx context.Context, table string, r expired) (bool, error) {
+	_, err := ddb.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(table),
+		Key:                 itemKey(r.PK, r.SK),
+		ConditionExpression: aws.String("deletedAt = :seen"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":seen": &types.AttributeValueMemberS{Value: r.DeletedAt},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// purgeTable deletes every profile record in table past cutoff and returns
+// them.
+func purgeTable(ctx context.Context, table, cutoff string) ([]expired, error) {
+	return purgeRecords(ctx, table, "PROFILE#", cutoff)
+}
+
+// purgeRecords deletes every record in table whose sort key starts with
+// skPrefix and that is past cutoff, and returns them.
+func purgeRecords(ctx context.Context, table, skPrefix, cutoff string) ([]expired, error) {
+	records, err := scanExpired(ctx, table, skPrefix, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var purged []expired
+	for _, r := range records {
+		ok, err := deleteExpired(ctx, table, r)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged = append(purged, r)
+		}
+	}
+	return purged, nil
+}
+
+func purgePartners(ctx context.Context, cutoff string) (int, error) {
+	purged, err := purgeTable(ctx, partnersTable, cutoff)
+	return len(purged), err
+}
+
+// purgeLeads deletes expired leads. Converted leads are never deleted, so
+// no referral is left pointing at a purged lead.
+func purgeLeads(ctx context.Context, cutoff string) (int, error) {
+	purged, err := purgeRecords(ctx, leadDataTable, "METADATA#", cutoff)
+	return len(purged), err
+}
+
+// purgeCustomers deletes expired customers and then the email and phone
+// claims that still point at them.
+func purgeCustomers(ctx context.Context, cutoff string) (int, error) {
+	purged, err := purgeTable(ctx, customersTable, cutoff)
+	if err != nil || len(purged) == 0 {
+		return len(purged), err
+	}
+	gone := map[string]bool{}
+	for _, r := range purged {
+		gone[r.ID] = true
+	}
+	var keys []map[string]types.AttributeValue
+	p := dynamodb.NewScanPaginator(ddb, &dynamodb.ScanInput{
+		TableName:        aws.String(customersTable),
+		FilterExpression: aws.String("SK = :unique"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":unique": &types.AttributeValueMemberS{Value: "UNIQUE"},
+		},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return len(purged), err
+		}
+		var claims []struct {
+			PK         string `dynamodbav:"PK"`
+			SK         string `dynamodbav:"SK"`
+			CustomerID string `dynamodbav:"customerId"`
+		}
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &claims); err != nil {
+			return len(purged), err
+		}
+		for _, c := range claims {
+			if gone[c.CustomerID] {
+				keys = append(keys, itemKey(c.PK, c.SK))
+			}
+		}
+	}
+	return len(purged), batchDelete(ctx, customersTable, keys)
+}
+
+// purgeUsers deletes expired user profiles, the downline edges in their
+// partition and the edges that place them under their uplines. Members
+// that still name a purged user as upline keep the ID until their profile
+// is next saved, when validation asks for a new upline.
+func purgeUsers(ctx context.Context, cutoff string) (int, error) {
+	purged, err := purgeTable(ctx, userProfileTable, cutoff)
+	if err != nil {
+		return len(purged), err
+	}
+	var keys []map[string]types.AttributeValue
+	for _, r := range purged {
+		for _, u := range []struct{ relation, id string }{
+			{"EVC", r.UplineEVC},
+			{"SMD", r.UplineSMD},
+		} {
+			if u.id != "" {
+				keys = append(keys, itemKey(fmt.Sprintf("USER#%s", u.id), fmt.Sprintf("DOWNLINE#%s#%s", r.ID, u.relation)))
+			}
+		}
+		p := dynamodb.NewQueryPaginator(ddb, &dynamodb.QueryInput{
+			TableName:              aws.String(userProfileTable),
+			KeyConditionExpression: aws.String("PK = :pk"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":pk": &types.AttributeValueMemberS{Value: r.PK},
+			},
+			ProjectionExpression: aws.String("PK, SK"),
+		})
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			if err != nil {
+				return len(purged), err
+			}
+			for _, item := range out.Items {
+				keys = append(keys, map[string]types.AttributeValue{"PK": item["PK"], "SK": item["SK"]})
+			}
+		}
+	}
+	return len(purged), batchDelete(ctx, userProfileTable, keys)
+}
+
+// batchDelete deletes keys from table in BatchWriteItem-sized chunks,
+// resubmitting whatever DynamoDB leaves unprocessed.
+func batchDelete(ctx context.Context, table string, keys []map[string]types.AttributeValue) error {
+	for len(keys) > 0 {
+		n := min(len(keys), batchWriteLimit)
+		var reqs []types.WriteRequest
+		for _, k := range keys[:n] {
+			reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: k}})
+		}
+		keys = keys[n:]
+		batch := map[string][]types.WriteRequest{table: reqs}
+		for len(batch) > 0 {
+			out, err := ddb.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: batch})
+			if err != nil {
+				return err
+			}
+			batch = out.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+func itemKey(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: pk},
+		"SK": &types.AttributeValueMemberS{Value: sk},
+	}
+}
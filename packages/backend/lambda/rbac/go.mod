@@ -0,0 +1,3 @@
+module rbac
+
+go 1.24.3
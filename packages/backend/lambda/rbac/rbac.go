@@ -0,0 +1,196 @@
+// Package rbac is the access policy every Lambda consults: which roles may
+// perform each action, and which action each route performs.
+//
+// The roles are the ones in app_design/Implementation_Plan.md: owner (the
+// user a record belongs to), admins, team_lead and authenticated (any
+// signed-in user), plus partner for calls made with a partner credential
+// and anyone for the few routes that take no identity at all.
+package rbac
+
+import "errors"
+
+// Role is a role a caller can hold for an action.
+type Role string
+
+const (
+	Owner         Role = "owner"
+	Admins        Role = "admins"
+	TeamLead      Role = "team_lead"
+	Authenticated Role = "authenticated"
+	Partner       Role = "partner"
+	Anyone        Role = "anyone"
+)
+
+// Action is a resource and what is done to it, as "resource:verb".
+type Action string
+
+// Policy lists the roles allowed to perform each action. An action that is
+// not listed is allowed to no one.
+var Policy = map[Action][]Role{
+	"users:read":         {Owner, Admins},
+	"users:update":       {Owner, Admins},
+	"users:delete":       {Owner, Admins},
+	"users:restore":      {Admins},
+	"notifications:read": {Owner, Admins},
+
+	// Only users choose where their money goes; admins can take a bad
+	// account off file.
+	"bank-accounts:update": {Owner},
+	"bank-accounts:delete": {Owner, Admins},
+
+	"payments:list":   {Admins},
+	"payments:read":   {Owner, Admins},
+	"payments:create": {Admins},
+	"payments:update": {Admins},
+
+	"partners:read":    {Authenticated},
+	"partners:create":  {Admins},
+	"partners:update":  {Admins},
+	"partners:delete":  {Admins},
+	"partners:restore": {Admins},
+	// Everyone signed in sees ACTIVE partners; drafts and partners waiting on
+	// approval are only for admins, who alone can take a partner live.
+	"partners:review":  {Admins},
+	"partners:approve": {Admins},
+
+	"webhooks:read":   {Admins},
+	"webhooks:update": {Admins},
+	"webhooks:replay": {Admins},
+
+	"credentials:read":   {Admins},
+	"credentials:create": {Admins},
+	"credentials:rotate": {Admins},
+	"credentials:revoke": {Admins},
+
+	"customers:read":    {Owner, Admins},
+	"customers:create":  {Authenticated},
+	"customers:update":  {Owner, Admins},
+	"customers:delete":  {Owner, Admins},
+	"customers:restore": {Admins},
+	"customers:merge":   {Admins},
+
+	"partner-customers:read": {Admins},
+
+	"team:read":     {TeamLead, Admins},
+	"downline:read": {Owner, Admins},
+
+	"leads:read":    {Owner, Admins},
+	"leads:create":  {Authenticated},
+	"leads:update":  {Owner, Admins},
+	"leads:delete":  {Owner, Admins},
+	"leads:convert": {Owner, Admins},
+	"leads:restore": {Admins},
+
+	"referrals:read":   {Owner, Admins},
+	"referrals:create": {Authenticated},
+	"referrals:update": {Admins},
+	"metrics:read":     {Owner, Admins},
+
+	"audit:read": {Admins},
+
+	"docusign:create":   {Authenticated},
+	"docusign:read":     {Authenticated},
+	"docusign:callback": {Anyone},
+
+	"bonus-pools:read":   {TeamLead, Admins},
+	"bonus-pools:create": {Admins},
+	"bonus-pools:update": {Admins},
+	"reports:read":       {TeamLead, Admins},
+
+	"partner-api:read":   {Partner},
+	"partner-api:update": {Partner},
+}
+
+var (
+	// ErrUnauthenticated means the action needs an identity the caller did
+	// not present.
+	ErrUnauthenticated = errors.New("rbac: unauthenticated")
+	// ErrForbidden means the caller holds none of the action's roles.
+	ErrForbidden = errors.New("rbac: forbidden")
+	// ErrNoRoute means the route is not in Routes.
+	ErrNoRoute = errors.New("rbac: unknown route")
+)
+
+// Identity is who is calling: a Cognito user with its groups, or a partner
+// authenticated with its credential.
+type Identity struct {
+	Sub       string
+	Groups    []string
+	PartnerID string
+}
+
+func (id Identity) inGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Has reports whether id holds role for a record belonging to owner. owner
+// is the record's user ID, or "" when there is none.
+func (id Identity) Has(role Role, owner string) bool {
+	switch role {
+	case Owner:
+		return id.Sub != "" && id.Sub == owner
+	case Admins, TeamLead:
+		return id.Sub != "" && id.inGroup(string(role))
+	case Authenticated:
+		return id.Sub != ""
+	case Partner:
+		return id.PartnerID != ""
+	case Anyone:
+		return true
+	}
+	return false
+}
+
+// Allowed reports whether id may perform action on a record belonging to
+// owner.
+func Allowed(id Identity, action Action, owner string) bool {
+	for _, role := range Policy[action] {
+		if id.Has(role, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check decides whether id may call route (see Routes) with the given path
+// parameters. Owner rules are settled with the route's owner parameter. On
+// routes whose owner is only known once the record is loaded, a signed-in
+// caller is let through and the handler must call Allowed with the
+// record's owner.
+func Check(id Identity, route string, params map[string]string) (Action, error) {
+	r, ok := Routes[route]
+	if !ok {
+		return "", ErrNoRoute
+	}
+	owner := ""
+	switch {
+	case r.OwnerParam != "":
+		owner = params[r.OwnerParam]
+	case r.Scoped:
+		owner = id.Sub
+	}
+	if Allowed(id, r.Action, owner) {
+		return r.Action, nil
+	}
+	if r.OwnerInRecord && id.Sub != "" && permits(r.Action, Owner) {
+		return r.Action, nil
+	}
+	if id.Sub == "" && id.PartnerID == "" {
+		return r.Action, ErrUnauthenticated
+	}
+	return r.Action, ErrForbidden
+}
+
+func permits(action Action, role Role) bool {
+	for _, r := range Policy[action] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package rbac
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The personas every route is checked with. owner is the user named by the
+// route's owner parameter, or the owner of the record it loads.
+var personas = map[string]Identity{
+	"anon":    {},
+	"owner":   {Sub: "u1"},
+	"other":   {Sub: "u2"},
+	"lead":    {Sub: "t1", Groups: []string{"team_lead"}},
+	"admin":   {Sub: "a1", Groups: []string{"admins"}},
+	"partner": {PartnerID: "p1"},
+}
+
+// Groups of personas, to keep the matrix readable.
+var (
+	signedIn = []string{"owner", "other", "lead", "admin"}
+	self     = []string{"owner", "admin"}
+	admins   = []string{"admin"}
+	leads    = []string{"lead", "admin"}
+	partners = []string{"partner"}
+	everyone = []string{"anon", "owner", "other", "lead", "admin", "partner"}
+)
+
+// matrix lists, for every route, the personas Check lets through. On
+// OwnerInRecord routes that includes every signed-in caller; TestRecordOwner
+// covers the handlers' follow-up check.
+var matrix = map[string][]string{
+	"GET /users/{userId}":               self,
+	"PUT /users/{userId}":               self,
+	"PATCH /users/{userId}":             self,
+	"DELETE /users/{userId}":            self,
+	"POST /users/{userId}/restore":      admins,
+	"GET /users/{userId}/notifications": self,
+	"GET /users/{userId}/payments":      self,
+	"GET /payments":                     admins,
+	"POST /payments":                    admins,
+	"GET /payments/{paymentId}":         signedIn,
+	"PUT /payments/{paymentId}":         admins,
+	"PATCH /payments/{paymentId}":       admins,
+
+	"PUT /users/{userId}/bank-account":    {"owner"},
+	"DELETE /users/{userId}/bank-account": self,
+
+	"GET /partners":                                                     signedIn,
+	"POST /partners":                                                    admins,
+	"GET /partners/{partnerId}":                                         signedIn,
+	"PUT /partners/{partnerId}":                                         admins,
+	"PATCH /partners/{partnerId}":                                       admins,
+	"DELETE /partners/{partnerId}":                                      admins,
+	"POST /partners/{partnerId}/restore":                                admins,
+	"POST /partners/{partnerId}/status":                                 admins,
+	"POST /partners/{partnerId}/webhook-secret":                         admins,
+	"GET /partners/{partnerId}/webhook-deliveries":                      admins,
+	"POST /partners/{partnerId}/webhook-deliveries/{deliveryId}/replay": admins,
+	"GET /webhook-dead-letters":                                         admins,
+	"GET /partners/{partnerId}/credentials":                             admins,
+	"POST /partners/{partnerId}/credentials":                            admins,
+	"POST /partners/{partnerId}/credentials/{credentialId}/rotate":      admins,
+	"DELETE /partners/{partnerId}/credentials/{credentialId}":           admins,
+	"GET /partner-api/partner":                                          partners,
+	"GET /partner-api/referrals":                                        partners,
+	"POST /partner-api/referrals/{referralId}/status":                   partners,
+
+	"GET /customers":                        signedIn,
+	"POST /customers":                       signedIn,
+	"GET /customers/{customerId}":           signedIn,
+	"PUT /customers/{customerId}":           signedIn,
+	"PATCH /customers/{customerId}":         signedIn,
+	"DELETE /customers/{customerId}":        signedIn,
+	"POST /customers/{customerId}/restore":  admins,
+	"GET /customers/{customerId}/referrals": signedIn,
+	"POST /customers/{customerId}/merge":    admins,
+	"GET /partners/{partnerId}/customers":   admins,
+	"GET /partner-api/customers":            partners,
+
+	"GET /lead/users":                   leads,
+	"GET /lead/users/{userId}/downline": self,
+	"GET /leads":                        signedIn,
+	"POST /leads":                       signedIn,
+	"GET /leads/{leadId}":               signedIn,
+	"PUT /leads/{leadId}":               signedIn,
+	"DELETE /leads/{leadId}":            signedIn,
+	"POST /leads/{leadId}/convert":      signedIn,
+	"POST /leads/{leadId}/restore":      admins,
+
+	"GET /audit/entities/{entityType}/{entityId}": admins,
+	"GET /audit/actors/{actor}":                   admins,
+	"POST /docusign/envelopes":                    signedIn,
+	"GET /docusign/envelopes/{envelopeId}":        signedIn,
+	"POST /docusign/callback":                     everyone,
+	"GET /bonus-pools":                            leads,
+	"POST /bonus-pools":                           admins,
+	"GET /bonus-pools/{poolId}":                   leads,
+	"PUT /bonus-pools/{poolId}":                   admins,
+	"GET /bonus-pools/{poolId}/report":            leads,
+
+	"Query.referrals":               signedIn,
+	"Query.referral":                signedIn,
+	"Query.payments":                signedIn,
+	"Query.dashboardMetrics":        signedIn,
+	"Query.earningsByMonth":         signedIn,
+	"Mutation.createReferral":       signedIn,
+	"Mutation.updateReferralStatus": admins,
+}
+
+func TestCheckMatrix(t *testing.T) {
+	for route, allowed := range matrix {
+		r, ok := Routes[route]
+		if !ok {
+			t.Errorf("%s: in the matrix but not in Routes", route)
+			continue
+		}
+		params := map[string]string{}
+		if r.OwnerParam != "" {
+			params[r.OwnerParam] = personas["owner"].Sub
+		}
+		for name, id := range personas {
+			_, err := Check(id, route, params)
+			want := contains(allowed, name)
+			switch {
+			case want && err != nil:
+				t.Errorf("%s as %s: got %v, want allowed", route, name, err)
+			case !want && name == "anon" && !errors.Is(err, ErrUnauthenticated):
+				t.Errorf("%s as anon: got %v, want ErrUnauthenticated", route, err)
+			case !want && name != "anon" && !errors.Is(err, ErrForbidden):
+				t.Errorf("%s as %s: got %v, want ErrForbidden", route, name, err)
+			}
+		}
+	}
+	for route := range Routes {
+		if _, ok := matrix[route]; !ok {
+			t.Errorf("%s: in Routes but not in the matrix", route)
+		}
+	}
+}
+
+// TestRecordOwner covers what handlers decide once they have loaded the
+// record on OwnerInRecord routes: only its owner and admins get through.
+func TestRecordOwner(t *testing.T) {
+	for route, r := range Routes {
+		if !r.OwnerInRecord {
+			continue
+		}
+		for name, id := range personas {
+			got := Allowed(id, r.Action, personas["owner"].Sub)
+			if want := contains(self, name); got != want {
+				t.Errorf("%s as %s on owner's record: allowed %v, want %v", route, name, got, want)
+			}
+		}
+	}
+}
+
+// TestScopedWidening covers the lists scoped to the caller: only admins see
+// everyone's records.
+func TestScopedWidening(t *testing.T) {
+	for route, r := range Routes {
+		if !r.Scoped {
+			continue
+		}
+		for name, id := range personas {
+			if got, want := Allowed(id, r.Action, ""), name == "admin"; got != want {
+				t.Errorf("%s as %s unscoped: allowed %v, want %v", route, name, got, want)
+			}
+		}
+	}
+}
+
+func TestRoutesHaveKnownActions(t *testing.T) {
+	for route, r := range Routes {
+		if len(Policy[r.Action]) == 0 {
+			t.Errorf("%s: action %q is not in Policy", route, r.Action)
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	if _, err := Check(personas["admin"], "GET /nowhere", nil); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("got %v, want ErrNoRoute", err)
+	}
+}
+
+var (
+	restRoute = regexp.MustCompile(`req\.Resource == "([^"]+)" && req\.HTTPMethod == http\.Method(\w+)`)
+	stubRoute = regexp.MustCompile(`http\.Method(\w+) \+ " (/[^"]+)":`)
+	resolver  = regexp.MustCompile(`typeName: '(\w+)',\s*fieldName: '(\w+)'`)
+)
+
+// TestEveryRouteIsDeclared reads the routes the Lambdas dispatch on and the
+// AppSync resolvers the stack wires up, and fails for any that Routes lacks.
+func TestEveryRouteIsDeclared(t *testing.T) {
+	var found []string
+	mains, err := filepath.Glob("../*/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range mains {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range restRoute.FindAllStringSubmatch(string(src), -1) {
+			found = append(found, strings.ToUpper(m[2])+" "+m[1])
+		}
+		for _, m := range stubRoute.FindAllStringSubmatch(string(src), -1) {
+			found = append(found, strings.ToUpper(m[1])+" "+m[2])
+		}
+	}
+	stack, err := os.ReadFile("../../lib/miliare-backend-stack.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range resolver.FindAllStringSubmatch(string(stack), -1) {
+		found = append(found, m[1]+"."+m[2])
+	}
+	if len(found) < len(Routes) {
+		t.Errorf("found %d routes in the sources, fewer than the %d declared", len(found), len(Routes))
+	}
+	sort.Strings(found)
+	for _, route := range found {
+		if _, ok := Routes[route]; !ok {
+			t.Errorf("%s is served but not in Routes", route)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package rbac
+
+// Route is the action a route performs and where the owner of what it acts
+// on comes from, for the owner role.
+type Route struct {
+	Action Action
+	// OwnerParam names the path parameter holding the owner's user ID.
+	OwnerParam string
+	// OwnerInRecord marks routes whose owner is a field of the record they
+	// load; the handler settles the owner role with Allowed.
+	OwnerInRecord bool
+	// Scoped marks routes that only ever act on the caller's own records,
+	// which the caller therefore owns. Handlers widen them for callers with
+	// another of the action's roles.
+	Scoped bool
+}
+
+// Routes maps every REST route, "METHOD /resource" as in API Gateway's
+// resource path, and every AppSync field, "Type.field", to its Route.
+var Routes = map[string]Route{
+	// profile
+	"GET /users/{userId}":               {Action: "users:read", OwnerParam: "userId"},
+	"PUT /users/{userId}":               {Action: "users:update", OwnerParam: "userId"},
+	"PATCH /users/{userId}":             {Action: "users:update", OwnerParam: "userId"},
+	"DELETE /users/{userId}":            {Action: "users:delete", OwnerParam: "userId"},
+	"POST /users/{userId}/restore":      {Action: "users:restore"},
+	"GET /users/{userId}/notifications": {Action: "notifications:read", OwnerParam: "userId"},
+	"GET /users/{userId}/payments":      {Action: "payments:read", OwnerParam: "userId"},
+	"GET /payments":                     {Action: "payments:list"},
+	"POST /payments":                    {Action: "payments:create"},
+	"GET /payments/{paymentId}":         {Action: "payments:read", OwnerInRecord: true},
+	"PUT /payments/{paymentId}":         {Action: "payments:update"},
+	"PATCH /payments/{paymentId}":       {Action: "payments:update"},
+
+	"PUT /users/{userId}/bank-account":    {Action: "bank-accounts:update", OwnerParam: "userId"},
+	"DELETE /users/{userId}/bank-account": {Action: "bank-accounts:delete", OwnerParam: "userId"},
+
+	// partner
+	"GET /partners":                                                     {Action: "partners:read"},
+	"POST /partners":                                                    {Action: "partners:create"},
+	"GET /partners/{partnerId}":                                         {Action: "partners:read"},
+	"PUT /partners/{partnerId}":                                         {Action: "partners:update"},
+	"PATCH /partners/{partnerId}":                                       {Action: "partners:update"},
+	"DELETE /partners/{partnerId}":                                      {Action: "partners:delete"},
+	"POST /partners/{partnerId}/restore":                                {Action: "partners:restore"},
+	"POST /partners/{partnerId}/status":                                 {Action: "partners:update"},
+	"POST /partners/{partnerId}/webhook-secret":                         {Action: "webhooks:update"},
+	"GET /partners/{partnerId}/webhook-deliveries":                      {Action: "webhooks:read"},
+	"POST /partners/{partnerId}/webhook-deliveries/{deliveryId}/replay": {Action: "webhooks:replay"},
+	"GET /webhook-dead-letters":                                         {Action: "webhooks:read"},
+	"GET /partners/{partnerId}/credentials":                             {Action: "credentials:read"},
+	"POST /partners/{partnerId}/credentials":                            {Action: "credentials:create"},
+	"POST /partners/{partnerId}/credentials/{credentialId}/rotate":      {Action: "credentials:rotate"},
+	"DELETE /partners/{partnerId}/credentials/{credentialId}":           {Action: "credentials:revoke"},
+	"GET /partner-api/partner":                                          {Action: "partner-api:read"},
+	"GET /partner-api/referrals":                                        {Action: "partner-api:read"},
+	"POST /partner-api/referrals/{referralId}/status":                   {Action: "partner-api:update"},
+
+	// customer
+	"GET /customers":                        {Action: "customers:read", Scoped: true},
+	"POST /customers":                       {Action: "customers:create"},
+	"GET /customers/{customerId}":           {Action: "customers:read", OwnerInRecord: true},
+	"PUT /customers/{customerId}":           {Action: "customers:update", OwnerInRecord: true},
+	"PATCH /customers/{customerId}":         {Action: "customers:update", OwnerInRecord: true},
+	"DELETE /customers/{customerId}":        {Action: "customers:delete", OwnerInRecord: true},
+	"POST /customers/{customerId}/restore":  {Action: "customers:restore"},
+	"GET /customers/{customerId}/referrals": {Action: "customers:read", OwnerInRecord: true},
+	"POST /customers/{customerId}/merge":    {Action: "customers:merge"},
+	"GET /partners/{partnerId}/customers":   {Action: "partner-customers:read"},
+	"GET /partner-api/customers":            {Action: "partner-api:read"},
+
+	// lead
+	"GET /lead/users":                   {Action: "team:read"},
+	"GET /lead/users/{userId}/downline": {Action: "downline:read", OwnerParam: "userId"},
+	"GET /leads":                        {Action: "leads:read", Scoped: true},
+	"POST /leads":                       {Action: "leads:create"},
+	"GET /leads/{leadId}":               {Action: "leads:read", OwnerInRecord: true},
+	"PUT /leads/{leadId}":               {Action: "leads:update", OwnerInRecord: true},
+	"DELETE /leads/{leadId}":            {Action: "leads:delete", OwnerInRecord: true},
+	"POST /leads/{leadId}/convert":      {Action: "leads:convert", OwnerInRecord: true},
+	"POST /leads/{leadId}/restore":      {Action: "leads:restore"},
+
+	// ops
+	"GET /audit/entities/{entityType}/{entityId}": {Action: "audit:read"},
+	"GET /audit/actors/{actor}":                   {Action: "audit:read"},
+	"POST /docusign/envelopes":                    {Action: "docusign:create"},
+	"GET /docusign/envelopes/{envelopeId}":        {Action: "docusign:read"},
+	"POST /docusign/callback":                     {Action: "docusign:callback"},
+	"GET /bonus-pools":                            {Action: "bonus-pools:read"},
+	"POST /bonus-pools":                           {Action: "bonus-pools:create"},
+	"GET /bonus-pools/{poolId}":                   {Action: "bonus-pools:read"},
+	"PUT /bonus-pools/{poolId}":                   {Action: "bonus-pools:update"},
+	"GET /bonus-pools/{poolId}/report":            {Action: "reports:read"},
+
+	// user (AppSync)
+	"Query.referrals":               {Action: "referrals:read", Scoped: true},
+	"Query.referral":                {Action: "referrals:read", OwnerInRecord: true},
+	"Query.payments":                {Action: "payments:read", Scoped: true},
+	"Query.dashboardMetrics":        {Action: "metrics:read", Scoped: true},
+	"Query.earningsByMonth":         {Action: "metrics:read", Scoped: true},
+	"Mutation.createReferral":       {Action: "referrals:create"},
+	"Mutation.updateReferralStatus": {Action: "referrals:update"},
+}
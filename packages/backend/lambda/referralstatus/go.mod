@@ -0,0 +1,3 @@
+module referralstatus
+
+go 1.24.3
@@ -0,0 +1,46 @@
+// Package referralstatus is the referral status lifecycle shared by the
+// Lambdas that change a referral's status.
+//
+// Partners move their referrals only along Transitions. Staff, through
+// updateReferralStatus, may set any known status, so they can correct a
+// referral a partner moved by mistake (PAID back to IN_REVIEW, say).
+package referralstatus
+
+// Referral statuses.
+const (
+	InProgress = "IN_PROGRESS"
+	InReview   = "IN_REVIEW"
+	Paid       = "PAID"
+	Rejected   = "REJECTED"
+)
+
+// Statuses are the known referral statuses, in lifecycle order.
+var Statuses = []string{InProgress, InReview, Paid, Rejected}
+
+// Transitions is the referral state machine: the statuses each status can
+// move to. PAID and REJECTED are final.
+var Transitions = map[string][]string{
+	InProgress: {InReview, Rejected},
+	InReview:   {Paid, Rejected},
+}
+
+// Known reports whether status is a referral status.
+func Known(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransition reports whether the state machine lets a referral move
+// from one status to another.
+func CanTransition(from, to string) bool {
+	for _, s := range Transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package referralstatus
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{InProgress, InReview}: true,
+		{InProgress, Rejected}: true,
+		{InReview, Paid}:       true,
+		{InReview, Rejected}:   true,
+	}
+	for _, from := range Statuses {
+		for _, to := range Statuses {
+			if got := CanTransition(from, to); got != allowed[[2]string{from, to}] {
+				t.Errorf("CanTransition(%s, %s) = %t", from, to, got)
+			}
+		}
+	}
+	if CanTransition("", InReview) || CanTransition(InProgress, "APPROVED") {
+		t.Error("unknown statuses must not transition")
+	}
+}
+
+// Every status a transition names is known, and the final statuses have no
+// way out.
+func TestTransitionsUseKnownStatuses(t *testing.T) {
+	for from, tos := range Transitions {
+		if !Known(from) {
+			t.Errorf("unknown status %q", from)
+		}
+		for _, to := range tos {
+			if !Known(to) {
+				t.Errorf("unknown status %q", to)
+			}
+		}
+	}
+	for _, s := range []string{Paid, Rejected} {
+		if len(Transitions[s]) > 0 {
+			t.Errorf("%s is not final", s)
+		}
+	}
+	if Known("APPROVED") || Known("paid") {
+		t.Error("Known accepts an unknown status")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Domain event types, used as the EventBridge detail-type.
+const (
+	referralCreated       = "ReferralCreated"
+	referralStatusChanged = "ReferralStatusChanged"
+	referralPaid          = "ReferralPaid"
+	paymentProcessed      = "PaymentProcessed"
+)
+
+// domainEvent is one business fact derived from a table change, or a
+// relayed outbox message. ID is the stream record's eventID with the type
+// appended, or the message's deduplication key, so it is stable across
+// redeliveries and consumers can use it to drop duplicates.
+type domainEvent struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	OccurredAt string      `json:"occurredAt"`
+	Detail     interface{} `json:"detail"`
+}
+
+// referral holds the referral attributes carried by the referral events.
+type referral struct {
+	ID         string  `json:"id"`
+	UserID     string  `json:"userId"`
+	CompanyID  string  `json:"companyId"`
+	CustomerID string  `json:"customerId,omitempty"`
+	LeadID     string  `json:"leadId,omitempty"`
+	ClientName string  `json:"clientName"`
+	Status     string  `json:"status"`
+	Amount     float64 `json:"amount,omitempty"`
+	PaidAt     string  `json:"paidAt,omitempty"`
+}
+
+// statusChange is the detail of ReferralStatusChanged: the referral after
+// the change and the status it left.
+type statusChange struct {
+	*referral
+	PreviousStatus string `json:"previousStatus"`
+}
+
+// payment holds the payment attributes carried by PaymentProcessed.
+type payment struct {
+	ID          string  `json:"id"`
+	ReferralID  string  `json:"referralId"`
+	UserID      string  `json:"userId"`
+	Amount      float64 `json:"amount"`
+	Status      string  `json:"status"`
+	ProcessedAt string  `json:"processedAt,omitempty"`
+}
+
+// outboxMessage is a side effect recorded by the user and profile
+// functions in the same transaction as the write that caused it. Its ID is
+// the deduplication key and is passed on as the event ID.
+type outboxMessage struct {
+	ID        string      `json:"id"`
+	Topic     string      `json:"topic"`
+	Payload   interface{} `json:"payload"`
+	CreatedAt string      `json:"createdAt"`
+}
+
+// processedStatuses are the payment statuses that mean the money went out.
+// "Paid" is still written by older clients and counted by the dashboards.
+var processedStatuses = map[string]bool{"PROCESSED": true, "Paid": true}
+
+// domainEvents returns the events rec gives rise to, if any. Status events
+// are only emitted on the transition, so rewriting a paid referral or a
+// processed payment does not announce it again.
+func domainEvents(rec events.DynamoDBEventRecord) ([]domainEvent, error) {
+	pk := rec.Change.Keys["PK"]
+	if pk.DataType() != events.DataTypeString {
+		return nil, fmt.Errorf("record has no string PK")
+	}
+	at := rec.Change.ApproximateCreationDateTime.UTC().Format(time.RFC3339)
+	newEvent := func(typ string, detail interface{}) domainEvent {
+		return domainEvent{ID: rec.EventID + "#" + typ, Type: typ, OccurredAt: at, Detail: detail}
+	}
+
+	switch {
+	case strings.HasPrefix(pk.String(), "REFERRAL#"):
+		var before, after *referral
+		if err := decodeImages(rec, &before, &after); err != nil {
+			return nil, err
+		}
+		if after == nil {
+			return nil, nil
+		}
+		var out []domainEvent
+		if before == nil {
+			out = append(out, newEvent(referralCreated, after))
+		} else if before.Status != after.Status {
+			out = append(out, newEvent(referralStatusChanged, statusChange{referral: after, PreviousStatus: before.Status}))
+		}
+		if after.Status == "PAID" && (before == nil || before.Status != "PAID") {
+			out = append(out, newEvent(referralPaid, after))
+		}
+		return out, nil
+
+	case strings.HasPrefix(pk.String(), "PAYMENT#"):
+		var before, after *payment
+		if err := decodeImages(rec, &before, &after); err != nil {
+			return nil, err
+		}
+		if after == nil || !processedStatuses[after.Status] || (before != nil && processedStatuses[before.Status]) {
+			return nil, nil
+		}
+		return []domainEvent{newEvent(paymentProcessed, after)}, nil
+
+	case strings.HasPrefix(pk.String(), "OUTBOX#"):
+		// Outbox messages are relayed once, when they are written; the TTL
+		// removal that follows is ignored.
+		var before, after *outboxMessage
+		if err := decodeImages(rec, &before, &after); err != nil {
+			return nil, err
+		}
+		if before != nil || after == nil {
+			return nil, nil
+		}
+		return []domainEvent{{ID: after.ID, Type: after.Topic, OccurredAt: after.CreatedAt, Detail: after.Payload}}, nil
+	}
+	return nil, nil
+}
+
+// decodeImages decodes the old and new images of rec into before and after,
+// leaving either nil when the image is absent (an INSERT has no old image,
+// a REMOVE no new one).
+func decodeImages[T any](rec events.DynamoDBEventRecord, before, after **T) error {
+	for _, img := range []struct {
+		image map[string]events.DynamoDBAttributeValue
+		out   **T
+	}{{rec.Change.OldImage, before}, {rec.Change.NewImage, after}} {
+		if len(img.image) == 0 {
+			continue
+		}
+		item, err := toItem(img.image)
+		if err != nil {
+			return err
+		}
+		v := new(T)
+		if err := attributevalue.UnmarshalMapWithOptions(item, v, func(o *attributevalue.DecoderOptions) {
+			o.TagKey = "json"
+		}); err != nil {
+			return err
+		}
+		*img.out = v
+	}
+	return nil
+}
+
+// toItem converts a stream image, which uses the Lambda event types, into
+// the SDK's attribute values so the usual decoder can read it.
+func toItem(image map[string]events.DynamoDBAttributeValue) (map[string]types.AttributeValue, error) {
+	item := make(map[string]types.AttributeValue, len(image))
+	for name, av := range image {
+		v, err := toAttributeValue(av)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		item[name] = v
+	}
+	return item, nil
+}
+
+func toAttributeValue(av events.DynamoDBAttributeValue) (types.AttributeValue, error) {
+	switch av.DataType() {
+	case events.DataTypeString:
+		return &types.AttributeValueMemberS{Value: av.String()}, nil
+	case events.DataTypeNumber:
+		return &types.AttributeValueMemberN{Value: av.Number()}, nil
+	case events.DataTypeBoolean:
+		return &types.AttributeValueMemberBOOL{Value: av.Boolean()}, nil
+	case events.DataTypeNull:
+		return &types.AttributeValueMemberNULL{Value: true}, nil
+	case events.DataTypeBinary:
+		return &types.AttributeValueMemberB{Value: av.Binary()}, nil
+	case events.DataTypeStringSet:
+		return &types.AttributeValueMemberSS{Value: av.StringSet()}, nil
+	case events.DataTypeNumberSet:
+		return &types.AttributeValueMemberNS{Value: av.NumberSet()}, nil
+	case events.DataTypeBinarySet:
+		return &types.AttributeValueMemberBS{Value: av.BinarySet()}, nil
+	case events.DataTypeList:
+		list := make([]types.AttributeValue, 0, len(av.List()))
+		for _, el := range av.List() {
+			v, err := toAttributeValue(el)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return &types.AttributeValueMemberL{Value: list}, nil
+	case events.DataTypeMap:
+		m, err := toItem(av.Map())
+		if err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberM{Value: m}, nil
+	}
+	return nil, fmt.Errorf("unsupported attribute type %d", av.DataType())
+}
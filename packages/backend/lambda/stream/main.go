@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+)
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// bus receives the domain events: the EventBridge bus named by
+// EVENT_BUS_NAME, set up in main so tests can put a memoryBus in its place.
+var bus publisher
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
+}
+
+// handler turns the stream records of the referrals and payments tables
+// into domain events and relays the messages written to the outbox table.
+// Records whose events could not be published are reported back so Lambda
+// retries from the first of them; records that cannot be decoded are logged
+// and skipped, as a retry would not help.
+func handler(ctx context.Context, e events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	resp := events.DynamoDBEventResponse{BatchItemFailures: []events.DynamoDBBatchItemFailure{}}
+	for _, rec := range e.Records {
+		evts, err := domainEvents(rec)
+		if err != nil {
+			logger.ErrorContext(ctx, "skipping undecodable stream record",
+				slog.String("eventId", rec.EventID),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		if len(evts) == 0 {
+			continue
+		}
+		if err := bus.Publish(ctx, evts...); err != nil {
+			logger.ErrorContext(ctx, "publish failed",
+				slog.String("eventId", rec.EventID),
+				slog.String("error", err.Error()),
+			)
+			// Records of a shard are processed in order, so everything
+			// from here on is retried.
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.DynamoDBBatchItemFailure{ItemIdentifier: rec.Change.SequenceNumber})
+			return resp, nil
+		}
+		for _, evt := range evts {
+			logger.InfoContext(ctx, "domain event published",
+				slog.String("id", evt.ID),
+				slog.String("type", evt.Type),
+			)
+		}
+	}
+	return resp, nil
+}
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	bus = &eventBridgePublisher{client: eventbridge.NewFromConfig(cfg), busName: getenv("EVENT_BUS_NAME")}
+	lambda.Start(handler)
+}
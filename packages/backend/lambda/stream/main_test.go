@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var changedAt = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+type image map[string]events.DynamoDBAttributeValue
+
+// record builds a stream record for the item with primary key pk. A nil old
+// image makes an INSERT, a nil new image a REMOVE.
+func record(id, pk string, old, new image) events.DynamoDBEventRecord {
+	name := "MODIFY"
+	switch {
+	case old == nil:
+		name = "INSERT"
+	case new == nil:
+		name = "REMOVE"
+	}
+	return events.DynamoDBEventRecord{
+		EventID:   id,
+		EventName: name,
+		Change: events.DynamoDBStreamRecord{
+			ApproximateCreationDateTime: events.SecondsEpochTime{Time: changedAt},
+			Keys:                        map[string]events.DynamoDBAttributeValue{"PK": events.NewStringAttribute(pk)},
+			OldImage:                    old,
+			NewImage:                    new,
+			SequenceNumber:              "seq-" + id,
+		},
+	}
+}
+
+func referralImage(status string) image {
+	return image{
+		"PK":         events.NewStringAttribute("REFERRAL#r1"),
+		"id":         events.NewStringAttribute("r1"),
+		"userId":     events.NewStringAttribute("u1"),
+		"companyId":  events.NewStringAttribute("p1"),
+		"clientName": events.NewStringAttribute("Ada"),
+		"status":     events.NewStringAttribute(status),
+		"amount":     events.NewNumberAttribute("1500"),
+	}
+}
+
+func paymentImage(status string) image {
+	return image{
+		"PK":         events.NewStringAttribute("PAYMENT#pay1"),
+		"id":         events.NewStringAttribute("pay1"),
+		"referralId": events.NewStringAttribute("r1"),
+		"userId":     events.NewStringAttribute("u1"),
+		"amount":     events.NewNumberAttribute("1500"),
+		"status":     events.NewStringAttribute(status),
+	}
+}
+
+func outboxImage() image {
+	return image{
+		"PK":        events.NewStringAttribute("OUTBOX#m1"),
+		"id":        events.NewStringAttribute("referral-r1"),
+		"topic":     events.NewStringAttribute("notification.referralSubmitted"),
+		"createdAt": events.NewStringAttribute("2025-03-01T11:59:00Z"),
+		"payload": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+			"referralId": events.NewStringAttribute("r1"),
+		}),
+	}
+}
+
+// eventTypes lists the ID and type of each event.
+func eventTypes(evts []domainEvent) [][2]string {
+	var out [][2]string
+	for _, e := range evts {
+		out = append(out, [2]string{e.ID, e.Type})
+	}
+	return out
+}
+
+func TestDomainEvents(t *testing.T) {
+	cases := []struct {
+		name string
+		rec  events.DynamoDBEventRecord
+		want [][2]string
+	}{
+		{"referral insert", record("e1", "REFERRAL#r1", nil, referralImage("IN_PROGRESS")),
+			[][2]string{{"e1#ReferralCreated", referralCreated}}},
+		{"referral inserted paid", record("e1", "REFERRAL#r1", nil, referralImage("PAID")),
+			[][2]string{{"e1#ReferralCreated", referralCreated}, {"e1#ReferralPaid", referralPaid}}},
+		{"referral status change", record("e1", "REFERRAL#r1", referralImage("IN_PROGRESS"), referralImage("IN_REVIEW")),
+			[][2]string{{"e1#ReferralStatusChanged", referralStatusChanged}}},
+		{"referral paid", record("e1", "REFERRAL#r1", referralImage("APPROVED"), referralImage("PAID")),
+			[][2]string{{"e1#ReferralStatusChanged", referralStatusChanged}, {"e1#ReferralPaid", referralPaid}}},
+		{"referral rewritten", record("e1", "REFERRAL#r1", referralImage("PAID"), referralImage("PAID")), nil},
+		{"referral removed", record("e1", "REFERRAL#r1", referralImage("PAID"), nil), nil},
+		{"payment processed", record("e2", "PAYMENT#pay1", paymentImage("PENDING"), paymentImage("PROCESSED")),
+			[][2]string{{"e2#PaymentProcessed", paymentProcessed}}},
+		{"payment inserted processed", record("e2", "PAYMENT#pay1", nil, paymentImage("PROCESSED")),
+			[][2]string{{"e2#PaymentProcessed", paymentProcessed}}},
+		{"legacy Paid status", record("e2", "PAYMENT#pay1", paymentImage("PENDING"), paymentImage("Paid")),
+			[][2]string{{"e2#PaymentProcessed", paymentProcessed}}},
+		{"Paid rewritten as PROCESSED", record("e2", "PAYMENT#pay1", paymentImage("Paid"), paymentImage("PROCESSED")), nil},
+		{"payment pending", record("e2", "PAYMENT#pay1", nil, paymentImage("PENDING")), nil},
+		{"outbox insert", record("e3", "OUTBOX#m1", nil, outboxImage()),
+			[][2]string{{"referral-r1", "notification.referralSubmitted"}}},
+		{"outbox expiry", record("e3", "OUTBOX#m1", outboxImage(), nil), nil},
+		{"other table", record("e4", "USER#u1", nil, image{"PK": events.NewStringAttribute("USER#u1")}), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			evts, err := domainEvents(c.rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := eventTypes(evts); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("events = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDomainEventDetails(t *testing.T) {
+	evts, err := domainEvents(record("e1", "REFERRAL#r1", referralImage("IN_PROGRESS"), referralImage("IN_REVIEW")))
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("events = %v, %v", evts, err)
+	}
+	detail, _ := json.Marshal(evts[0].Detail)
+	var got map[string]interface{}
+	if err := json.Unmarshal(detail, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["status"] != "IN_REVIEW" || got["previousStatus"] != "IN_PROGRESS" || got["amount"] != 1500.0 {
+		t.Errorf("detail = %s", detail)
+	}
+	if evts[0].OccurredAt != "2025-03-01T12:00:00Z" {
+		t.Errorf("occurredAt = %s", evts[0].OccurredAt)
+	}
+
+	evts, err = domainEvents(record("e3", "OUTBOX#m1", nil, outboxImage()))
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("events = %v, %v", evts, err)
+	}
+	detail, _ = json.Marshal(evts[0].Detail)
+	if string(detail) != `{"referralId":"r1"}` || evts[0].OccurredAt != "2025-03-01T11:59:00Z" {
+		t.Errorf("relayed %s at %s", detail, evts[0].OccurredAt)
+	}
+}
+
+func TestHandlerPublishes(t *testing.T) {
+	mem := &memoryBus{}
+	bus = mem
+	resp, err := handler(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record("e1", "REFERRAL#r1", nil, referralImage("IN_PROGRESS")),
+		record("e2", "PAYMENT#pay1", nil, paymentImage("PENDING")),
+		record("e3", "OUTBOX#m1", nil, outboxImage()),
+	}})
+	if err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("handler = %v, %v", resp, err)
+	}
+	want := [][2]string{{"e1#ReferralCreated", referralCreated}, {"referral-r1", "notification.referralSubmitted"}}
+	if got := eventTypes(mem.Events()); !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+}
+
+func TestHandlerReportsFailedRecord(t *testing.T) {
+	bus = &memoryBus{Err: errors.New("bus unavailable")}
+	resp, err := handler(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record("e0", "USER#u1", nil, image{"PK": events.NewStringAttribute("USER#u1")}),
+		record("e1", "REFERRAL#r1", nil, referralImage("IN_PROGRESS")),
+		record("e2", "PAYMENT#pay1", nil, paymentImage("PROCESSED")),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The batch stops at the first failed record so it is retried from there.
+	want := []events.DynamoDBBatchItemFailure{{ItemIdentifier: "seq-e1"}}
+	if !reflect.DeepEqual(resp.BatchItemFailures, want) {
+		t.Errorf("failures = %v, want %v", resp.BatchItemFailures, want)
+	}
+}
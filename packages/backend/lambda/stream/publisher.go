@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// eventSource is the EventBridge source of every domain event; rules match
+// on it together with the detail-type.
+const eventSource = "miliare.referrals"
+
+// putEventsLimit is the most entries one PutEvents call accepts.
+const putEventsLimit = 10
+
+// publisher delivers domain events. Publish either delivers all of evts or
+// returns an error; a retry may deliver some of them twice, which consumers
+// handle through the event ID.
+type publisher interface {
+	Publish(ctx context.Context, evts ...domainEvent) error
+}
+
+// eventBridgePublisher puts events on an EventBridge bus.
+type eventBridgePublisher struct {
+	client  *eventbridge.Client
+	busName string
+}
+
+func (p *eventBridgePublisher) Publish(ctx context.Context, evts ...domainEvent) error {
+	for start := 0; start < len(evts); start += putEventsLimit {
+		end := min(start+putEventsLimit, len(evts))
+		entries := make([]ebtypes.PutEventsRequestEntry, 0, end-start)
+		for _, evt := range evts[start:end] {
+			detail, err := json.Marshal(evt)
+			if err != nil {
+				return err
+			}
+			at, _ := time.Parse(time.RFC3339, evt.OccurredAt)
+			entries = append(entries, ebtypes.PutEventsRequestEntry{
+				EventBusName: aws.String(p.busName),
+				Source:       aws.String(eventSource),
+				DetailType:   aws.String(evt.Type),
+				Detail:       aws.String(string(detail)),
+				Time:         aws.Time(at),
+			})
+		}
+		out, err := p.client.PutEvents(ctx, &eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return err
+		}
+		if out.FailedEntryCount > 0 {
+			for _, e := range out.Entries {
+				if e.ErrorCode != nil {
+					return fmt.Errorf("%d of %d events rejected: %s: %s", out.FailedEntryCount, len(entries), aws.ToString(e.ErrorCode), aws.ToString(e.ErrorMessage))
+				}
+			}
+			return fmt.Errorf("%d of %d events rejected", out.FailedEntryCount, len(entries))
+		}
+	}
+	return nil
+}
+
+// memoryBus keeps published events in memory. It stands in for EventBridge
+// in tests, where Events shows what the handler emitted.
+type memoryBus struct {
+	mu     sync.Mutex
+	events []domainEvent
+	// Err, when set, is returned by Publish instead of recording the events.
+	Err error
+}
+
+func (b *memoryBus) Publish(_ context.Context, evts ...domainEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Err != nil {
+		return b.Err
+	}
+	b.events = append(b.events, evts...)
+	return nil
+}
+
+// Events returns a copy of the events published so far.
+func (b *memoryBus) Events() []domainEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]domainEvent(nil), b.events...)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Create mutations accept an optional idempotencyKey. The record is written
+// in one transaction with an idempotency record holding the response, so a
+// retry with the same key and input gets the original response instead of
+// creating another record, and a retry with different input is rejected.
+// Keys are scoped to the mutation and the caller, and expire after
+// idempotencyTTL. PK IDEMPOTENCY#<operation>#<actor>#<key>, SK RESPONSE:
+// the same items the REST functions keep.
+
+const (
+	idempotencyTTL          = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+	idempotencyCompleted    = "COMPLETED"
+)
+
+type idempotencyRecord struct {
+	PK          string `dynamodbav:"PK"`
+	SK          string `dynamodbav:"SK"`
+	RequestHash string `dynamodbav:"requestHash"`
+	Status      string `dynamodbav:"status"`
+	Body        string `dynamodbav:"body,omitempty"`
+	CreatedAt   string `dynamodbav:"createdAt"`
+	ExpiresAt   int64  `dynamodbav:"expiresAt"`
+}
+
+// newIdempotencyRecord returns the record for key, identifying the request
+// by the hash of input.
+func newIdempotencyRecord(operation, actor, key string, input interface{}) (*idempotencyRecord, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, &userError{fmt.Sprintf("idempotencyKey must be at most %d characters", maxIdempotencyKeyLength)}
+	}
+	raw, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	now := time.Now().UTC()
+	return &idempotencyRecord{
+		PK:          fmt.Sprintf("IDEMPOTENCY#%s#%s#%s", operation, actor, key),
+		SK:          "RESPONSE",
+		RequestHash: hex.EncodeToString(sum[:]),
+		Status:      idempotencyCompleted,
+		CreatedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(idempotencyTTL).Unix(),
+	}, nil
+}
+
+// replayIdempotent decodes the response stored for rec's key into out and
+// reports whether there was one. A key used with different input is a
+// *userError.
+func replayIdempotent(ctx context.Context, rec *idempotencyRecord, out interface{}) (bool, error) {
+	res, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(idempotencyTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: rec.PK},
+			"SK": &types.AttributeValueMemberS{Value: rec.SK},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return false, err
+	}
+	var stored idempotencyRecord
+	if err := attributevalue.UnmarshalMap(res.Item, &stored); err != nil {
+		return false, err
+	}
+	// TTL deletion lags, so an expired record counts as absent.
+	if stored.ExpiresAt < time.Now().Unix() {
+		return false, nil
+	}
+	if stored.RequestHash != rec.RequestHash {
+		return false, &userError{"idempotencyKey was already used with different input"}
+	}
+	return true, json.Unmarshal([]byte(stored.Body), out)
+}
+
+// idempotencyWrite is the transaction item that stores response under rec's
+// key. It fails if a live record holds the key.
+func idempotencyWrite(rec idempotencyRecord, response interface{}) (types.TransactWriteItem, error) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	rec.Body = string(body)
+	item, err := attributevalue.MarshalMap(rec)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(idempotencyTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) OR expiresAt < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	}}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+type resolverHandler func(context.Context, AppSyncEvent) (interface{}, error)
+
+type requestLogKey struct{}
+
+// requestLog carries the request-scoped logger and correlation ID.
+type requestLog struct {
+	logger    *slog.Logger
+	requestID string
+}
+
+// userError is a resolver error about the caller's input. Its message is
+// returned as is rather than masked.
+type userError struct {
+	msg string
+}
+
+func (e *userError) Error() string { return e.msg }
+
+// withLogging logs every resolver invocation with the AppSync request ID, the
+// caller's sub, the field and the latency. Resolver errors other than
+// *userError are logged in full and replaced by a generic error carrying only
+// the correlation ID.
+func withLogging(next resolverHandler) resolverHandler {
+	return func(ctx context.Context, event AppSyncEvent) (interface{}, error) {
+		start := time.Now()
+		requestID := event.Request.Headers["x-amzn-requestid"]
+		l := logger.With(
+			slog.String("route", event.Info.ParentTypeName+"."+event.Info.FieldName),
+			slog.String("sub", event.Identity.Sub),
+		)
+		if lc, ok := lambdacontext.FromContext(ctx); ok {
+			l = l.With(slog.String("awsRequestId", lc.AwsRequestID))
+			if requestID == "" {
+				requestID = lc.AwsRequestID
+			}
+		}
+		l = l.With(slog.String("requestId", requestID))
+		ctx = context.WithValue(ctx, requestLogKey{}, requestLog{logger: l, requestID: requestID})
+
+		out, err := next(ctx, event)
+
+		latency := slog.Int64("latencyMs", time.Since(start).Milliseconds())
+		var ue *userError
+		if errors.As(err, &ue) {
+			l.WarnContext(ctx, "resolver rejected input", slog.String("error", ue.Error()), latency)
+			return nil, ue
+		}
+		if err != nil {
+			l.ErrorContext(ctx, "resolver failed", slog.String("error", err.Error()), latency)
+			return nil, fmt.Errorf("internal error (request id %s)", requestID)
+		}
+		l.InfoContext(ctx, "resolver completed", latency)
+		return out, nil
+	}
+}
+
+func requestLogFrom(ctx context.Context) requestLog {
+	if rl, ok := ctx.Value(requestLogKey{}).(requestLog); ok {
+		return rl
+	}
+	return requestLog{logger: logger}
+}
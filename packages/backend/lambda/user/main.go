@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -14,22 +16,33 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+
+	"api"
+	"rbac"
+	"referralstatus"
 )
 
 type AppSyncEvent struct {
 	Info struct {
-		FieldName string `json:"fieldName"`
+		FieldName      string `json:"fieldName"`
+		ParentTypeName string `json:"parentTypeName"`
 	} `json:"info"`
 	Arguments map[string]json.RawMessage `json:"arguments"`
 	Identity  struct {
-		Sub string `json:"sub"`
+		Sub    string   `json:"sub"`
+		Groups []string `json:"groups"`
 	} `json:"identity"`
+	Request struct {
+		Headers map[string]string `json:"headers"`
+	} `json:"request"`
 }
 
 type Referral struct {
 	ID         string  `json:"id"`
 	UserID     string  `json:"userId"`
 	CompanyID  string  `json:"companyId"`
+	CustomerID string  `json:"customerId,omitempty"`
+	LeadID     string  `json:"leadId,omitempty"`
 	ClientName string  `json:"clientName"`
 	Status     string  `json:"status"`
 	Amount     float64 `json:"amount,omitempty"`
@@ -37,16 +50,19 @@ type Referral struct {
 	UpdatedAt  string  `json:"updatedAt"`
 }
 
+// Payment is a payment as the profile function stores it; Amount is in
+// whole USD cents.
 type Payment struct {
-	ID         string  `json:"id"`
-	ReferralID string  `json:"referralId"`
-	UserID     string  `json:"userId"`
-	Amount     float64 `json:"amount"`
-	Date       string  `json:"date"`
-	Status     string  `json:"status"`
+	ID         string `json:"id"`
+	ReferralID string `json:"referralId"`
+	UserID     string `json:"userId"`
+	Amount     int64  `json:"amount"`
+	Date       string `json:"date"`
+	Status     string `json:"status"`
 }
 
-// DashboardMetrics provides enhanced analytics for the dashboard
+// DashboardMetrics provides enhanced analytics for the dashboard. Earnings
+// are in dollars.
 type DashboardMetrics struct {
 	TotalEarnings      float64 `json:"totalEarnings"`
 	PendingCommissions int     `json:"pendingCommissions"`
@@ -63,6 +79,9 @@ type MonthlyEarning struct {
 type CreateReferralInput struct {
 	CompanyID  string `json:"companyId"`
 	ClientName string `json:"clientName"`
+	// IdempotencyKey makes retries of the mutation return the referral
+	// created by the first call; see idempotency.go.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type UpdateReferralStatusInput struct {
@@ -71,9 +90,11 @@ type UpdateReferralStatusInput struct {
 }
 
 var (
-	ddb            *dynamodb.Client
-	referralsTable string
-	paymentsTable  string
+	ddb              *dynamodb.Client
+	referralsTable   string
+	paymentsTable    string
+	idempotencyTable string
+	partnersTable    string
 )
 
 func init() {
@@ -82,8 +103,11 @@ func init() {
 		panic(err)
 	}
 	ddb = dynamodb.NewFromConfig(cfg)
+	api.Use(ddb, api.Tables{Audit: os.Getenv("AUDIT_TABLE"), Outbox: os.Getenv("OUTBOX_TABLE")})
 	referralsTable = os.Getenv("REFERRALS_TABLE")
 	paymentsTable = os.Getenv("PAYMENTS_TABLE")
+	idempotencyTable = os.Getenv("IDEMPOTENCY_TABLE")
+	partnersTable = os.Getenv("PARTNERS_TABLE")
 }
 
 func handler(ctx context.Context, event AppSyncEvent) (interface{}, error) {
@@ -96,7 +120,11 @@ func handler(ctx context.Context, event AppSyncEvent) (interface{}, error) {
 			ID string `json:"id"`
 		}
 		json.Unmarshal(event.Arguments["id"], &args.ID)
-		return getReferral(ctx, args.ID)
+		r, err := getReferral(ctx, args.ID)
+		if err != nil || r == nil || !rbac.Allowed(identity(event), "referrals:read", r.UserID) {
+			return nil, err
+		}
+		return r, nil
 	case "payments":
 		return listPayments(ctx, userID)
 	case "dashboardMetrics":
@@ -110,16 +138,25 @@ func handler(ctx context.Context, event AppSyncEvent) (interface{}, error) {
 	case "createReferral":
 		var input CreateReferralInput
 		json.Unmarshal(event.Arguments["input"], &input)
-		return createReferral(ctx, userID, input)
+		return createReferral(ctx, userID, auditActor(event), input)
 	case "updateReferralStatus":
 		var input UpdateReferralStatusInput
 		json.Unmarshal(event.Arguments["input"], &input)
-		return updateReferralStatus(ctx, input)
+		return updateReferralStatus(ctx, auditActor(event), input)
 	default:
 		return nil, fmt.Errorf("unknown field %s", event.Info.FieldName)
 	}
 }
 
+// auditActor names the caller for the audit log: the Cognito sub, or "apikey"
+// for requests made with the API key.
+func auditActor(event AppSyncEvent) string {
+	if event.Identity.Sub != "" {
+		return event.Identity.Sub
+	}
+	return "apikey"
+}
+
 func listReferrals(ctx context.Context, userID string) ([]Referral, error) {
 	out, err := ddb.Scan(ctx, &dynamodb.ScanInput{
 		TableName:        aws.String(referralsTable),
@@ -177,7 +214,20 @@ func listPayments(ctx context.Context, userID string) ([]Payment, error) {
 	return payments, nil
 }
 
-func createReferral(ctx context.Context, userID string, input CreateReferralInput) (*Referral, error) {
+func createReferral(ctx context.Context, userID, actor string, input CreateReferralInput) (*Referral, error) {
+	var idem *idempotencyRecord
+	if input.IdempotencyKey != "" {
+		request := input
+		request.IdempotencyKey = ""
+		var err error
+		if idem, err = newIdempotencyRecord("createReferral", actor, input.IdempotencyKey, request); err != nil {
+			return nil, err
+		}
+		var prev Referral
+		if found, err := replayIdempotent(ctx, idem, &prev); found || err != nil {
+			return &prev, err
+		}
+	}
 	id := uuid.NewString()
 	now := time.Now().UTC().Format(time.RFC3339)
 	r := &Referral{
@@ -189,7 +239,7 @@ func createReferral(ctx context.Context, userID string, input CreateReferralInpu
 		CreatedAt:  now,
 		UpdatedAt:  now,
 	}
-	item, err := attributevalue.MarshalMap(struct {
+	item, err := api.MarshalItem(struct {
 		PK string `dynamodbav:"PK"`
 		SK string `dynamodbav:"SK"`
 		Referral
@@ -201,32 +251,104 @@ func createReferral(ctx context.Context, userID string, input CreateReferralInpu
 	if err != nil {
 		return nil, err
 	}
-	if _, err := ddb.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(referralsTable), Item: item}); err != nil {
+	event, err := api.NewAuditEvent(api.AuditReferral, id, actor, nil, r)
+	if err != nil {
+		return nil, err
+	}
+	// The partner is notified through the outbox, so the notification is
+	// recorded if and only if the referral is.
+	notify := api.NewOutboxMessage(api.TopicReferralSubmitted, r, id)
+	writes := []types.TransactWriteItem{
+		partnerAcceptsReferrals(input.CompanyID),
+		{Put: &types.Put{TableName: aws.String(referralsTable), Item: item}},
+	}
+	if idem != nil {
+		w, err := idempotencyWrite(*idem, r)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, w)
+	}
+	err = api.WriteWithOutbox(ctx, writes, []api.OutboxMessage{notify}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil, &userError{fmt.Sprintf("partner %s is not accepting referrals", input.CompanyID)}
+	}
+	var canceled *types.TransactionCanceledException
+	if idem != nil && errors.As(err, &canceled) {
+		// A concurrent call with the same key may have won.
+		var prev Referral
+		if found, rerr := replayIdempotent(ctx, idem, &prev); found || rerr != nil {
+			return &prev, rerr
+		}
+	}
+	if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-func updateReferralStatus(ctx context.Context, input UpdateReferralStatusInput) (*Referral, error) {
-	now := time.Now().UTC().Format(time.RFC3339)
-	_, err := ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+// partnerAcceptsReferrals checks, in the referral's transaction, that the
+// partner exists and is ACTIVE: drafts, partners awaiting approval and
+// deactivated or deleted partners take no new referrals.
+func partnerAcceptsReferrals(partnerID string) types.TransactWriteItem {
+	return types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		TableName: aws.String(partnersTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", partnerID)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", partnerID)},
+		},
+		ConditionExpression:      aws.String("#status = :active AND attribute_not_exists(deletedAt)"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: "ACTIVE"},
+		},
+	}}
+}
+
+// updateReferralStatus sets a referral's status and audits the change. It
+// returns nil if the referral does not exist. Staff may set any known
+// status, not only the partner's next steps, so they can correct a referral
+// moved by mistake.
+func updateReferralStatus(ctx context.Context, actor string, input UpdateReferralStatusInput) (*Referral, error) {
+	if !referralstatus.Known(input.Status) {
+		return nil, &userError{fmt.Sprintf("status must be one of %s", strings.Join(referralstatus.Statuses, ", "))}
+	}
+	before, err := getReferral(ctx, input.ID)
+	if err != nil || before == nil {
+		return nil, err
+	}
+	after := *before
+	after.Status = input.Status
+	after.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	event, err := api.NewAuditEvent(api.AuditReferral, input.ID, actor, before, after)
+	if err != nil {
+		return nil, err
+	}
+	err = api.WriteAudited(ctx, types.TransactWriteItem{Update: &types.Update{
 		TableName: aws.String(referralsTable),
 		Key: map[string]types.AttributeValue{
 			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFERRAL#%s", input.ID)},
 			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("METADATA#%s", input.ID)},
 		},
-		UpdateExpression:         aws.String("SET #s = :s, updatedAt = :u"),
+		UpdateExpression: aws.String("SET #s = :s, updatedAt = :u"),
+		// The audited before state must still be the stored one.
+		ConditionExpression:      aws.String("#s = :prev"),
 		ExpressionAttributeNames: map[string]string{"#s": "status"},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":s": &types.AttributeValueMemberS{Value: input.Status},
-			":u": &types.AttributeValueMemberS{Value: now},
+			":s":    &types.AttributeValueMemberS{Value: after.Status},
+			":u":    &types.AttributeValueMemberS{Value: after.UpdatedAt},
+			":prev": &types.AttributeValueMemberS{Value: before.Status},
 		},
-		ReturnValues: types.ReturnValueAllNew,
-	})
+	}}, event)
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return nil, &userError{fmt.Sprintf("referral %s was changed by another request; fetch it again and retry", input.ID)}
+	}
 	if err != nil {
 		return nil, err
 	}
-	return getReferral(ctx, input.ID)
+	return &after, nil
 }
 
 // dashboardMetrics returns enhanced analytics for the dashboard
@@ -243,11 +365,13 @@ func dashboardMetrics(ctx context.Context, userID string) (*DashboardMetrics, er
 	var metrics DashboardMetrics
 	var paidCount int
 
+	var earned int64
 	for _, p := range pays {
-		if p.Status == "Paid" {
-			metrics.TotalEarnings += p.Amount
+		if api.PaymentEarned(p.Status) {
+			earned += p.Amount
 		}
 	}
+	metrics.TotalEarnings = api.CentsToDollars(earned)
 
 	for _, r := range refs {
 		metrics.TotalReferrals++
@@ -277,11 +401,12 @@ func earningsByMonth(ctx context.Context, userID string, months int) ([]MonthlyE
 		return nil, err
 	}
 
-	earningsByMonth := make(map[string]float64)
+	// Earnings are summed in cents and converted once per month.
+	earningsByMonth := make(map[string]int64)
 
 	// Process payments
 	for _, p := range pays {
-		if p.Status == "Paid" {
+		if api.PaymentEarned(p.Status) {
 			// Extract YYYY-MM from date
 			if len(p.Date) >= 7 {
 				monthKey := p.Date[:7]
@@ -296,7 +421,7 @@ func earningsByMonth(ctx context.Context, userID string, months int) ([]MonthlyE
 			// Extract YYYY-MM from createdAt
 			if len(r.CreatedAt) >= 7 {
 				monthKey := r.CreatedAt[:7]
-				earningsByMonth[monthKey] += r.Amount
+				earningsByMonth[monthKey] += int64(r.Amount)
 			}
 		}
 	}
@@ -306,7 +431,7 @@ func earningsByMonth(ctx context.Context, userID string, months int) ([]MonthlyE
 	for month, amount := range earningsByMonth {
 		earnings = append(earnings, MonthlyEarning{
 			Month:    month,
-			Earnings: amount,
+			Earnings: api.CentsToDollars(amount),
 		})
 	}
 
@@ -314,5 +439,5 @@ func earningsByMonth(ctx context.Context, userID string, months int) ([]MonthlyE
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(withLogging(withPolicy(handler)))
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deliveries are POSTed as JSON with these headers:
+//
+//	Miliare-Delivery:  the delivery ID, the same on every retry and replay
+//	Miliare-Event:     the event type, e.g. referral.created
+//	Miliare-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// The HMAC key is the partner's webhook secret. Receivers should reject
+// signatures whose timestamp is more than a few minutes old.
+const (
+	headerDelivery  = "Miliare-Delivery"
+	headerEvent     = "Miliare-Event"
+	headerSignature = "Miliare-Signature"
+)
+
+const eventReferralCreated = "referral.created"
+
+// Retry policy: up to maxAttempts POSTs, waiting an exponentially growing,
+// fully jittered backoff between them. The worst case, every attempt timing
+// out, stays well inside the function timeout.
+const (
+	maxAttempts    = 5
+	baseBackoff    = time.Second
+	maxBackoff     = 8 * time.Second
+	attemptTimeout = 5 * time.Second
+)
+
+// maxResponseSnippet is how much of a failed response body is logged.
+const maxResponseSnippet = 256
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// envelope is the body of every webhook.
+type envelope struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt string      `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// sign returns the Miliare-Signature header value for body sent at t.
+func sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + string(body)))
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// backoff returns how long to wait before attempt n+1, after n failures.
+func backoff(n int) time.Duration {
+	d := baseBackoff << (n - 1)
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// retryable reports whether a response status is worth retrying: server
+// errors, timeouts and rate limiting. Other 4xx responses will not change.
+func retryable(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// post makes one delivery attempt.
+func post(ctx context.Context, d *delivery, secret string) attempt {
+	start := time.Now().UTC()
+	a := attempt{At: start.Format(time.RFC3339Nano)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Miliare-Webhooks/1.0")
+	req.Header.Set(headerDelivery, d.ID)
+	req.Header.Set(headerEvent, d.EventType)
+	req.Header.Set(headerSignature, sign(secret, start, []byte(d.Payload)))
+	resp, err := httpClient.Do(req)
+	a.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	defer resp.Body.Close()
+	a.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSnippet))
+		a.Error = strings.TrimSpace(string(snippet))
+		if a.Error == "" {
+			a.Error = resp.Status
+		}
+	}
+	return a
+}
+
+// attemptDelivery POSTs d until it is accepted, fails permanently or runs
+// out of attempts, logging every attempt on the delivery record, and then
+// marks the delivery DELIVERED or DEAD_LETTER.
+func attemptDelivery(ctx context.Context, d *delivery, secret string) error {
+	for n := 1; ; n++ {
+		a := post(ctx, d, secret)
+		if err := appendAttempt(ctx, d.PartnerID, d.ID, a); err != nil {
+			return err
+		}
+		log := logger.With(
+			slog.String("partnerId", d.PartnerID),
+			slog.String("deliveryId", d.ID),
+			slog.Int("attempt", n),
+			slog.Int("status", a.StatusCode),
+		)
+		if a.succeeded() {
+			log.InfoContext(ctx, "webhook delivered")
+			return finishDelivery(ctx, d.PartnerID, d.ID, statusDelivered, "")
+		}
+		log.WarnContext(ctx, "webhook attempt failed", slog.String("error", a.Error))
+		if n == maxAttempts || (a.StatusCode != 0 && !retryable(a.StatusCode)) {
+			return finishDelivery(ctx, d.PartnerID, d.ID, statusDeadLetter, a.Error)
+		}
+		if err := sleep(ctx, backoff(n)); err != nil {
+			return finishDelivery(ctx, d.PartnerID, d.ID, statusDeadLetter, err.Error())
+		}
+	}
+}
+
+// deliverReferral sends a newly submitted referral to its partner's webhook.
+// eventID identifies the submission, so a redelivered event maps to the
+// same delivery and is not sent again once it has been delivered or
+// dead-lettered.
+func deliverReferral(ctx context.Context, eventID string, at time.Time, r referral) error {
+	p, err := getPartner(ctx, r.CompanyID)
+	if err != nil {
+		return err
+	}
+	if p == nil || p.DeletedAt != "" || p.WebhookURL == "" {
+		return nil
+	}
+	id := deliveryID(at, eventID)
+	body, err := json.Marshal(envelope{
+		ID:        id,
+		Type:      eventReferralCreated,
+		CreatedAt: at.Format(time.RFC3339),
+		Data:      r,
+	})
+	if err != nil {
+		return err
+	}
+	d := &delivery{
+		ID:        id,
+		PartnerID: p.ID,
+		EventID:   eventID,
+		EventType: eventReferralCreated,
+		URL:       p.WebhookURL,
+		Payload:   string(body),
+		Status:    statusPending,
+		CreatedAt: at.Format(time.RFC3339Nano),
+	}
+	created, err := createDelivery(ctx, d)
+	if err != nil {
+		return err
+	}
+	if !created {
+		// A redelivered event: carry on only if the first run stopped
+		// before the delivery reached a final state.
+		if d, err = getDelivery(ctx, p.ID, d.ID); err != nil || d == nil || d.Status != statusPending {
+			return err
+		}
+	}
+	return send(ctx, d)
+}
+
+// replayDelivery sends a dead-lettered delivery again to the partner's
+// current webhook URL, with the original payload.
+func replayDelivery(ctx context.Context, req replayRequest) error {
+	d, err := getDelivery(ctx, req.PartnerID, req.DeliveryID)
+	if err != nil {
+		return err
+	}
+	if d == nil || d.Status != statusReplayRequested {
+		return nil
+	}
+	p, err := getPartner(ctx, req.PartnerID)
+	if err != nil {
+		return err
+	}
+	if p == nil || p.DeletedAt != "" || p.WebhookURL == "" {
+		return finishDelivery(ctx, d.PartnerID, d.ID, statusDeadLetter, "partner has no webhook URL")
+	}
+	if p.WebhookURL != d.URL {
+		if err := setDeliveryURL(ctx, d.PartnerID, d.ID, p.WebhookURL); err != nil {
+			return err
+		}
+		d.URL = p.WebhookURL
+	}
+	return send(ctx, d)
+}
+
+// send signs and attempts d with the partner's secret. Without a secret the
+// delivery cannot be signed, so it goes straight to the dead-letter store
+// to be replayed once a secret has been issued.
+func send(ctx context.Context, d *delivery) error {
+	secret, err := getSecret(ctx, d.PartnerID)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return finishDelivery(ctx, d.PartnerID, d.ID, statusDeadLetter, "partner has no webhook secret")
+	}
+	return attemptDelivery(ctx, d, secret)
+}
+
+// deliveryID sorts deliveries by when their event occurred, and is derived
+// from the event ID so the same event always yields the same delivery.
+func deliveryID(at time.Time, eventID string) string {
+	sum := sha256.Sum256([]byte(eventID))
+	return at.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(sum[:6])
+}
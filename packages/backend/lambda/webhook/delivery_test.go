@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	got := sign("whsec_test", time.Unix(1700000000, 0), []byte(`{"id":"evt_1"}`))
+	want := "t=1700000000,v1=c89214b5b5da833daed6f0b8c5bb6bd58cea9022bd80ccc78230f3942d632925"
+	if got != want {
+		t.Errorf("sign = %s, want %s", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{maxAttempts, maxBackoff},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if d := backoff(c.failures); d <= 0 || d > c.max {
+				t.Fatalf("backoff(%d) = %v, want in (0, %v]", c.failures, d, c.max)
+			}
+		}
+	}
+}
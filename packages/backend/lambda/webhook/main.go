@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// logger writes JSON lines to stdout, which Lambda forwards to CloudWatch.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Outbox topics this function subscribes to on the domain event bus.
+const (
+	topicReferralSubmitted      = "notification.referralSubmitted"
+	topicWebhookReplayRequested = "webhook.replayRequested"
+)
+
+var (
+	ddb           *dynamodb.Client
+	partnersTable string
+	webhooksTable string
+	httpClient    = &http.Client{Timeout: attemptTimeout}
+)
+
+func getenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic(fmt.Sprintf("%s not set", key))
+	}
+	return v
+}
+
+// relayedMessage is the detail of an outbox message relayed to the bus.
+type relayedMessage struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	OccurredAt string          `json:"occurredAt"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// referral is the part of a submitted referral sent to the partner.
+type referral struct {
+	ID         string `json:"id"`
+	CompanyID  string `json:"companyId"`
+	ClientName string `json:"clientName"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// replayRequest is the payload of webhook.replayRequested.
+type replayRequest struct {
+	PartnerID  string `json:"partnerId"`
+	DeliveryID string `json:"deliveryId"`
+}
+
+// handler delivers a new referral to its partner's webhook, or replays a
+// dead-lettered delivery an admin asked for. Delivery failures end in the
+// dead-letter state rather than an error, so EventBridge only retries when
+// the delivery could not even be recorded.
+func handler(ctx context.Context, e events.CloudWatchEvent) error {
+	var msg relayedMessage
+	if err := json.Unmarshal(e.Detail, &msg); err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+	switch msg.Type {
+	case topicReferralSubmitted:
+		var r referral
+		if err := json.Unmarshal(msg.Detail, &r); err != nil {
+			return fmt.Errorf("decode referral: %w", err)
+		}
+		at, err := time.Parse(time.RFC3339, msg.OccurredAt)
+		if err != nil {
+			at = time.Now()
+		}
+		return deliverReferral(ctx, msg.ID, at.UTC(), r)
+	case topicWebhookReplayRequested:
+		var req replayRequest
+		if err := json.Unmarshal(msg.Detail, &req); err != nil {
+			return fmt.Errorf("decode replay request: %w", err)
+		}
+		return replayDelivery(ctx, req)
+	}
+	logger.WarnContext(ctx, "ignoring event", slog.String("type", msg.Type))
+	return nil
+}
+
+func main() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	ddb = dynamodb.NewFromConfig(cfg)
+	partnersTable = getenv("PARTNERS_TABLE")
+	webhooksTable = getenv("WEBHOOKS_TABLE")
+	lambda.Start(handler)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The webhooks table holds, per partner, the signing secret (PK
+// PARTNER#<partnerId>, SK SECRET) and one record per delivery (SK
+// DELIVERY#<deliveryId>) with every attempt made. Dead-lettered deliveries
+// also carry deadLetter, the partition key of the sparse DeadLetterIndex.
+
+// Delivery statuses.
+const (
+	statusPending         = "PENDING"
+	statusDelivered       = "DELIVERED"
+	statusDeadLetter      = "DEAD_LETTER"
+	statusReplayRequested = "REPLAY_REQUESTED"
+)
+
+// attempt is one POST of a delivery. StatusCode is 0 when no response was
+// received.
+type attempt struct {
+	At         string `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (a attempt) succeeded() bool {
+	return a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// delivery is one event sent, or to be sent, to one partner.
+type delivery struct {
+	ID        string    `json:"id"`
+	PartnerID string    `json:"partnerId"`
+	EventID   string    `json:"eventId"`
+	EventType string    `json:"eventType"`
+	URL       string    `json:"url"`
+	Payload   string    `json:"payload"`
+	Status    string    `json:"status"`
+	Attempts  []attempt `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	CreatedAt string    `json:"createdAt"`
+	UpdatedAt string    `json:"updatedAt,omitempty"`
+}
+
+// partner is the part of a partner record deliveries need.
+type partner struct {
+	ID         string `json:"id"`
+	WebhookURL string `json:"webhookUrl"`
+	DeletedAt  string `json:"deletedAt"`
+}
+
+func unmarshalItem(item map[string]types.AttributeValue, v interface{}) error {
+	return attributevalue.UnmarshalMapWithOptions(item, v, func(o *attributevalue.DecoderOptions) {
+		o.TagKey = "json"
+	})
+}
+
+func deliveryKey(partnerID, deliveryID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "PARTNER#" + partnerID},
+		"SK": &types.AttributeValueMemberS{Value: "DELIVERY#" + deliveryID},
+	}
+}
+
+// getPartner loads a partner by ID, returning nil if none exists.
+func getPartner(ctx context.Context, id string) (*partner, error) {
+	if id == "" {
+		return nil, nil
+	}
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(partnersTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PARTNER#%s", id)},
+			"SK": &types.AttributeValueMemberS{Value: fmt.Sprintf("PROFILE#%s", id)},
+		},
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	var p partner
+	if err := unmarshalItem(out.Item, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getSecret returns the partner's webhook signing secret, or "" if none has
+// been issued.
+func getSecret(ctx context.Context, partnerID string) (string, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(webhooksTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "PARTNER#" + partnerID},
+			"SK": &types.AttributeValueMemberS{Value: "SECRET"},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return "", err
+	}
+	var s struct {
+		Secret string `json:"secret"`
+	}
+	if err := unmarshalItem(out.Item, &s); err != nil {
+		return "", err
+	}
+	return s.Secret, nil
+}
+
+// createDelivery records d, reporting false if a delivery with its ID
+// already exists.
+func createDelivery(ctx context.Context, d *delivery) (bool, error) {
+	d.Attempts = []attempt{}
+	item, err := attributevalue.MarshalMapWithOptions(struct {
+		PK string `json:"PK"`
+		SK string `json:"SK"`
+		*delivery
+	}{
+		PK:       "PARTNER#" + d.PartnerID,
+		SK:       "DELIVERY#" + d.ID,
+		delivery: d,
+	}, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = ddb.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(webhooksTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getDelivery loads a delivery, returning nil if none exists.
+func getDelivery(ctx context.Context, partnerID, deliveryID string) (*delivery, error) {
+	out, err := ddb.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(webhooksTable),
+		Key:            deliveryKey(partnerID, deliveryID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	var d delivery
+	if err := unmarshalItem(out.Item, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// appendAttempt adds a to the delivery's attempt log.
+func appendAttempt(ctx context.Context, partnerID, deliveryID string, a attempt) error {
+	av, err := attributevalue.MarshalMapWithOptions(a, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(webhooksTable),
+		Key:              deliveryKey(partnerID, deliveryID),
+		UpdateExpression: aws.String("SET attempts = list_append(if_not_exists(attempts, :empty), :attempt), updatedAt = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":empty":   &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":attempt": &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberM{Value: av}}},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	return err
+}
+
+// finishDelivery moves a delivery to its final status. Dead-lettered
+// deliveries join the DeadLetterIndex with lastErr as the reason; delivered
+// ones leave it.
+func finishDelivery(ctx context.Context, partnerID, deliveryID, status, lastErr string) error {
+	values := map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{Value: status},
+		":now":    &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+	}
+	update := "SET #status = :status, updatedAt = :now"
+	if status == statusDeadLetter {
+		values[":deadLetter"] = &types.AttributeValueMemberS{Value: statusDeadLetter}
+		values[":lastError"] = &types.AttributeValueMemberS{Value: lastErr}
+		update += ", deadLetter = :deadLetter, lastError = :lastError"
+	} else {
+		update += " REMOVE deadLetter, lastError"
+	}
+	_, err := ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(webhooksTable),
+		Key:                       deliveryKey(partnerID, deliveryID),
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// setDeliveryURL points a delivery at the partner's current webhook URL.
+func setDeliveryURL(ctx context.Context, partnerID, deliveryID, url string) error {
+	_, err := ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(webhooksTable),
+		Key:              deliveryKey(partnerID, deliveryID),
+		UpdateExpression: aws.String("SET #url = :url"),
+		ExpressionAttributeNames: map[string]string{
+			"#url": "url",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":url": &types.AttributeValueMemberS{Value: url},
+		},
+	})
+	return err
+}
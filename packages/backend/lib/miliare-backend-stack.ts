@@ -8,9 +8,49 @@ import * as route53 from 'aws-cdk-lib/aws-route53';
 import * as acm from 'aws-cdk-lib/aws-certificatemanager';
 import * as targets from 'aws-cdk-lib/aws-route53-targets';
 import * as cognito from 'aws-cdk-lib/aws-cognito';
+import * as events from 'aws-cdk-lib/aws-events';
+import * as eventTargets from 'aws-cdk-lib/aws-events-targets';
+import * as eventSources from 'aws-cdk-lib/aws-lambda-event-sources';
+import * as iam from 'aws-cdk-lib/aws-iam';
+import * as kms from 'aws-cdk-lib/aws-kms';
 import { RemovalPolicy } from 'aws-cdk-lib';
 import * as fs from 'fs';
 
+// goFunctionCode builds the Go Lambda in lambda/<dir> into a bootstrap
+// binary, locally when Go is installed and otherwise in Docker. The asset is
+// the whole lambda directory, not just <dir>: each function's go.mod replaces
+// the shared modules (rbac, api, fieldcrypt, referralstatus) with their
+// sibling directories, which the Docker build must be able to see too.
+function goFunctionCode(dir: string): lambda.Code {
+  const build = 'GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc';
+  return lambda.Code.fromAsset('lambda', {
+    // Hash the binary, not the shared source, so a change to one function
+    // does not redeploy all of them.
+    assetHashType: cdk.AssetHashType.OUTPUT,
+    bundling: {
+      image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
+      workingDir: `/asset-input/${dir}`,
+      // The container runs as the calling user, who cannot write to the
+      // image's Go caches.
+      environment: { GOCACHE: '/tmp/go-build', GOMODCACHE: '/tmp/go-mod' },
+      command: ['bash', '-c', `${build} -o /asset-output/bootstrap .`],
+      local: {
+        tryBundle(outputDir: string) {
+          if (process.env.SKIP_BUNDLING) {
+            fs.writeFileSync(`${outputDir}/bootstrap`, '');
+            return true;
+          }
+          require('child_process').execSync(`${build} -o ${outputDir}/bootstrap .`, {
+            cwd: `lambda/${dir}`,
+            stdio: ['ignore', 'inherit', 'inherit'],
+          });
+          return true;
+        },
+      },
+    },
+  });
+}
+
 export interface MiliareBackendStackProps extends cdk.StackProps {
   readonly restDomainName: string;
   readonly hostedZoneId?: string;
@@ -101,6 +141,8 @@ export class MiliareBackendStack extends cdk.Stack {
     const referralsTable = new dynamodb.Table(this, 'ReferralsTable', {
       partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
       sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      // Feeds the stream function that publishes domain events
+      stream: dynamodb.StreamViewType.NEW_AND_OLD_IMAGES,
       removalPolicy: RemovalPolicy.DESTROY,
       pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
       billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
@@ -115,6 +157,58 @@ export class MiliareBackendStack extends cdk.Stack {
     });
 
     const paymentsTable = new dynamodb.Table(this, 'PaymentsTable', {
+      partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      // Feeds the stream function that publishes domain events
+      stream: dynamodb.StreamViewType.NEW_AND_OLD_IMAGES,
+      removalPolicy: RemovalPolicy.DESTROY,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+
+    // Append-only history of referral, payment, bonus pool and compensation writes
+    const auditTable = new dynamodb.Table(this, 'AuditTable', {
+      partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      removalPolicy: RemovalPolicy.DESTROY,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+
+    // Side effects (notifications, ledger postings) written in the same
+    // transaction as the referral or payment, relayed by the stream function
+    const outboxTable = new dynamodb.Table(this, 'OutboxTable', {
+      partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      stream: dynamodb.StreamViewType.NEW_AND_OLD_IMAGES,
+      timeToLiveAttribute: 'expiresAt',
+      removalPolicy: RemovalPolicy.DESTROY,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+
+    // Responses to create requests made with an Idempotency-Key, kept for a day
+    const idempotencyTable = new dynamodb.Table(this, 'IdempotencyTable', {
+      partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      removalPolicy: RemovalPolicy.DESTROY,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+
+    // In-app notifications, written by the notify function, kept for 90 days
+    const notificationsTable = new dynamodb.Table(this, 'NotificationsTable', {
+      partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+      timeToLiveAttribute: 'expiresAt',
+      removalPolicy: RemovalPolicy.DESTROY,
+      pointInTimeRecoverySpecification: { pointInTimeRecoveryEnabled: false },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+    });
+
+    // Partner webhook signing secrets and the log of every delivery made
+    const webhooksTable = new dynamodb.Table(this, 'WebhooksTable', {
       partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
       sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
       removalPolicy: RemovalPolicy.DESTROY,
@@ -122,6 +216,65 @@ export class MiliareBackendStack extends cdk.Stack {
       billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
     });
 
+    // The referrals table's indexes: per-user lookups (team downline
+    // stats), a customer's referral history and a partner's customer book,
+    // and a partner's referrals, checked before the partner is deleted.
+    // CloudFormation adds at most one index to a table per update, so a stack
+    // deployed before these existed is brought up to date in steps: deploy
+    // with `-c referralsTableIndexes=1`, then `=2`, then without the flag
+    // (see README.md, Deployment). New stacks take all three at once.
+    const referralsTableIndexes: dynamodb.GlobalSecondaryIndexProps[] = [
+      { indexName: 'UserIndex', partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING } },
+      { indexName: 'CustomerIndex', partitionKey: { name: 'customerId', type: dynamodb.AttributeType.STRING } },
+      { indexName: 'CompanyIndex', partitionKey: { name: 'companyId', type: dynamodb.AttributeType.STRING } },
+    ];
+    const referralsTableIndexCount = Number(
+      this.node.tryGetContext('referralsTableIndexes') ?? referralsTableIndexes.length,
+    );
+    referralsTableIndexes
+      .slice(0, referralsTableIndexCount)
+      .forEach((index) => referralsTable.addGlobalSecondaryIndex(index));
+
+    // Per-user payment lookups (team downline stats)
+    paymentsTable.addGlobalSecondaryIndex({
+      indexName: 'UserIndex',
+      partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING },
+    });
+
+    // Partner API credentials by key ID, for the partner authorizer; sparse,
+    // as only credential items carry keyId
+    partnersTable.addGlobalSecondaryIndex({
+      indexName: 'CredentialIndex',
+      partitionKey: { name: 'keyId', type: dynamodb.AttributeType.STRING },
+    });
+
+    // A partner's customer book
+    customersTable.addGlobalSecondaryIndex({
+      indexName: 'PartnerIndex',
+      partitionKey: { name: 'partnerId', type: dynamodb.AttributeType.STRING },
+    });
+
+    // Per-agent lead lists
+    leadDataTable.addGlobalSecondaryIndex({
+      indexName: 'OwnerIndex',
+      partitionKey: { name: 'ownerId', type: dynamodb.AttributeType.STRING },
+    });
+
+    // Audit events by the user who made them
+    auditTable.addGlobalSecondaryIndex({
+      indexName: 'ActorIndex',
+      partitionKey: { name: 'actor', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'at', type: dynamodb.AttributeType.STRING },
+    });
+
+    // Dead-lettered webhook deliveries across all partners; sparse, as only
+    // dead letters carry deadLetter
+    webhooksTable.addGlobalSecondaryIndex({
+      indexName: 'DeadLetterIndex',
+      partitionKey: { name: 'deadLetter', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'createdAt', type: dynamodb.AttributeType.STRING },
+    });
+
     // Add tags to all resources for easier identification
     const tags = {
       Environment: 'development',
@@ -180,6 +333,39 @@ export class MiliareBackendStack extends cdk.Stack {
       description: 'Payments Table Name',
     });
 
+    new cdk.CfnOutput(this, 'AuditTableName', {
+      value: auditTable.tableName,
+      description: 'Audit Table Name',
+    });
+
+    new cdk.CfnOutput(this, 'OutboxTableName', {
+      value: outboxTable.tableName,
+      description: 'Outbox Table Name',
+    });
+
+    new cdk.CfnOutput(this, 'IdempotencyTableName', {
+      value: idempotencyTable.tableName,
+      description: 'Idempotency Table Name',
+    });
+
+    new cdk.CfnOutput(this, 'NotificationsTableName', {
+      value: notificationsTable.tableName,
+      description: 'Notifications Table Name',
+    });
+
+    new cdk.CfnOutput(this, 'WebhooksTableName', {
+      value: webhooksTable.tableName,
+      description: 'Webhooks Table Name',
+    });
+
+    // Wraps the data keys that encrypt sensitive profile and bank fields
+    // (see lambda/fieldcrypt).
+    const fieldEncryptionKey = new kms.Key(this, 'FieldEncryptionKey', {
+      description: 'Envelope key for encrypted record fields',
+      enableKeyRotation: true,
+      removalPolicy: RemovalPolicy.DESTROY,
+    });
+
     const profileFn = new lambda.Function(this, 'ProfileFunction', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
       architecture: lambda.Architecture.ARM_64,
@@ -187,32 +373,27 @@ export class MiliareBackendStack extends cdk.Stack {
       environment: {
         USER_PROFILE_TABLE: userProfileTable.tableName,
         PAYMENTS_TABLE: paymentsTable.tableName,
+        AUDIT_TABLE: auditTable.tableName,
+        IDEMPOTENCY_TABLE: idempotencyTable.tableName,
+        NOTIFICATIONS_TABLE: notificationsTable.tableName,
+        OUTBOX_TABLE: outboxTable.tableName,
+        // Lets the function verify tokens itself where no authorizer ran,
+        // e.g. under sam local.
+        COGNITO_ISSUER: `https://cognito-idp.${this.region}.amazonaws.com/${userPool.userPoolId}`,
+        COGNITO_JWKS_URL: `https://cognito-idp.${this.region}.amazonaws.com/${userPool.userPoolId}/.well-known/jwks.json`,
+        COGNITO_CLIENT_ID: userPoolClient.userPoolClientId,
+        FIELD_ENCRYPTION_KEY_ID: fieldEncryptionKey.keyArn,
       },
-      code: lambda.Code.fromAsset('lambda/profile', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/profile',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                }
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      code: goFunctionCode('profile'),
     });
 
     userProfileTable.grantReadWriteData(profileFn);
     paymentsTable.grantReadWriteData(profileFn);
+    auditTable.grant(profileFn, 'dynamodb:PutItem');
+    idempotencyTable.grantReadWriteData(profileFn);
+    notificationsTable.grantReadData(profileFn);
+    outboxTable.grant(profileFn, 'dynamodb:PutItem');
+    fieldEncryptionKey.grant(profileFn, 'kms:GenerateDataKey', 'kms:Decrypt');
 
     // Lambda function implemented in Go
     const userFn = new lambda.Function(this, 'UserFunction', {
@@ -222,32 +403,21 @@ export class MiliareBackendStack extends cdk.Stack {
       environment: {
         REFERRALS_TABLE: referralsTable.tableName,
         PAYMENTS_TABLE: paymentsTable.tableName,
+        AUDIT_TABLE: auditTable.tableName,
+        IDEMPOTENCY_TABLE: idempotencyTable.tableName,
+        OUTBOX_TABLE: outboxTable.tableName,
+        PARTNERS_TABLE: partnersTable.tableName,
       },
-      code: lambda.Code.fromAsset('lambda/user', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/user',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                }
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      code: goFunctionCode('user'),
     });
 
     referralsTable.grantReadWriteData(userFn);
     paymentsTable.grantReadWriteData(userFn);
+    auditTable.grant(userFn, 'dynamodb:PutItem');
+    outboxTable.grant(userFn, 'dynamodb:PutItem');
+    idempotencyTable.grant(userFn, 'dynamodb:GetItem', 'dynamodb:PutItem');
+    // createReferral checks the partner is ACTIVE in the referral's transaction.
+    partnersTable.grant(userFn, 'dynamodb:ConditionCheckItem');
 
     const partnerFn = new lambda.Function(this, 'PartnerFunction', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
@@ -255,31 +425,21 @@ export class MiliareBackendStack extends cdk.Stack {
       handler: 'bootstrap',
       environment: {
         PARTNERS_TABLE: partnersTable.tableName,
+        REFERRALS_TABLE: referralsTable.tableName,
+        AUDIT_TABLE: auditTable.tableName,
+        IDEMPOTENCY_TABLE: idempotencyTable.tableName,
+        OUTBOX_TABLE: outboxTable.tableName,
+        WEBHOOKS_TABLE: webhooksTable.tableName,
       },
-      code: lambda.Code.fromAsset('lambda/partner', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/partner',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                }
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      code: goFunctionCode('partner'),
     });
 
     partnersTable.grantReadWriteData(partnerFn);
+    referralsTable.grantReadWriteData(partnerFn);
+    auditTable.grant(partnerFn, 'dynamodb:PutItem');
+    idempotencyTable.grantReadWriteData(partnerFn);
+    outboxTable.grant(partnerFn, 'dynamodb:PutItem');
+    webhooksTable.grantReadWriteData(partnerFn);
 
     const customerFn = new lambda.Function(this, 'CustomerFunction', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
@@ -287,31 +447,17 @@ export class MiliareBackendStack extends cdk.Stack {
       handler: 'bootstrap',
       environment: {
         CUSTOMERS_TABLE: customersTable.tableName,
+        REFERRALS_TABLE: referralsTable.tableName,
+        AUDIT_TABLE: auditTable.tableName,
+        IDEMPOTENCY_TABLE: idempotencyTable.tableName,
       },
-      code: lambda.Code.fromAsset('lambda/customer', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/customer',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                }
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      code: goFunctionCode('customer'),
     });
 
     customersTable.grantReadWriteData(customerFn);
+    referralsTable.grantReadWriteData(customerFn);
+    auditTable.grant(customerFn, 'dynamodb:PutItem');
+    idempotencyTable.grantReadWriteData(customerFn);
 
     const leadFn = new lambda.Function(this, 'LeadFunction', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
@@ -319,58 +465,163 @@ export class MiliareBackendStack extends cdk.Stack {
       handler: 'bootstrap',
       environment: {
         USER_PROFILE_TABLE: userProfileTable.tableName,
+        REFERRALS_TABLE: referralsTable.tableName,
+        PAYMENTS_TABLE: paymentsTable.tableName,
+        LEAD_DATA_TABLE: leadDataTable.tableName,
+        PARTNERS_TABLE: partnersTable.tableName,
+        AUDIT_TABLE: auditTable.tableName,
+        OUTBOX_TABLE: outboxTable.tableName,
       },
-      code: lambda.Code.fromAsset('lambda/lead', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/lead',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                },
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      code: goFunctionCode('lead'),
     });
 
     userProfileTable.grantReadData(leadFn);
-
-    // Lambda for DocuSign and bonus pool REST endpoints
+    referralsTable.grantReadWriteData(leadFn);
+    paymentsTable.grantReadData(leadFn);
+    leadDataTable.grantReadWriteData(leadFn);
+    auditTable.grant(leadFn, 'dynamodb:PutItem');
+    outboxTable.grant(leadFn, 'dynamodb:PutItem');
+    // Converting a lead checks the partner is active in the same transaction.
+    partnersTable.grant(leadFn, 'dynamodb:ConditionCheckItem');
+
+    // Lambda for DocuSign, bonus pool and audit log REST endpoints
     const opsFn = new lambda.Function(this, 'OpsFunction', {
       runtime: lambda.Runtime.PROVIDED_AL2023,
       architecture: lambda.Architecture.ARM_64,
       handler: 'bootstrap',
-      code: lambda.Code.fromAsset('lambda/ops', {
-        bundling: {
-          image: cdk.DockerImage.fromRegistry('public.ecr.aws/docker/library/golang:1.24'),
-          local: {
-            tryBundle(outputDir: string) {
-              if (process.env.SKIP_BUNDLING) {
-                require('fs').writeFileSync(`${outputDir}/bootstrap`, '');
-                return true;
-              }
-              require('child_process').execSync(
-                `GOOS=linux GOARCH=arm64 CGO_ENABLED=0 go build -ldflags="-s -w" -tags lambda.norpc -o ${outputDir}/bootstrap main.go`,
-                {
-                  cwd: 'lambda/ops',
-                  stdio: ['ignore', 'inherit', 'inherit'],
-                },
-              );
-              return true;
-            },
-          },
-        },
-      }),
+      environment: {
+        AUDIT_TABLE: auditTable.tableName,
+      },
+      code: goFunctionCode('ops'),
+    });
+
+    // Audit events are only ever put by the writers; the ops function reads them.
+    auditTable.grantReadData(opsFn);
+
+    // Daily job that removes soft-deleted records past their retention period
+    const purgeFn = new lambda.Function(this, 'PurgeFunction', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.ARM_64,
+      handler: 'bootstrap',
+      timeout: cdk.Duration.minutes(5),
+      environment: {
+        USER_PROFILE_TABLE: userProfileTable.tableName,
+        PARTNERS_TABLE: partnersTable.tableName,
+        CUSTOMERS_TABLE: customersTable.tableName,
+        LEAD_DATA_TABLE: leadDataTable.tableName,
+        RETENTION_DAYS: '30',
+      },
+      code: goFunctionCode('purge'),
+    });
+
+    userProfileTable.grantReadWriteData(purgeFn);
+    partnersTable.grantReadWriteData(purgeFn);
+    customersTable.grantReadWriteData(purgeFn);
+    leadDataTable.grantReadWriteData(purgeFn);
+
+    new events.Rule(this, 'PurgeSchedule', {
+      schedule: events.Schedule.rate(cdk.Duration.days(1)),
+      targets: [new eventTargets.LambdaFunction(purgeFn)],
+    });
+
+    // Domain events (ReferralCreated, ReferralPaid, PaymentProcessed) derived
+    // from the referrals and payments table streams, and outbox messages
+    const domainEventBus = new events.EventBus(this, 'DomainEventBus');
+
+    new cdk.CfnOutput(this, 'DomainEventBusName', {
+      value: domainEventBus.eventBusName,
+      description: 'Domain Event Bus Name',
+    });
+
+    const streamFn = new lambda.Function(this, 'StreamFunction', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.ARM_64,
+      handler: 'bootstrap',
+      environment: {
+        EVENT_BUS_NAME: domainEventBus.eventBusName,
+      },
+      code: goFunctionCode('stream'),
+    });
+
+    domainEventBus.grantPutEventsTo(streamFn);
+
+    for (const table of [referralsTable, paymentsTable, outboxTable]) {
+      streamFn.addEventSource(new eventSources.DynamoEventSource(table, {
+        startingPosition: lambda.StartingPosition.TRIM_HORIZON,
+        batchSize: 100,
+        reportBatchItemFailures: true,
+        bisectBatchOnError: true,
+        retryAttempts: 10,
+      }));
+    }
+
+    // Emails and in-app notifications for referral status changes and
+    // processed payments
+    const notifyFn = new lambda.Function(this, 'NotifyFunction', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.ARM_64,
+      handler: 'bootstrap',
+      environment: {
+        USER_PROFILE_TABLE: userProfileTable.tableName,
+        NOTIFICATIONS_TABLE: notificationsTable.tableName,
+        EMAIL_FROM: 'notifications@miliarereferral.com',
+      },
+      code: goFunctionCode('notify'),
+    });
+
+    userProfileTable.grantReadData(notifyFn);
+    notificationsTable.grant(notifyFn, 'dynamodb:PutItem');
+    notifyFn.addToRolePolicy(new iam.PolicyStatement({
+      actions: ['ses:SendEmail'],
+      resources: ['*'],
+    }));
+
+    new events.Rule(this, 'NotifyRule', {
+      eventBus: domainEventBus,
+      eventPattern: {
+        source: ['miliare.referrals'],
+        detailType: ['ReferralStatusChanged', 'PaymentProcessed'],
+      },
+      targets: [new eventTargets.LambdaFunction(notifyFn, { retryAttempts: 4 })],
+    });
+
+    // Resolves a partner API credential to the partner it belongs to
+    const authorizerFn = new lambda.Function(this, 'AuthorizerFunction', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.ARM_64,
+      handler: 'bootstrap',
+      environment: {
+        PARTNERS_TABLE: partnersTable.tableName,
+      },
+      code: goFunctionCode('authorizer'),
+    });
+
+    partnersTable.grantReadData(authorizerFn);
+
+    // Signed webhooks to partners for new referrals, with retries and a
+    // dead-letter store; also replays dead letters on request
+    const webhookFn = new lambda.Function(this, 'WebhookFunction', {
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.ARM_64,
+      handler: 'bootstrap',
+      timeout: cdk.Duration.minutes(1),
+      environment: {
+        PARTNERS_TABLE: partnersTable.tableName,
+        WEBHOOKS_TABLE: webhooksTable.tableName,
+      },
+      code: goFunctionCode('webhook'),
+    });
+
+    partnersTable.grantReadData(webhookFn);
+    webhooksTable.grantReadWriteData(webhookFn);
+
+    new events.Rule(this, 'WebhookRule', {
+      eventBus: domainEventBus,
+      eventPattern: {
+        source: ['miliare.referrals'],
+        detailType: ['notification.referralSubmitted', 'webhook.replayRequested'],
+      },
+      targets: [new eventTargets.LambdaFunction(webhookFn, { retryAttempts: 4 })],
     });
 
     // GraphQL API using AppSync
@@ -448,60 +699,154 @@ export class MiliareBackendStack extends cdk.Stack {
         allowHeaders: [
           'Content-Type',
           'X-Api-Key',
+          'Authorization',
+          'If-Match',
+          'Idempotency-Key',
         ],
       },
     });
 
     // REST resources
 
+    // Every route but the DocuSign callback and the partner API needs Cognito
+    // claims; the functions check them against the shared policy in
+    // lambda/rbac.
+    const cognitoAuthorizer = new apigateway.CognitoUserPoolsAuthorizer(this, 'RestCognitoAuthorizer', {
+      cognitoUserPools: [userPool],
+    });
+    const cognitoMethod = {
+      apiKeyRequired: true,
+      authorizer: cognitoAuthorizer,
+      authorizationType: apigateway.AuthorizationType.COGNITO,
+    };
+
     const users = restApi.root.addResource('users');
     const userId = users.addResource('{userId}');
-    userId.addMethod('GET', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
-    userId.addMethod('PUT', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
+    userId.addMethod('GET', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    userId.addMethod('PUT', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    userId.addMethod('PATCH', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    const notificationsRes = userId.addResource('notifications');
+    notificationsRes.addMethod('GET', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
     const paymentsRes = userId.addResource('payments');
-    paymentsRes.addMethod('GET', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
+    paymentsRes.addMethod('GET', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    const bankAccount = userId.addResource('bank-account');
+    bankAccount.addMethod('PUT', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    bankAccount.addMethod('DELETE', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
 
     const payments = restApi.root.addResource('payments');
-    payments.addMethod('GET', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
-    payments.addMethod('POST', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
+    payments.addMethod('GET', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    payments.addMethod('POST', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
     const paymentId = payments.addResource('{paymentId}');
-    paymentId.addMethod('GET', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
-    paymentId.addMethod('PUT', new apigateway.LambdaIntegration(profileFn), { apiKeyRequired: true });
+    paymentId.addMethod('GET', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    paymentId.addMethod('PUT', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    paymentId.addMethod('PATCH', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
 
     const partners = restApi.root.addResource('partners');
-    partners.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), { apiKeyRequired: true });
-    partners.addMethod('POST', new apigateway.LambdaIntegration(partnerFn), { apiKeyRequired: true });
+    partners.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    partners.addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
     const partnerId = partners.addResource('{partnerId}');
-    partnerId.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), { apiKeyRequired: true });
-    partnerId.addMethod('PUT', new apigateway.LambdaIntegration(partnerFn), { apiKeyRequired: true });
+    partnerId.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    partnerId.addMethod('PUT', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    partnerId.addMethod('PATCH', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
 
     const customers = restApi.root.addResource('customers');
-    customers.addMethod('GET', new apigateway.LambdaIntegration(customerFn), { apiKeyRequired: true });
-    customers.addMethod('POST', new apigateway.LambdaIntegration(customerFn), { apiKeyRequired: true });
+    customers.addMethod('GET', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customers.addMethod('POST', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
     const customerId = customers.addResource('{customerId}');
-    customerId.addMethod('GET', new apigateway.LambdaIntegration(customerFn), { apiKeyRequired: true });
-    customerId.addMethod('PUT', new apigateway.LambdaIntegration(customerFn), { apiKeyRequired: true });
-
+    customerId.addMethod('GET', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customerId.addMethod('PUT', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customerId.addMethod('PATCH', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customerId.addResource('merge').addMethod('POST', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customerId.addResource('referrals').addMethod('GET', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    partnerId.addResource('customers').addMethod('GET', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+
+    // /lead/users and /leads scope their results to the caller.
     const lead = restApi.root.addResource('lead');
     const leadUsers = lead.addResource('users');
-    leadUsers.addMethod('GET', new apigateway.LambdaIntegration(leadFn), { apiKeyRequired: true });
+    leadUsers.addMethod('GET', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    const leadDownline = leadUsers.addResource('{userId}').addResource('downline');
+    leadDownline.addMethod('GET', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+
+    const leads = restApi.root.addResource('leads');
+    leads.addMethod('GET', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    leads.addMethod('POST', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    const leadId = leads.addResource('{leadId}');
+    leadId.addMethod('GET', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    leadId.addMethod('PUT', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    leadId.addMethod('DELETE', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    leadId.addResource('convert').addMethod('POST', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+    leadId.addResource('restore').addMethod('POST', new apigateway.LambdaIntegration(leadFn), cognitoMethod);
+
+    // Deletes record the caller and restores are admin-only, so both need Cognito claims.
+    userId.addMethod('DELETE', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    userId.addResource('restore').addMethod('POST', new apigateway.LambdaIntegration(profileFn), cognitoMethod);
+    partnerId.addMethod('DELETE', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    partnerId.addResource('restore').addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+
+    // Partner lifecycle: drafts are submitted for approval, which only admins give.
+    partnerId.addResource('status').addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+
+    // Partner webhook administration, admins only
+    partnerId.addResource('webhook-secret').addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    const webhookDeliveries = partnerId.addResource('webhook-deliveries');
+    webhookDeliveries.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    webhookDeliveries.addResource('{deliveryId}').addResource('replay')
+      .addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    restApi.root.addResource('webhook-dead-letters')
+      .addMethod('GET', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+
+    // Partner credentials, admins only
+    const credentials = partnerId.addResource('credentials');
+    credentials.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    credentials.addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    const credentialId = credentials.addResource('{credentialId}');
+    credentialId.addMethod('DELETE', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+    credentialId.addResource('rotate').addMethod('POST', new apigateway.LambdaIntegration(partnerFn), cognitoMethod);
+
+    // Server-to-server calls from partners, authenticated with the partner's
+    // own credential instead of the shared API key. Decisions are cached
+    // briefly, so a revoked credential stops working within a minute.
+    const partnerAuthorizer = new apigateway.TokenAuthorizer(this, 'PartnerAuthorizer', {
+      handler: authorizerFn,
+      identitySource: apigateway.IdentitySource.header('Authorization'),
+      resultsCacheTtl: cdk.Duration.minutes(1),
+    });
+    const partnerMethod = {
+      authorizer: partnerAuthorizer,
+      authorizationType: apigateway.AuthorizationType.CUSTOM,
+    };
+    const partnerApi = restApi.root.addResource('partner-api');
+    partnerApi.addResource('partner').addMethod('GET', new apigateway.LambdaIntegration(partnerFn), partnerMethod);
+    partnerApi.addResource('customers').addMethod('GET', new apigateway.LambdaIntegration(customerFn), partnerMethod);
+    const partnerReferrals = partnerApi.addResource('referrals');
+    partnerReferrals.addMethod('GET', new apigateway.LambdaIntegration(partnerFn), partnerMethod);
+    partnerReferrals.addResource('{referralId}').addResource('status')
+      .addMethod('POST', new apigateway.LambdaIntegration(partnerFn), partnerMethod);
+    customerId.addMethod('DELETE', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
+    customerId.addResource('restore').addMethod('POST', new apigateway.LambdaIntegration(customerFn), cognitoMethod);
 
     const docusign = restApi.root.addResource('docusign');
     const envelopes = docusign.addResource('envelopes');
-    envelopes.addMethod('POST', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
+    envelopes.addMethod('POST', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
     const envelopeId = envelopes.addResource('{envelopeId}');
-    envelopeId.addMethod('GET', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
+    envelopeId.addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
     const callbackRes = docusign.addResource('callback');
     callbackRes.addMethod('POST', new apigateway.LambdaIntegration(opsFn));
 
+    const audit = restApi.root.addResource('audit');
+    audit.addResource('entities').addResource('{entityType}').addResource('{entityId}')
+      .addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
+    audit.addResource('actors').addResource('{actor}')
+      .addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
+
     const bonusPools = restApi.root.addResource('bonus-pools');
-    bonusPools.addMethod('POST', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
-    bonusPools.addMethod('GET', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
+    bonusPools.addMethod('POST', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
+    bonusPools.addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
     const poolId = bonusPools.addResource('{poolId}');
-    poolId.addMethod('GET', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
-    poolId.addMethod('PUT', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
+    poolId.addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
+    poolId.addMethod('PUT', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
     const report = poolId.addResource('report');
-    report.addMethod('GET', new apigateway.LambdaIntegration(opsFn), { apiKeyRequired: true });
+    report.addMethod('GET', new apigateway.LambdaIntegration(opsFn), cognitoMethod);
 
     // Pin a static API key for clients that rely on a fixed value.
     const restApiKeyValue =
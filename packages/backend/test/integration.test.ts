@@ -1,5 +1,5 @@
 import * as cdk from 'aws-cdk-lib';
-import { Template } from 'aws-cdk-lib/assertions';
+import { Match, Template } from 'aws-cdk-lib/assertions';
 import { MiliareBackendStack } from '../lib/miliare-backend-stack';
 
 describe('Enhanced Miliare Backend Integration Tests', () => {
@@ -19,10 +19,10 @@ describe('Enhanced Miliare Backend Integration Tests', () => {
 
   test('Complete infrastructure deployment includes all enhanced features', () => {
     // Verify all DynamoDB tables are created
-    template.resourceCountIs('AWS::DynamoDB::Table', 6);
+    template.resourceCountIs('AWS::DynamoDB::Table', 11);
     
     // Verify all Lambda functions are created
-    template.resourceCountIs('AWS::Lambda::Function', 6);
+    template.resourceCountIs('AWS::Lambda::Function', 11);
     
     // Verify GraphQL API with all resolvers
     template.resourceCountIs('AWS::AppSync::Resolver', 7);
@@ -50,8 +50,8 @@ describe('Enhanced Miliare Backend Integration Tests', () => {
     // Verify DynamoDB permissions are granted
     template.hasResourceProperties('AWS::IAM::Policy', {
       PolicyDocument: {
-        Statement: [
-          {
+        Statement: Match.arrayWith([
+          Match.objectLike({
             Effect: 'Allow',
             Action: [
               'dynamodb:BatchGetItem',
@@ -67,8 +67,8 @@ describe('Enhanced Miliare Backend Integration Tests', () => {
               'dynamodb:DeleteItem',
               'dynamodb:DescribeTable'
             ]
-          }
-        ]
+          }),
+        ]),
       }
     });
   });
@@ -200,4 +200,107 @@ describe('Enhanced Miliare Backend Integration Tests', () => {
       ]
     });
   });
-}); 
\ No newline at end of file
+
+  test('Table streams feed the domain event publisher', () => {
+    // Referrals, payments and the outbox stream both images to the stream function
+    template.hasResourceProperties('AWS::DynamoDB::Table', {
+      StreamSpecification: { StreamViewType: 'NEW_AND_OLD_IMAGES' }
+    });
+    template.resourceCountIs('AWS::Lambda::EventSourceMapping', 3);
+    template.hasResourceProperties('AWS::Lambda::EventSourceMapping', {
+      FunctionResponseTypes: ['ReportBatchItemFailures'],
+      BisectBatchOnFunctionError: true
+    });
+
+    // Events go to a dedicated bus
+    template.resourceCountIs('AWS::Events::EventBus', 1);
+    template.hasResourceProperties('AWS::Lambda::Function', {
+      Environment: {
+        Variables: {
+          EVENT_BUS_NAME: {}
+        }
+      }
+    });
+  });
+
+  test('Status change events trigger notifications', () => {
+    template.hasResourceProperties('AWS::Events::Rule', {
+      EventPattern: {
+        source: ['miliare.referrals'],
+        'detail-type': ['ReferralStatusChanged', 'PaymentProcessed']
+      }
+    });
+    template.hasResourceProperties('AWS::Lambda::Function', {
+      Environment: {
+        Variables: {
+          NOTIFICATIONS_TABLE: {},
+          EMAIL_FROM: 'notifications@miliarereferral.com'
+        }
+      }
+    });
+  });
+
+  test('New referrals are delivered to partner webhooks', () => {
+    template.hasResourceProperties('AWS::Events::Rule', {
+      EventPattern: {
+        source: ['miliare.referrals'],
+        'detail-type': ['notification.referralSubmitted', 'webhook.replayRequested']
+      }
+    });
+    template.hasResourceProperties('AWS::DynamoDB::Table', {
+      GlobalSecondaryIndexes: [
+        {
+          IndexName: 'DeadLetterIndex'
+        }
+      ]
+    });
+    template.hasResourceProperties('AWS::Lambda::Function', {
+      Environment: {
+        Variables: {
+          WEBHOOKS_TABLE: {},
+          OUTBOX_TABLE: {}
+        }
+      }
+    });
+  });
+
+  test('Converted leads notify the partner through the outbox', () => {
+    template.hasResourceProperties('AWS::Lambda::Function', {
+      Environment: {
+        Variables: {
+          LEAD_DATA_TABLE: {},
+          OUTBOX_TABLE: {}
+        }
+      }
+    });
+  });
+
+  test('Partners call the partner API with their own credentials', () => {
+    template.hasResourceProperties('AWS::ApiGateway::Resource', {
+      PathPart: 'partner-api'
+    });
+    template.hasResourceProperties('AWS::ApiGateway::Authorizer', {
+      Type: 'TOKEN',
+      IdentitySource: 'method.request.header.Authorization',
+      AuthorizerResultTtlInSeconds: 60
+    });
+    template.hasResourceProperties('AWS::ApiGateway::Method', {
+      HttpMethod: 'POST',
+      AuthorizationType: 'CUSTOM'
+    });
+    template.hasResourceProperties('AWS::DynamoDB::Table', {
+      GlobalSecondaryIndexes: Match.arrayWith([
+        Match.objectLike({ IndexName: 'CredentialIndex' })
+      ])
+    });
+  });
+
+  test('Every route but the DocuSign callback is authorized', () => {
+    const methods = Object.values(template.findResources('AWS::ApiGateway::Method'))
+      .map((m: any) => m.Properties)
+      .filter((p: any) => p.HttpMethod !== 'OPTIONS');
+    const open = methods.filter((p: any) => !['COGNITO_USER_POOLS', 'CUSTOM'].includes(p.AuthorizationType));
+    expect(open).toHaveLength(1);
+    expect(open[0].ApiKeyRequired).toBeFalsy();
+  });
+});
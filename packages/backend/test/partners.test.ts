@@ -1,5 +1,5 @@
 import * as cdk from 'aws-cdk-lib';
-import { Template } from 'aws-cdk-lib/assertions';
+import { Match, Template } from 'aws-cdk-lib/assertions';
 import { MiliareBackendStack } from '../lib/miliare-backend-stack';
 
 test('Partners lambda and resource created', () => {
@@ -20,3 +20,36 @@ test('Partners lambda and resource created', () => {
     }
   });
 });
+
+test('Partners move through approval and the user and lead functions check they are active', () => {
+  const app = new cdk.App();
+  const stack = new MiliareBackendStack(app, 'TestStack', {
+    restDomainName: 'api.example.com',
+    hostedZoneId: 'Z1111111111',
+    env: { account: '111111111111', region: 'us-east-1' }
+  });
+
+  const template = Template.fromStack(stack);
+
+  template.hasResourceProperties('AWS::ApiGateway::Resource', {
+    PathPart: 'status'
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: Match.arrayWith([
+        Match.objectLike({
+          Action: 'dynamodb:ConditionCheckItem',
+          Effect: 'Allow'
+        })
+      ])
+    }
+  });
+  template.hasResourceProperties('AWS::Lambda::Function', {
+    Environment: {
+      Variables: {
+        LEAD_DATA_TABLE: {},
+        PARTNERS_TABLE: {}
+      }
+    }
+  });
+});
@@ -1,5 +1,5 @@
 import * as cdk from 'aws-cdk-lib';
-import { Template } from 'aws-cdk-lib/assertions';
+import { Match, Template } from 'aws-cdk-lib/assertions';
 import { MiliareBackendStack } from '../lib/miliare-backend-stack';
 
 test('Payment REST API endpoints are configured', () => {
@@ -15,8 +15,8 @@ test('Payment REST API endpoints are configured', () => {
   // Test that profile function has proper permissions to payments table
   template.hasResourceProperties('AWS::IAM::Policy', {
     PolicyDocument: {
-      Statement: [
-        {
+      Statement: Match.arrayWith([
+        Match.objectLike({
           Effect: 'Allow',
           Action: [
             'dynamodb:BatchGetItem',
@@ -32,8 +32,8 @@ test('Payment REST API endpoints are configured', () => {
             'dynamodb:DeleteItem',
             'dynamodb:DescribeTable'
           ]
-        }
-      ]
+        }),
+      ]),
     }
   });
 });
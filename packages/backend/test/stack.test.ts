@@ -1,5 +1,5 @@
 import * as cdk from 'aws-cdk-lib';
-import { Template } from 'aws-cdk-lib/assertions';
+import { Match, Template } from 'aws-cdk-lib/assertions';
 import * as dynamodb from 'aws-cdk-lib/aws-dynamodb';
 import { RemovalPolicy } from 'aws-cdk-lib';
 import { MiliareBackendStack } from '../lib/miliare-backend-stack';
@@ -51,8 +51,43 @@ test('Stack includes core DynamoDB tables', () => {
     billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
   });
 
+  new dynamodb.Table(stack, 'AuditTable', {
+    partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+    sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+    removalPolicy: RemovalPolicy.DESTROY,
+    billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+  });
+
+  new dynamodb.Table(stack, 'OutboxTable', {
+    partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+    sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+    removalPolicy: RemovalPolicy.DESTROY,
+    billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+  });
+
+  new dynamodb.Table(stack, 'IdempotencyTable', {
+    partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+    sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+    removalPolicy: RemovalPolicy.DESTROY,
+    billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+  });
+
+  new dynamodb.Table(stack, 'NotificationsTable', {
+    partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+    sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+    removalPolicy: RemovalPolicy.DESTROY,
+    billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+  });
+
+  new dynamodb.Table(stack, 'WebhooksTable', {
+    partitionKey: { name: 'PK', type: dynamodb.AttributeType.STRING },
+    sortKey: { name: 'SK', type: dynamodb.AttributeType.STRING },
+    removalPolicy: RemovalPolicy.DESTROY,
+    billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+  });
+
   const template = Template.fromStack(stack);
-  template.resourceCountIs('AWS::DynamoDB::Table', 6);
+  template.resourceCountIs('AWS::DynamoDB::Table', 11);
 });
 
 test('Enhanced backend stack has all required lambda functions', () => {
@@ -65,9 +100,9 @@ test('Enhanced backend stack has all required lambda functions', () => {
 
   const template = Template.fromStack(stack);
   
-  // Test that we have the expected number of lambda functions (6 total)
-  // ProfileFunction, UserFunction, PartnerFunction, CustomerFunction, LeadFunction, OpsFunction
-  template.resourceCountIs('AWS::Lambda::Function', 6);
+  // Test that we have the expected number of lambda functions (11 total)
+  // ProfileFunction, UserFunction, PartnerFunction, CustomerFunction, LeadFunction, OpsFunction, PurgeFunction, StreamFunction, NotifyFunction, AuthorizerFunction, WebhookFunction
+  template.resourceCountIs('AWS::Lambda::Function', 11);
   
   // Test that all functions use ARM64 architecture
   template.hasResourceProperties('AWS::Lambda::Function', {
@@ -136,8 +171,8 @@ test('Enhanced security and permissions configuration', () => {
   // Test that IAM policies exist for DynamoDB access
   template.hasResourceProperties('AWS::IAM::Policy', {
     PolicyDocument: {
-      Statement: [
-        {
+      Statement: Match.arrayWith([
+        Match.objectLike({
           Effect: 'Allow',
           Action: [
             'dynamodb:BatchGetItem',
@@ -153,8 +188,8 @@ test('Enhanced security and permissions configuration', () => {
             'dynamodb:DeleteItem',
             'dynamodb:DescribeTable'
           ]
-        }
-      ]
+        }),
+      ]),
     }
   });
 });
@@ -180,3 +215,21 @@ test('Domain and DNS configuration', () => {
     Name: 'api.example.com.miliarereferral.com.'
   });
 });
+
+test('Referrals table indexes can be added one deploy at a time', () => {
+  const indexNames = (context: Record<string, unknown>) => {
+    const app = new cdk.App({ context });
+    const stack = new MiliareBackendStack(app, 'TestStack', {
+      restDomainName: 'api.example.com',
+      hostedZoneId: 'Z1111111111',
+      env: { account: '111111111111', region: 'us-east-1' }
+    });
+    const tables = Template.fromStack(stack).findResources('AWS::DynamoDB::Table');
+    const id = Object.keys(tables).find((key) => key.startsWith('ReferralsTable'))!;
+    return tables[id].Properties.GlobalSecondaryIndexes.map((index: { IndexName: string }) => index.IndexName);
+  };
+
+  expect(indexNames({ referralsTableIndexes: 1 })).toEqual(['UserIndex']);
+  expect(indexNames({ referralsTableIndexes: 2 })).toEqual(['UserIndex', 'CustomerIndex']);
+  expect(indexNames({})).toEqual(['UserIndex', 'CustomerIndex', 'CompanyIndex']);
+});